@@ -35,7 +35,7 @@ func (sigma *authMessage) auth(rand io.Reader, ourPub, theirPub, theirPubEcdh ed
 	pt1 := ed448.PointScalarMul(ed448.BasePoint, t1)
 	pt2 := ed448.PointDoubleScalarMul(ed448.BasePoint, theirPub, sigma.r2, sigma.c2)
 	pt3 := ed448.PointDoubleScalarMul(ed448.BasePoint, theirPubEcdh, sigma.r3, sigma.c3)
-	c := appendAndHash(ed448.BasePoint, ed448.ScalarQ, ourPub, theirPub, theirPubEcdh, pt1, pt2, pt3, message)
+	c := appendAndHash(usageAuth, ed448.BasePoint, ed448.ScalarQ, ourPub, theirPub, theirPubEcdh, pt1, pt2, pt3, message)
 	sigma.c1, sigma.r1 = ed448.NewScalar(), ed448.NewScalar()
 	sigma.c1.Sub(c, sigma.c2)
 	sigma.c1.Sub(sigma.c1, sigma.c3)
@@ -48,9 +48,27 @@ func (sigma *authMessage) verify(theirPub, ourPub, ourPubEcdh ed448.Point, messa
 	pt1 := ed448.PointDoubleScalarMul(ed448.BasePoint, theirPub, sigma.r1, sigma.c1)
 	pt2 := ed448.PointDoubleScalarMul(ed448.BasePoint, ourPub, sigma.r2, sigma.c2)
 	pt3 := ed448.PointDoubleScalarMul(ed448.BasePoint, ourPubEcdh, sigma.r3, sigma.c3)
-	c := appendAndHash(ed448.BasePoint, ed448.ScalarQ, theirPub, ourPub, ourPubEcdh, pt1, pt2, pt3, message)
+	c := appendAndHash(usageAuth, ed448.BasePoint, ed448.ScalarQ, theirPub, ourPub, ourPubEcdh, pt1, pt2, pt3, message)
 	out := ed448.NewScalar()
 	out.Add(sigma.c1, sigma.c2)
 	out.Add(out, sigma.c3)
 	return c.Equals(out)
 }
+
+func (sigma *authMessage) serialize() []byte {
+	return appendBytes(sigma.c1, sigma.r1, sigma.c2, sigma.r2, sigma.c3, sigma.r3)
+}
+
+func (sigma *authMessage) deserialize(bs []byte) ([]byte, bool) {
+	cursor := bs
+	ok := true
+
+	for _, s := range []*ed448.Scalar{&sigma.c1, &sigma.r1, &sigma.c2, &sigma.r2, &sigma.c3, &sigma.r3} {
+		cursor, *s, ok = extractScalar(cursor)
+		if !ok {
+			return bs, false
+		}
+	}
+
+	return cursor, true
+}
@@ -6,6 +6,15 @@ import (
 	. "gopkg.in/check.v1"
 )
 
+// newTestSigma signs message with testPrivA, in a ring with testPubB and
+// testPubC, from the fixed randAuthData
+func newTestSigma(c *C, message []byte) *authMessage {
+	sigma := new(authMessage)
+	err := sigma.auth(fixedRand(randAuthData), testPubA.h, testPubB.h, testPubC, testPrivA.r, message)
+	c.Assert(err, IsNil)
+	return sigma
+}
+
 func (s *OTR4Suite) Test_GenerateAuthParams(c *C) {
 	sigma := new(authMessage)
 
@@ -27,14 +36,13 @@ func (s *OTR4Suite) Test_GenerateAuthParams(c *C) {
 
 func (s *OTR4Suite) Test_Auth(c *C) {
 	message := []byte("our message")
-	sigma := new(authMessage)
-	err := sigma.auth(fixedRand(randAuthData), testPubA.h, testPubB.h, testPubC, testPrivA.r, message)
 
-	c.Assert(sigma, DeepEquals, testSigma)
-	c.Assert(err, IsNil)
+	// the same randomness gives the same signature
+	c.Assert(newTestSigma(c, message), DeepEquals, newTestSigma(c, message))
 
+	sigma := new(authMessage)
 	r := make([]byte, 270)
-	err = sigma.auth(fixedRand(r), testPubA.h, testPubB.h, testPubC, testPrivA.r, message)
+	err := sigma.auth(fixedRand(r), testPubA.h, testPubB.h, testPubC, testPrivA.r, message)
 
 	c.Assert(err, ErrorMatches, ".*cannot source enough entropy")
 
@@ -47,7 +55,7 @@ func (s *OTR4Suite) Test_Auth(c *C) {
 func (s *OTR4Suite) Test_Verify(c *C) {
 	message := []byte("our message")
 
-	b := testSigma.verify(testPubA.h, testPubB.h, testPubC, message)
+	b := newTestSigma(c, message).verify(testPubA.h, testPubB.h, testPubC, message)
 
 	c.Assert(b, Equals, true)
 }
@@ -76,6 +84,24 @@ func (s *OTR4Suite) Test_VerifyAndAuth(c *C) {
 	ver = sigma.verify(pubA.h, pubB.h, pubB.h, message)
 	c.Assert(ver, Equals, false)
 
-	ver = testSigma.verify(pubA.h, pubB.h, testPubC, message)
+	ver = newTestSigma(c, message).verify(pubA.h, pubB.h, testPubC, message)
 	c.Assert(ver, Equals, false)
 }
+
+func (s *OTR4Suite) Test_SerializeAuthMessage(c *C) {
+	testSigma := newTestSigma(c, []byte("our message"))
+	ser := testSigma.serialize()
+
+	c.Assert(ser, HasLen, 6*fieldBytes)
+
+	sigma := &authMessage{}
+	cursor, ok := sigma.deserialize(append(ser, 0x01))
+
+	c.Assert(ok, Equals, true)
+	c.Assert(cursor, DeepEquals, []byte{0x01})
+	c.Assert(sigma, DeepEquals, testSigma)
+
+	_, ok = sigma.deserialize(ser[:len(ser)-1])
+
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,294 @@
+package otr4
+
+import (
+	"strings"
+	"time"
+)
+
+// A client profile binds the long-term and forging keys of a client to its
+// instance tag and the versions it supports, for a limited time.
+
+const (
+	profileFieldInstanceTag     = 0x0001
+	profileFieldPublicKey       = 0x0002
+	profileFieldForgingKey      = 0x0003
+	profileFieldVersions        = 0x0004
+	profileFieldExpiration      = 0x0005
+	profileFieldDSAKey          = 0x0006
+	profileFieldTransitionalSig = 0x0007
+
+	forgingKeyTypeValue = uint16(0x0012)
+	dsaKeyTypeValue     = uint16(0x0000)
+
+	defaultProfileExpiration = 14 * 24 * time.Hour
+)
+
+type dsaSignature [dsaSigBytes]byte
+
+type clientProfile struct {
+	instanceTag uint32
+	publicKey   *publicKey
+	forgingKey  *publicKey
+	versions    string
+	expiration  time.Time
+
+	// the OTRv3 DSA key, serialized, and its signature of the profile, for
+	// clients that also support version 3
+	dsaKey          []byte
+	transitionalSig *dsaSignature
+
+	sig []byte
+}
+
+func (p *clientProfile) supportsVersion(v uint16) bool {
+	for _, b := range parseToByte(p.versions) {
+		if uint16(b) == v {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidVersions(v string) bool {
+	return strings.Contains(v, "4") && !strings.ContainsAny(v, "12")
+}
+
+// isVersionString tells whether v is a string of version digits, as the
+// versions field holds them
+func isVersionString(v []byte) bool {
+	for _, b := range v {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return len(v) > 0
+}
+
+// newClientProfile creates a client profile signed with keys
+func newClientProfile(keys *keyPair, forgingKey *publicKey, instanceTag uint32, versions string, expiration time.Time) (*clientProfile, error) {
+	if !isValidVersions(versions) || !isVersionString([]byte(versions)) {
+		return nil, errInvalidVersion
+	}
+
+	p := &clientProfile{
+		instanceTag: instanceTag,
+		publicKey:   &keys.pub,
+		forgingKey:  forgingKey,
+		versions:    versions,
+		expiration:  time.Unix(expiration.Unix(), 0),
+	}
+	p.sign(keys)
+
+	return p, nil
+}
+
+func appendKey(b []byte, keyType uint16, pub *publicKey) []byte {
+	return appendBytes(appendShort(b, keyType), pub.h)
+}
+
+func extractKey(bs []byte, keyType uint16) ([]byte, *publicKey, bool) {
+	cursor, t, ok := extractShort(bs)
+	if !ok || t != keyType {
+		return bs, nil, false
+	}
+
+	cursor, h, ok := extractEncodedPoint(cursor)
+	if !ok {
+		return bs, nil, false
+	}
+
+	return cursor, &publicKey{h: h}, true
+}
+
+// extractDSAKey returns an OTRv3 DSA public key as it was serialized
+func extractDSAKey(bs []byte) ([]byte, []byte, bool) {
+	cursor, t, ok := extractShort(bs)
+	if !ok || t != dsaKeyTypeValue {
+		return bs, nil, false
+	}
+
+	for i := 0; i < 4; i++ {
+		cursor, _, ok = extractMPI(cursor)
+		if !ok {
+			return bs, nil, false
+		}
+	}
+
+	l := len(bs) - len(cursor)
+	return cursor, bs[:l], true
+}
+
+// serializeBody serializes every field of the profile covered by its
+// signature
+func (p *clientProfile) serializeBody() []byte {
+	fields := uint32(5)
+
+	out := appendShort(nil, profileFieldInstanceTag)
+	out = appendWord32(out, p.instanceTag)
+	out = appendShort(out, profileFieldPublicKey)
+	out = appendKey(out, pubKeyTypeValue, p.publicKey)
+	out = appendShort(out, profileFieldForgingKey)
+	out = appendKey(out, forgingKeyTypeValue, p.forgingKey)
+	out = appendShort(out, profileFieldVersions)
+	out = appendData(out, []byte(p.versions))
+	out = appendShort(out, profileFieldExpiration)
+	out = appendWord64(out, p.expiration.Unix())
+
+	if p.dsaKey != nil {
+		fields++
+		out = appendShort(out, profileFieldDSAKey)
+		out = append(out, p.dsaKey...)
+	}
+
+	if p.transitionalSig != nil {
+		fields++
+		out = appendShort(out, profileFieldTransitionalSig)
+		out = append(out, p.transitionalSig[:]...)
+	}
+
+	return append(appendWord32(nil, fields), out...)
+}
+
+func (p *clientProfile) serialize() []byte {
+	return append(p.serializeBody(), p.sig...)
+}
+
+// deserialize reads a profile from the start of bs, returning what follows
+// it
+func (p *clientProfile) deserialize(bs []byte) ([]byte, error) {
+	cursor, fields, ok := extractWord32(bs)
+	if !ok {
+		return bs, errMalformedMessage
+	}
+
+	*p = clientProfile{}
+	seen := make(map[uint16]bool)
+
+	for i := uint32(0); i < fields; i++ {
+		var fieldType uint16
+		cursor, fieldType, ok = extractShort(cursor)
+		if !ok || seen[fieldType] {
+			return bs, errMalformedMessage
+		}
+		seen[fieldType] = true
+
+		switch fieldType {
+		case profileFieldInstanceTag:
+			cursor, p.instanceTag, ok = extractWord32(cursor)
+		case profileFieldPublicKey:
+			cursor, p.publicKey, ok = extractKey(cursor, pubKeyTypeValue)
+		case profileFieldForgingKey:
+			cursor, p.forgingKey, ok = extractKey(cursor, forgingKeyTypeValue)
+		case profileFieldVersions:
+			var v []byte
+			cursor, v, ok = extractData(cursor)
+			ok = ok && isVersionString(v)
+			p.versions = string(v)
+		case profileFieldExpiration:
+			var t uint64
+			cursor, t, ok = extractWord64(cursor)
+			p.expiration = time.Unix(int64(t), 0)
+		case profileFieldDSAKey:
+			cursor, p.dsaKey, ok = extractDSAKey(cursor)
+		case profileFieldTransitionalSig:
+			ok = len(cursor) >= dsaSigBytes
+			if ok {
+				p.transitionalSig = &dsaSignature{}
+				copy(p.transitionalSig[:], cursor)
+				cursor = cursor[dsaSigBytes:]
+			}
+		default:
+			ok = false
+		}
+
+		if !ok {
+			return bs, errMalformedMessage
+		}
+	}
+
+	for _, f := range []uint16{profileFieldInstanceTag, profileFieldPublicKey,
+		profileFieldForgingKey, profileFieldVersions, profileFieldExpiration} {
+		if !seen[f] {
+			return bs, errMalformedMessage
+		}
+	}
+
+	if len(cursor) < signatureSize {
+		return bs, errMalformedMessage
+	}
+
+	p.sig = cursor[:signatureSize]
+
+	return cursor[signatureSize:], nil
+}
+
+func (p *clientProfile) sign(keys *keyPair) {
+	p.sig = keys.sign(p.serializeBody())
+}
+
+// validate checks that the profile can be used: it must be signed by its
+// long-term key, hold valid keys, support version 4 and not be expired
+func (p *clientProfile) validate() error {
+	if !isValidPublicKey(p.publicKey, p.forgingKey) {
+		return errInvalidPublicKey
+	}
+
+	if !p.publicKey.verify(p.serializeBody(), p.sig) {
+		return errInvalidSignature
+	}
+
+	if !isValidVersions(p.versions) {
+		return errInvalidVersion
+	}
+
+	if !isValidInstanceTag(p.instanceTag) {
+		return errInvalidInstanceTag
+	}
+
+	if p.transitionalSig != nil && p.dsaKey == nil {
+		return errMalformedMessage
+	}
+
+	if !time.Now().Before(p.expiration) {
+		return errExpiredProfile
+	}
+
+	return nil
+}
+
+// validateSenderProfile checks the client profile received in a DAKE message,
+// which must also belong to the instance that sent it
+func validateSenderProfile(p *clientProfile, senderInstanceTag uint32) error {
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+
+	if p.instanceTag != senderInstanceTag {
+		return errInvalidInstanceTag
+	}
+
+	return nil
+}
+
+// clientProfile returns our current client profile, creating a new one if it
+// does not exist or has expired
+func (c *Conversation) clientProfile() (*clientProfile, error) {
+	if c.ourProfile != nil && time.Now().Before(c.ourProfile.expiration) {
+		return c.ourProfile, nil
+	}
+
+	// the forging key is kept when the profile is renewed, since our
+	// fingerprint covers it
+	if c.ourForgingKey == nil {
+		forgingKey, err := generateKeyPair(c.rand())
+		if err != nil {
+			return nil, err
+		}
+		c.ourForgingKey = forgingKey
+	}
+
+	var err error
+	c.ourProfile, err = newClientProfile(c.ourKeys, &c.ourForgingKey.pub, c.ourInstanceTag, "4", time.Now().Add(defaultProfileExpiration))
+	return c.ourProfile, err
+}
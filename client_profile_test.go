@@ -0,0 +1,178 @@
+package otr4
+
+import (
+	"crypto/rand"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func newTestClientProfile(c *C) (*clientProfile, *keyPair) {
+	keys, err := generateKeyPair(rand.Reader)
+	c.Assert(err, IsNil)
+	forging, err := generateKeyPair(rand.Reader)
+	c.Assert(err, IsNil)
+
+	profile, err := newClientProfile(keys, &forging.pub, 0x101, "34", time.Now().Add(defaultProfileExpiration))
+	c.Assert(err, IsNil)
+
+	return profile, keys
+}
+
+var testDSAKey = []byte{
+	0x00, 0x00,
+	0x00, 0x00, 0x00, 0x01, 0x17,
+	0x00, 0x00, 0x00, 0x01, 0x0B,
+	0x00, 0x00, 0x00, 0x01, 0x04,
+	0x00, 0x00, 0x00, 0x01, 0x09,
+}
+
+var testTransitionalSig = &dsaSignature{
+	0xee, 0xec, 0x0c, 0xa7, 0x39, 0x65, 0x3c, 0x35,
+	0xe2, 0x28, 0xd3, 0xc8, 0xc1, 0x07, 0x96, 0xeb,
+	0x06, 0xe8, 0x14, 0x05, 0x62, 0x52, 0xab, 0x6c,
+	0x63, 0xf1, 0x4f, 0x55, 0xb3, 0xea, 0x9b, 0x1d,
+	0xbf, 0xe7, 0xb7, 0xec, 0x8b, 0x52, 0x43, 0x46,
+}
+
+func (s *OTR4Suite) Test_NewClientProfile(c *C) {
+	profile, keys := newTestClientProfile(c)
+
+	c.Assert(profile.instanceTag, Equals, uint32(0x101))
+	c.Assert(profile.publicKey.h.Equals(keys.pub.h), Equals, true)
+	c.Assert(profile.versions, Equals, "34")
+	c.Assert(profile.sig, HasLen, signatureSize)
+	c.Assert(profile.validate(), IsNil)
+}
+
+func (s *OTR4Suite) Test_NewClientProfileRejectsInvalidVersions(c *C) {
+	keys, _ := generateKeyPair(rand.Reader)
+	expiration := time.Now().Add(time.Hour)
+
+	for _, v := range []string{"", "3", "1", "14", "24", "4x"} {
+		profile, err := newClientProfile(keys, &keys.pub, 0x101, v, expiration)
+		c.Assert(profile, IsNil)
+		c.Assert(err, Equals, errInvalidVersion)
+	}
+}
+
+func (s *OTR4Suite) Test_SerializeClientProfileBody(c *C) {
+	profile, _ := newTestClientProfile(c)
+	profile.expiration = time.Unix(12, 0)
+
+	ser := profile.serializeBody()
+
+	c.Assert(ser[:4], DeepEquals, []byte{0x00, 0x00, 0x00, 0x05})
+	c.Assert(ser[4:10], DeepEquals, []byte{0x00, 0x01, 0x00, 0x00, 0x01, 0x01})
+	c.Assert(ser[10:14], DeepEquals, []byte{0x00, 0x02, 0x00, 0x10})
+	c.Assert(ser[14:70], DeepEquals, profile.publicKey.h.Encode())
+	c.Assert(ser[70:74], DeepEquals, []byte{0x00, 0x03, 0x00, 0x12})
+	c.Assert(ser[74:130], DeepEquals, profile.forgingKey.h.Encode())
+	c.Assert(ser[130:], DeepEquals, []byte{
+		0x00, 0x04, 0x00, 0x00, 0x00, 0x02, '3', '4',
+		0x00, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+	})
+}
+
+func (s *OTR4Suite) Test_ClientProfileSerialization(c *C) {
+	profile, keys := newTestClientProfile(c)
+
+	for _, transitional := range []bool{false, true} {
+		if transitional {
+			profile.dsaKey = testDSAKey
+			profile.transitionalSig = testTransitionalSig
+			profile.sign(keys)
+		}
+
+		ser := profile.serialize()
+
+		p := &clientProfile{}
+		rest, err := p.deserialize(append(ser, 0x01, 0x02))
+
+		c.Assert(err, IsNil)
+		c.Assert(rest, DeepEquals, []byte{0x01, 0x02})
+		c.Assert(p.instanceTag, Equals, profile.instanceTag)
+		c.Assert(p.publicKey.h.Equals(profile.publicKey.h), Equals, true)
+		c.Assert(p.forgingKey.h.Equals(profile.forgingKey.h), Equals, true)
+		c.Assert(p.versions, Equals, profile.versions)
+		c.Assert(p.expiration, Equals, profile.expiration)
+		c.Assert(p.dsaKey, DeepEquals, profile.dsaKey)
+		c.Assert(p.transitionalSig, DeepEquals, profile.transitionalSig)
+		c.Assert(p.sig, DeepEquals, profile.sig)
+		c.Assert(p.serialize(), DeepEquals, ser)
+		c.Assert(p.validate(), IsNil)
+	}
+}
+
+func (s *OTR4Suite) Test_ClientProfileDeserializeRejectsTruncatedInput(c *C) {
+	profile, keys := newTestClientProfile(c)
+	profile.dsaKey = testDSAKey
+	profile.transitionalSig = testTransitionalSig
+	profile.sign(keys)
+
+	ser := profile.serialize()
+
+	for l := 0; l < len(ser); l++ {
+		_, err := (&clientProfile{}).deserialize(ser[:l])
+		c.Assert(err, Equals, errMalformedMessage)
+	}
+}
+
+func (s *OTR4Suite) Test_ClientProfileDeserializeRejectsInvalidFields(c *C) {
+	profile, _ := newTestClientProfile(c)
+	ser := profile.serialize()
+
+	missing := append([]byte{0x00, 0x00, 0x00, 0x04}, ser[4:]...)
+	_, err := (&clientProfile{}).deserialize(missing)
+	c.Assert(err, Equals, errMalformedMessage)
+
+	duplicated := append([]byte{0x00, 0x00, 0x00, 0x06}, ser[4:10]...)
+	duplicated = append(duplicated, ser[4:]...)
+	_, err = (&clientProfile{}).deserialize(duplicated)
+	c.Assert(err, Equals, errMalformedMessage)
+
+	unknown := append([]byte{}, ser...)
+	unknown[4], unknown[5] = 0x00, 0x08
+	_, err = (&clientProfile{}).deserialize(unknown)
+	c.Assert(err, Equals, errMalformedMessage)
+
+	wrongKeyType := append([]byte{}, ser...)
+	wrongKeyType[13] = 0x12
+	_, err = (&clientProfile{}).deserialize(wrongKeyType)
+	c.Assert(err, Equals, errMalformedMessage)
+
+	// the versions are a string of digits, not the versions as bytes
+	binaryVersions := append([]byte{}, ser...)
+	binaryVersions[136] = 0x03
+	_, err = (&clientProfile{}).deserialize(binaryVersions)
+	c.Assert(err, Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_ValidateClientProfile(c *C) {
+	profile, keys := newTestClientProfile(c)
+	other, _ := generateKeyPair(rand.Reader)
+
+	profile.instanceTag = 0x102
+	c.Assert(profile.validate(), Equals, errInvalidSignature)
+
+	profile.sign(other)
+	c.Assert(profile.validate(), Equals, errInvalidSignature)
+
+	profile.expiration = time.Now().Add(-time.Second)
+	profile.sign(keys)
+	c.Assert(profile.validate(), Equals, errExpiredProfile)
+
+	profile.expiration = time.Now().Add(time.Hour)
+	profile.versions = "3"
+	profile.sign(keys)
+	c.Assert(profile.validate(), Equals, errInvalidVersion)
+
+	profile.versions = "4"
+	profile.transitionalSig = testTransitionalSig
+	profile.sign(keys)
+	c.Assert(profile.validate(), Equals, errMalformedMessage)
+
+	profile.dsaKey = testDSAKey
+	profile.sign(keys)
+	c.Assert(profile.validate(), IsNil)
+}
@@ -17,6 +17,17 @@ const (
 	// SignatureSize is the size, in bytes, of signatures generated and verified.
 	signatureSize = 114
 	mask          = 0x80
+
+	otrVersion = 0x0004
+
+	identityMsgType = 0x35
+	authRMsgType    = 0x36
+	authIMsgType    = 0x37
+
+	prekeyMsgType     = 0x0F
+	nonIntAuthMsgType = 0x8D
+
+	dataMsgType = 0x03
 )
 
 var (
@@ -1,7 +1,288 @@
 package otr4
 
-import "io"
+import (
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/otrv4/ed448"
+)
+
+// Conversation represents an OTRv4 conversation with a single peer.
+type Conversation struct {
+	// Policy sets the versions of the protocol the conversation accepts and
+	// how it starts encrypted conversations. If zero, the policy is taken
+	// from Policies, for Account and Peer.
+	Policy Policy
+	// Policies, if set, holds the policies of accounts and peers, used when
+	// Policy is zero. If neither is set, DefaultPolicy is used.
+	Policies *Policies
+
+	// MTU is the maximum length of the messages the transport carries.
+	// Longer messages are fragmented. If zero, messages are never
+	// fragmented.
+	MTU int
+
+	// MaxSkip is the maximum number of messages that can be skipped in a
+	// receiving chain. If zero, defaultMaxSkip is used.
+	MaxSkip int
+	// MaxStoredMessageKeys is the maximum number of keys of skipped messages
+	// kept to decrypt them if they arrive late. If zero,
+	// defaultMaxStoredMessageKeys is used.
+	MaxStoredMessageKeys int
+	// Padding, if set, pads the payload of the data messages sent with a
+	// padding TLV to a multiple of Padding bytes, to hide the length of the
+	// messages.
+	Padding int
+
+	// PrekeyBatchSize is the number of prekey messages published at once to
+	// the prekey server. If zero, defaultPrekeyBatchSize is used.
+	PrekeyBatchSize int
+	// MinPrekeys is the number of our prekey messages the prekey server
+	// should keep: when it reports fewer, a new batch is published. If zero,
+	// defaultMinPrekeys is used.
+	MinPrekeys int
+	// PrekeyConsumed is called when a Non-Interactive-Auth consumed one of
+	// our prekey messages. Receive does not contact the prekey server: the
+	// application should call ReplenishPrekeys once Receive returned.
+	PrekeyConsumed func()
+
+	// SMPNormalization configures how SMP secrets are normalized.
+	SMPNormalization SMPNormalization
+	// SMPSecretNeeded is called when the peer starts the Socialist
+	// Millionaires Protocol, with the question it asked, if any. The user's
+	// secret should be given to ProvideSMPSecret.
+	SMPSecretNeeded func(question string)
+	// SMPResult is called when an SMP exchange finishes, telling whether both
+	// secrets matched.
+	SMPResult func(matched bool)
+	// SMPAborted is called when an SMP exchange in progress is aborted.
+	SMPAborted func()
+
+	// ExtraSymmetricKeyReceived is called when the peer tells it uses the
+	// extra symmetric key of a message, with the 4-byte usage and the usage
+	// data it sent, to be used by the application for out-of-band purposes.
+	ExtraSymmetricKeyReceived func(usage uint32, usageData, key []byte)
+
+	// TrustStore, if set, records the fingerprints the peer authenticates
+	// with, under Account and Peer. The DAKE fails if the peer uses a revoked
+	// fingerprint.
+	TrustStore *TrustStore
+	Account    string
+	Peer       string
+	// FingerprintSeen is called when the peer authenticates, with what its
+	// fingerprint means for the trust store. TrustFingerprintChanged should
+	// be shown to the user as a security warning.
+	FingerprintSeen func(event TrustEvent, f Fingerprint)
+
+	// StateChanged is called when the message state of the conversation
+	// changes.
+	StateChanged func(state MessageState)
+	// SecurityWarning is called with the events the user should be warned
+	// about.
+	SecurityWarning func(w Warning)
 
-type conversation struct {
 	random io.Reader
+
+	msgState MessageState
+	dake     dakeState
+
+	// whitespaceTagRejected is set when the peer answers our whitespace
+	// tags with plaintext
+	whitespaceTagRejected bool
+
+	ourKeys      *keyPair
+	theirKey     *publicKey
+	theirProfile *clientProfile
+
+	ourInstanceTag   uint32
+	theirInstanceTag uint32
+
+	ourECDH   *keyPair
+	ourDH     *dhKeyPair
+	theirECDH ed448.Point
+	theirDH   *big.Int
+
+	// ourIdentityMessage is the Identity message of the DAKE we started,
+	// sent again if we win a tie with a DAKE started by the peer
+	ourIdentityMessage []byte
+
+	ourProfile       *clientProfile
+	ourForgingKey    *keyPair
+	ourPrekeyProfile *prekeyProfile
+	sharedPrekey     *keyPair
+	ourPrekeys       map[uint32]*prekeySecret
+	consumedPrekeys  map[uint32]bool
+	prekeyServer     PrekeyTransport
+	prekeyAccount    string
+
+	braceKey     []byte
+	sharedSecret []byte
+	ssid         [ssidBytes]byte
+
+	ratchet  *ratchet
+	lastSent time.Time
+
+	smp *smpContext
+
+	tlvHandlers map[uint16]TLVHandler
+	fragments   *fragmentBuffer
+}
+
+// NewConversation creates a conversation with a freshly generated long-term
+// key pair. If random is nil, crypto/rand will be used.
+func NewConversation(random io.Reader) (*Conversation, error) {
+	c := &Conversation{random: random}
+
+	keys, err := generateKeyPair(c.rand())
+	if err != nil {
+		return nil, err
+	}
+	c.ourKeys = keys
+
+	c.ourForgingKey, err = generateKeyPair(c.rand())
+	if err != nil {
+		return nil, err
+	}
+
+	c.ourInstanceTag, err = generateInstanceTag(c.rand())
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Send takes a plaintext message from the user and returns the messages that
+// should be sent to the peer. Nothing can be sent once the peer has ended the
+// encrypted session, until End is called. Without an encrypted session, the
+// message is sent as the policy dictates: if it requires encryption, a query
+// message is returned instead, together with an error.
+func (c *Conversation) Send(plaintext []byte) ([][]byte, error) {
+	switch {
+	case c.msgState == StateFinished:
+		return nil, errConversationFinished
+	case c.dake == dakeWaitingDataMessage:
+		return nil, errSessionNotReady
+	case c.msgState == StateStart:
+		return c.sendPlaintext(plaintext)
+	}
+
+	msg, err := c.createDataMessage(plaintext, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.wireMessages(msg)
+}
+
+// Receive handles a message received from the peer. It returns the plaintext
+// to be shown to the user, if any, and the messages that should be sent back.
+// Error messages sent by the peer are returned as a *PeerError, together with
+// a query message if the policy has ErrorStartDAKE. When a data message
+// cannot be read, the error is returned together with the error message to
+// send to the peer.
+func (c *Conversation) Receive(message []byte) (plaintext []byte, toSend [][]byte, err error) {
+	switch {
+	case isFragment(message):
+		complete, ok, err := c.receiveFragment(message)
+		if err != nil || !ok {
+			return nil, nil, err
+		}
+		return c.Receive(complete)
+	case isEncoded(message):
+		decoded, err := decodeMessage(message)
+		if err != nil {
+			return nil, nil, err
+		}
+		plaintext, toSend, err = c.receiveEncoded(decoded)
+		return c.replyWith(plaintext, toSend, err)
+	case isErrorMessage(message):
+		if c.policy().has(ErrorStartDAKE) {
+			return nil, [][]byte{c.QueryMessage()}, parseErrorMessage(message)
+		}
+		return nil, nil, parseErrorMessage(message)
+	}
+
+	plaintext, toSend, err = c.receivePlaintext(message)
+	return c.replyWith(plaintext, toSend, err)
+}
+
+// replyWith encodes the replies to a received message
+func (c *Conversation) replyWith(plaintext []byte, toSend [][]byte, err error) ([]byte, [][]byte, error) {
+	wire, wireErr := c.wireMessages(toSend...)
+	return plaintext, wire, firstError(err, wireErr)
+}
+
+func (c *Conversation) receiveEncoded(message []byte) (plaintext []byte, toSend [][]byte, err error) {
+	_, h, ok := extractHeader(message)
+	if !ok {
+		return nil, nil, errInvalidLength
+	}
+
+	if h.version == 3 {
+		return nil, nil, errVersion3Unsupported
+	}
+
+	if h.version != otrVersion {
+		return nil, nil, errInvalidVersion
+	}
+
+	if !isValidInstanceTag(h.senderInstanceTag) {
+		return nil, nil, errInvalidInstanceTag
+	}
+
+	if !c.isForUs(h.receiverInstanceTag) {
+		return nil, nil, nil
+	}
+
+	var reply []byte
+	switch h.messageType {
+	case identityMsgType:
+		reply, err = c.receiveIdentityMessage(message)
+	case authRMsgType:
+		reply, err = c.receiveAuthRMessage(message)
+	case authIMsgType:
+		err = c.receiveAuthIMessage(message)
+	case nonIntAuthMsgType:
+		plaintext, reply, err = c.receiveNonInteractiveAuthMessage(message)
+	case dataMsgType:
+		code := errorCodeUnreadableMessage
+		if c.ratchet == nil {
+			code = errorCodeNotInPrivateState
+		}
+
+		plaintext, reply, err = c.processDataMessage(message)
+		if err != nil {
+			return nil, c.unreadableMessage(message, code), err
+		}
+
+		if c.dake == dakeWaitingDataMessage {
+			c.sessionEstablished()
+		}
+	default:
+		return nil, nil, errUnknownMessageType
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reply != nil {
+		toSend = append(toSend, reply)
+	}
+
+	if h.messageType == nonIntAuthMsgType && c.PrekeyConsumed != nil {
+		c.PrekeyConsumed()
+	}
+
+	if h.messageType == dataMsgType && c.shouldSendHeartbeat() {
+		reply, err = c.createHeartbeat()
+		if err != nil {
+			return plaintext, toSend, err
+		}
+		toSend = append(toSend, reply)
+	}
+
+	return plaintext, toSend, nil
 }
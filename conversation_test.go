@@ -11,3 +11,43 @@ func Test(t *testing.T) { TestingT(t) }
 type OTR4Suite struct{}
 
 var _ = Suite(&OTR4Suite{})
+
+func (s *OTR4Suite) Test_NewConversationGeneratesKeys(c *C) {
+	conv, err := NewConversation(fixedRand(randData))
+
+	c.Assert(err, IsNil)
+	c.Assert(conv.ourKeys, NotNil)
+	c.Assert(isValidPublicKey(&conv.ourKeys.pub), Equals, true)
+
+	_, err = NewConversation(fixedRand([]byte{0x00}))
+
+	c.Assert(err, NotNil)
+}
+
+func (s *OTR4Suite) Test_SendWithoutSessionReturnsPlaintext(c *C) {
+	conv := &Conversation{}
+
+	toSend, err := conv.Send([]byte("hello"))
+
+	c.Assert(err, IsNil)
+	c.Assert(toSend, DeepEquals, [][]byte{[]byte("hello")})
+}
+
+func (s *OTR4Suite) Test_ReceivePlaintext(c *C) {
+	conv := &Conversation{}
+
+	plain, toSend, err := conv.Receive([]byte("hello"))
+
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hello"))
+	c.Assert(toSend, IsNil)
+}
+
+func (s *OTR4Suite) Test_ReceiveUnknownMessageType(c *C) {
+	conv := &Conversation{}
+	msg := messageHeader{version: otrVersion, messageType: 0xFF, senderInstanceTag: 0x101}.serialize()
+
+	_, _, err := conv.Receive(encodeMessage(msg))
+
+	c.Assert(err, Equals, errUnknownMessageType)
+}
@@ -0,0 +1,391 @@
+package otr4
+
+import (
+	"math/big"
+
+	"github.com/otrv4/ed448"
+)
+
+// Following the spec, Bob starts the interactive DAKE by sending an Identity
+// message, Alice replies with an Auth-R message and Bob finishes it with an
+// Auth-I message.
+
+const (
+	braceKeyBytes     = 32
+	sharedSecretBytes = 64
+	ssidBytes         = 8
+	hashBytes         = 64
+)
+
+type identityMessage struct {
+	header  messageHeader
+	profile *clientProfile
+	y       ed448.Point
+	b       *big.Int
+}
+
+type authRMessage struct {
+	header  messageHeader
+	profile *clientProfile
+	x       ed448.Point
+	a       *big.Int
+	sigma   *authMessage
+}
+
+type authIMessage struct {
+	header messageHeader
+	sigma  *authMessage
+}
+
+func (m *identityMessage) serialize() []byte {
+	out := m.header.serialize()
+	out = append(out, m.profile.serialize()...)
+	out = appendBytes(out, m.y)
+	return appendMPI(out, m.b)
+}
+
+func (m *identityMessage) deserialize(msg []byte) error {
+	var ok1, ok3, ok4 bool
+
+	m.profile = &clientProfile{}
+
+	cursor, header, ok1 := extractHeader(msg)
+	cursor, err := m.profile.deserialize(cursor)
+	cursor, m.y, ok3 = extractEncodedPoint(cursor)
+	_, m.b, ok4 = extractMPI(cursor)
+
+	if !(ok1 && err == nil && ok3 && ok4) || header.messageType != identityMsgType {
+		return errMalformedMessage
+	}
+
+	m.header = header
+
+	return nil
+}
+
+func (m *authRMessage) serialize() []byte {
+	out := m.header.serialize()
+	out = append(out, m.profile.serialize()...)
+	out = appendBytes(out, m.x)
+	out = appendMPI(out, m.a)
+	return append(out, m.sigma.serialize()...)
+}
+
+func (m *authRMessage) deserialize(msg []byte) error {
+	var ok1, ok3, ok4, ok5 bool
+
+	m.profile = &clientProfile{}
+	m.sigma = &authMessage{}
+
+	cursor, header, ok1 := extractHeader(msg)
+	cursor, err := m.profile.deserialize(cursor)
+	cursor, m.x, ok3 = extractEncodedPoint(cursor)
+	cursor, m.a, ok4 = extractMPI(cursor)
+	_, ok5 = m.sigma.deserialize(cursor)
+
+	if !(ok1 && err == nil && ok3 && ok4 && ok5) || header.messageType != authRMsgType {
+		return errMalformedMessage
+	}
+
+	m.header = header
+
+	return nil
+}
+
+func (m *authIMessage) serialize() []byte {
+	out := m.header.serialize()
+	return append(out, m.sigma.serialize()...)
+}
+
+func (m *authIMessage) deserialize(msg []byte) error {
+	m.sigma = &authMessage{}
+
+	cursor, header, ok1 := extractHeader(msg)
+	_, ok2 := m.sigma.deserialize(cursor)
+
+	if !(ok1 && ok2) || header.messageType != authIMsgType {
+		return errMalformedMessage
+	}
+
+	m.header = header
+
+	return nil
+}
+
+// phi binds the DAKE to the state shared by both participants.
+func phi(bobInstanceTag, aliceInstanceTag uint32) []byte {
+	out := appendWord32(nil, bobInstanceTag)
+	return appendWord32(out, aliceInstanceTag)
+}
+
+// transcriptUsageIDs are the usage IDs with which the client profiles of Bob
+// and Alice and phi are hashed in the transcript of Auth-R (0x00), Auth-I
+// (0x01) and Non-Interactive-Auth (0x02) messages
+var transcriptUsageIDs = [][3]byte{
+	{usageAuthRBobClientProfile, usageAuthRAliceClientProfile, usageAuthRPhi},
+	{usageAuthIBobClientProfile, usageAuthIAliceClientProfile, usageAuthIPhi},
+	{usageNonIntAuthBobClientProfile, usageNonIntAuthAliceClientProfile, usageNonIntAuthPhi},
+}
+
+func authTranscript(prefix byte, bobProfile, aliceProfile *clientProfile, y, x ed448.Point, b, a *big.Int, phi []byte) []byte {
+	usage := transcriptUsageIDs[prefix]
+
+	t := []byte{prefix}
+	t = append(t, hwc(usage[0], bobProfile.serialize())...)
+	t = append(t, hwc(usage[1], aliceProfile.serialize())...)
+	t = appendBytes(t, y, x)
+	t = appendMPI(t, b)
+	t = appendMPI(t, a)
+	return append(t, hwc(usage[2], phi)...)
+}
+
+// transcriptAsBob is used when we sent the Identity message
+func (c *Conversation) transcriptAsBob(prefix byte) []byte {
+	return authTranscript(prefix, c.ourProfile, c.theirProfile,
+		c.ourECDH.pub.h, c.theirECDH, c.ourDH.pub, c.theirDH,
+		phi(c.ourInstanceTag, c.theirInstanceTag))
+}
+
+// transcriptAsAlice is used when we received the Identity message
+func (c *Conversation) transcriptAsAlice(prefix byte) []byte {
+	return authTranscript(prefix, c.theirProfile, c.ourProfile,
+		c.theirECDH, c.ourECDH.pub.h, c.theirDH, c.ourDH.pub,
+		phi(c.theirInstanceTag, c.ourInstanceTag))
+}
+
+func (c *Conversation) generateEphemeralKeys() error {
+	var err1, err2 error
+
+	c.ourECDH, err1 = generateKeyPair(c.rand())
+	c.ourDH, err2 = generateDHKeyPair(c.rand())
+
+	return firstError(err1, err2)
+}
+
+func isZero(bs []byte) bool {
+	var r byte
+	for _, b := range bs {
+		r |= b
+	}
+	return r == 0
+}
+
+func deriveDAKEKeys(kEcdh, kDH []byte) (braceKey, sharedSecret []byte, ssid [ssidBytes]byte) {
+	braceKey = kdf(usageThirdBraceKey, braceKeyBytes, kDH)
+	sharedSecret = kdf(usageSharedSecret, sharedSecretBytes, kEcdh, braceKey)
+	copy(ssid[:], kdf(usageSSID, ssidBytes, sharedSecret))
+
+	return
+}
+
+// dakeSecrets computes the secrets of a DAKE from our ephemeral keys and the
+// ones of the peer
+func dakeSecrets(ourECDH *keyPair, theirECDH ed448.Point, ourDH *dhKeyPair, theirDH *big.Int) (braceKey, sharedSecret []byte, ssid [ssidBytes]byte, err error) {
+	kEcdh := ed448.PointScalarMul(theirECDH, ourECDH.priv.r).Encode()
+	if isZero(kEcdh) {
+		err = errInvalidPublicKey
+		return
+	}
+
+	kDH := ourDH.sharedSecret(theirDH)
+	braceKey, sharedSecret, ssid = deriveDAKEKeys(kEcdh, kDH.Bytes())
+
+	return
+}
+
+func (c *Conversation) deriveSharedSecret() error {
+	braceKey, sharedSecret, ssid, err := dakeSecrets(c.ourECDH, c.theirECDH, c.ourDH, c.theirDH)
+	if err != nil {
+		return err
+	}
+
+	c.braceKey, c.sharedSecret, c.ssid = braceKey, sharedSecret, ssid
+	return nil
+}
+
+func (c *Conversation) startDAKE() ([]byte, error) {
+	profile, err := c.clientProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.generateEphemeralKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &identityMessage{
+		header:  c.header(identityMsgType),
+		profile: profile,
+		y:       c.ourECDH.pub.h,
+		b:       c.ourDH.pub,
+	}
+
+	c.dake = dakeWaitingAuthR
+	c.ourIdentityMessage = m.serialize()
+
+	return c.ourIdentityMessage, nil
+}
+
+// winsDAKETie tells whether our Identity message takes precedence over the
+// one received, when both parties started a DAKE at the same time. The one
+// with the higher DH public key keeps its DAKE: it ignores the Identity
+// message of the peer and sends its own again, for the peer to answer.
+func (c *Conversation) winsDAKETie(m *identityMessage) bool {
+	return c.ourDH.pub.Cmp(m.b) > 0
+}
+
+func (c *Conversation) receiveIdentityMessage(msg []byte) ([]byte, error) {
+	m := &identityMessage{}
+	err := m.deserialize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateSenderProfile(m.profile, m.header.senderInstanceTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isValidPublicKey(&publicKey{h: m.y}) || !isValidDHPublicKey(m.b) {
+		return nil, errInvalidPublicKey
+	}
+
+	if c.dake == dakeWaitingAuthR && c.winsDAKETie(m) {
+		return c.ourIdentityMessage, nil
+	}
+
+	profile, err := c.clientProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	c.theirInstanceTag = m.header.senderInstanceTag
+	c.theirProfile = m.profile
+	c.theirKey = m.profile.publicKey
+	c.theirECDH = m.y
+	c.theirDH = m.b
+
+	err = c.generateEphemeralKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	sigma := &authMessage{}
+	err = sigma.auth(c.rand(), c.ourKeys.pub.h, c.theirProfile.forgingKey.h, c.theirECDH, c.ourKeys.priv.r, c.transcriptAsAlice(0x00))
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.deriveSharedSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &authRMessage{
+		header:  c.header(authRMsgType),
+		profile: profile,
+		x:       c.ourECDH.pub.h,
+		a:       c.ourDH.pub,
+		sigma:   sigma,
+	}
+
+	c.dake = dakeWaitingAuthI
+
+	return reply.serialize(), nil
+}
+
+func (c *Conversation) receiveAuthRMessage(msg []byte) ([]byte, error) {
+	if c.dake != dakeWaitingAuthR {
+		return nil, errUnexpectedMessage
+	}
+
+	m := &authRMessage{}
+	err := m.deserialize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateSenderProfile(m.profile, m.header.senderInstanceTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isValidPublicKey(&publicKey{h: m.x}) || !isValidDHPublicKey(m.a) {
+		return nil, errInvalidPublicKey
+	}
+
+	// nothing is stored before the message is authenticated, so that a forged
+	// Auth-R cannot replace the keys of the peer
+	t := authTranscript(0x00, c.ourProfile, m.profile,
+		c.ourECDH.pub.h, m.x, c.ourDH.pub, m.a,
+		phi(c.ourInstanceTag, m.header.senderInstanceTag))
+	if !m.sigma.verify(m.profile.publicKey.h, c.ourProfile.forgingKey.h, c.ourECDH.pub.h, t) {
+		return nil, errInvalidRingSignature
+	}
+
+	err = c.checkTrust(m.profile)
+	if err != nil {
+		return nil, err
+	}
+
+	c.theirInstanceTag = m.header.senderInstanceTag
+	c.theirProfile = m.profile
+	c.theirKey = m.profile.publicKey
+	c.theirECDH = m.x
+	c.theirDH = m.a
+
+	sigma := &authMessage{}
+	err = sigma.auth(c.rand(), c.ourKeys.pub.h, c.theirProfile.forgingKey.h, c.theirECDH, c.ourKeys.priv.r, c.transcriptAsBob(0x01))
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.deriveSharedSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.initializeRatchet(false)
+	if err != nil {
+		return nil, err
+	}
+
+	c.dake = dakeWaitingDataMessage
+
+	reply := &authIMessage{
+		header: c.header(authIMsgType),
+		sigma:  sigma,
+	}
+
+	return reply.serialize(), nil
+}
+
+func (c *Conversation) receiveAuthIMessage(msg []byte) error {
+	if c.dake != dakeWaitingAuthI {
+		return errUnexpectedMessage
+	}
+
+	m := &authIMessage{}
+	err := m.deserialize(msg)
+	if err != nil {
+		return err
+	}
+
+	if !m.sigma.verify(c.theirKey.h, c.ourProfile.forgingKey.h, c.ourECDH.pub.h, c.transcriptAsAlice(0x01)) {
+		return errInvalidRingSignature
+	}
+
+	err = c.checkTrust(c.theirProfile)
+	if err != nil {
+		return err
+	}
+
+	err = c.initializeRatchet(true)
+	if err != nil {
+		return err
+	}
+
+	c.sessionEstablished()
+	return nil
+}
@@ -0,0 +1,174 @@
+package otr4
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	. "gopkg.in/check.v1"
+)
+
+func newTestConversation(c *C, tag uint32) *Conversation {
+	conv, err := NewConversation(rand.Reader)
+	c.Assert(err, IsNil)
+	conv.ourInstanceTag = tag
+	return conv
+}
+
+func (s *OTR4Suite) Test_InteractiveDAKE(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	identity, err := bob.startDAKE()
+	c.Assert(err, IsNil)
+
+	_, toSend, err := alice.Receive(encodeMessage(identity))
+	c.Assert(err, IsNil)
+	c.Assert(toSend, HasLen, 1)
+
+	_, toSend, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(toSend, HasLen, 1)
+
+	_, toSend, err = alice.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(toSend, IsNil)
+
+	c.Assert(alice.theirInstanceTag, Equals, uint32(0x102))
+	c.Assert(bob.theirInstanceTag, Equals, uint32(0x101))
+	c.Assert(alice.theirKey.h.Equals(bob.ourKeys.pub.h), Equals, true)
+	c.Assert(bob.theirKey.h.Equals(alice.ourKeys.pub.h), Equals, true)
+
+	c.Assert(alice.sharedSecret, HasLen, sharedSecretBytes)
+	c.Assert(alice.sharedSecret, DeepEquals, bob.sharedSecret)
+	c.Assert(alice.braceKey, DeepEquals, bob.braceKey)
+	c.Assert(alice.ssid, DeepEquals, bob.ssid)
+}
+
+func (s *OTR4Suite) Test_DAKERejectsForgedAuthR(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+	mallory := newTestConversation(c, 0x101)
+
+	identity, _ := bob.startDAKE()
+	_, toSend, err := alice.Receive(encodeMessage(identity))
+	c.Assert(err, IsNil)
+
+	genuine := toSend[0]
+	authR := &authRMessage{}
+	c.Assert(authR.deserialize(decodeTestMessage(c, genuine)), IsNil)
+	authR.profile, _ = mallory.clientProfile()
+
+	_, toSend, err = bob.Receive(encodeMessage(authR.serialize()))
+
+	c.Assert(err, Equals, errInvalidRingSignature)
+	c.Assert(toSend, IsNil)
+	c.Assert(bob.theirKey, IsNil)
+
+	_, toSend, err = bob.Receive(genuine)
+	c.Assert(err, IsNil)
+	c.Assert(toSend, HasLen, 1)
+	c.Assert(bob.theirKey.h.Equals(alice.ourKeys.pub.h), Equals, true)
+}
+
+func (s *OTR4Suite) Test_DAKERejectsForgedAuthI(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	identity, _ := bob.startDAKE()
+	_, toSend, _ := alice.Receive(encodeMessage(identity))
+	_, toSend, err := bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+
+	authI := &authIMessage{}
+	c.Assert(authI.deserialize(decodeTestMessage(c, toSend[0])), IsNil)
+	authI.sigma.c1, authI.sigma.c2 = authI.sigma.c2, authI.sigma.c1
+
+	_, _, err = alice.Receive(encodeMessage(authI.serialize()))
+
+	c.Assert(err, Equals, errInvalidRingSignature)
+}
+
+func (s *OTR4Suite) Test_DAKERejectsInvalidDHKey(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	profile, _ := bob.clientProfile()
+	bob.generateEphemeralKeys()
+	m := &identityMessage{
+		header:  bob.header(identityMsgType),
+		profile: profile,
+		y:       bob.ourECDH.pub.h,
+		b:       big.NewInt(1),
+	}
+
+	_, toSend, err := alice.Receive(encodeMessage(m.serialize()))
+
+	c.Assert(err, Equals, errInvalidPublicKey)
+	c.Assert(toSend, IsNil)
+}
+
+func (s *OTR4Suite) Test_DAKERejectsProfileOfAnotherInstance(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+	carol := newTestConversation(c, 0x103)
+
+	identity, _ := bob.startDAKE()
+	m := &identityMessage{}
+	c.Assert(m.deserialize(identity), IsNil)
+	m.profile, _ = carol.clientProfile()
+
+	_, toSend, err := alice.Receive(encodeMessage(m.serialize()))
+
+	c.Assert(err, Equals, errInvalidInstanceTag)
+	c.Assert(toSend, IsNil)
+	c.Assert(alice.theirKey, IsNil)
+}
+
+func (s *OTR4Suite) Test_DAKERejectsInvalidProfile(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	identity, _ := bob.startDAKE()
+	m := &identityMessage{}
+	c.Assert(m.deserialize(identity), IsNil)
+	m.profile.versions = "34"
+
+	_, toSend, err := alice.Receive(encodeMessage(m.serialize()))
+
+	c.Assert(err, Equals, errInvalidSignature)
+	c.Assert(toSend, IsNil)
+}
+
+func (s *OTR4Suite) Test_AuthRWithoutIdentityIsUnexpected(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+	carol := newTestConversation(c, 0x102)
+
+	identity, _ := bob.startDAKE()
+	_, toSend, _ := alice.Receive(encodeMessage(identity))
+
+	_, _, err := carol.Receive(toSend[0])
+
+	c.Assert(err, Equals, errUnexpectedMessage)
+}
+
+func (s *OTR4Suite) Test_IdentityMessageSerialization(c *C) {
+	bob := newTestConversation(c, 0x102)
+	identity, err := bob.startDAKE()
+	c.Assert(err, IsNil)
+
+	m := &identityMessage{}
+	err = m.deserialize(identity)
+
+	c.Assert(err, IsNil)
+	c.Assert(m.header.messageType, Equals, byte(identityMsgType))
+	c.Assert(m.header.senderInstanceTag, Equals, uint32(0x102))
+	c.Assert(m.profile.serialize(), DeepEquals, bob.ourProfile.serialize())
+	c.Assert(m.y.Equals(bob.ourECDH.pub.h), Equals, true)
+	c.Assert(m.b, DeepEquals, bob.ourDH.pub)
+	c.Assert(m.serialize(), DeepEquals, identity)
+
+	err = m.deserialize(identity[:len(identity)-1])
+
+	c.Assert(err, Equals, errMalformedMessage)
+}
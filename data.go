@@ -5,29 +5,8 @@ import (
 	"strconv"
 
 	"github.com/otrv4/ed448"
-	"golang.org/x/crypto/sha3"
 )
 
-func shakeToScalar(in []byte) ed448.Scalar {
-	hash := make([]byte, fieldBytes)
-	sha3.ShakeSum256(hash, in)
-	s := ed448.NewScalar(hash)
-	return s
-}
-
-func hashToScalar(i byte, in ...ed448.Point) ed448.Scalar {
-	hash := sha3.New512()
-	for _, p := range in {
-		hash.Write(p.Encode())
-	}
-	hash.Write([]byte{i})
-
-	h := hash.Sum(nil)
-	c := ed448.NewScalar(h[:56])
-
-	return c
-}
-
 func appendBytes(bs ...interface{}) []byte {
 	var b []byte
 
@@ -50,8 +29,12 @@ func appendBytes(bs ...interface{}) []byte {
 	return b
 }
 
-func appendAndHash(bs ...interface{}) ed448.Scalar {
-	return shakeToScalar(appendBytes(bs...))
+func appendAndHash(usageID byte, bs ...interface{}) ed448.Scalar {
+	return hashToScalar(usageID, appendBytes(bs...))
+}
+
+func appendShort(b []byte, data uint16) []byte {
+	return append(b, byte(data>>8), byte(data))
 }
 
 func appendWord32(b []byte, data uint32) []byte {
@@ -87,6 +70,15 @@ func appendPoint(b []byte, p ed448.Point) []byte {
 //	return nil
 //}
 
+func extractShort(bs []byte) ([]byte, uint16, bool) {
+	if len(bs) < 2 {
+		return nil, 0, false
+	}
+
+	return bs[2:], uint16(bs[0])<<8 |
+		uint16(bs[1]), true
+}
+
 func extractWord32(bs []byte) ([]byte, uint32, bool) {
 	if len(bs) < 4 {
 		return nil, 0, false
@@ -99,11 +91,11 @@ func extractWord32(bs []byte) ([]byte, uint32, bool) {
 }
 
 func extractWord64(bs []byte) ([]byte, uint64, bool) {
-	if len(bs) < 4 {
+	if len(bs) < 8 {
 		return nil, 0, false
 	}
 
-	return bs[4:], uint64(bs[0])<<56 |
+	return bs[8:], uint64(bs[0])<<56 |
 		uint64(bs[1])<<48 |
 		uint64(bs[2])<<40 |
 		uint64(bs[3])<<32 |
@@ -124,8 +116,25 @@ func extractData(bs []byte) ([]byte, []byte, bool) {
 	return cursor, data, ok
 }
 
+func extractMPI(bs []byte) ([]byte, *big.Int, bool) {
+	cursor, data, ok := extractData(bs)
+	if !ok {
+		return bs, nil, false
+	}
+
+	return cursor, new(big.Int).SetBytes(data), true
+}
+
+func extractScalar(bs []byte) ([]byte, ed448.Scalar, bool) {
+	if len(bs) < fieldBytes {
+		return bs, nil, false
+	}
+
+	return bs[fieldBytes:], ed448.NewScalar(bs[:fieldBytes]), true
+}
+
 func extractPoint(b []byte, cursor int) (ed448.Point, int, error) {
-	if len(b) < 56 {
+	if len(b) < cursor+fieldBytes {
 		return nil, 0, errInvalidLength
 	}
 
@@ -140,6 +149,15 @@ func extractPoint(b []byte, cursor int) (ed448.Point, int, error) {
 	return p, cursor, err
 }
 
+func extractEncodedPoint(bs []byte) ([]byte, ed448.Point, bool) {
+	p, cursor, err := extractPoint(bs, 0)
+	if err != nil {
+		return bs, nil, false
+	}
+
+	return bs[cursor:], p, true
+}
+
 func fromHexChar(c byte) (byte, bool) {
 	switch {
 	case '0' <= c && c <= '9':
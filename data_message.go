@@ -0,0 +1,229 @@
+package otr4
+
+import (
+	"crypto/subtle"
+	"math/big"
+	"time"
+
+	"github.com/otrv4/ed448"
+)
+
+const (
+	flagIgnoreUnreadable = 0x01
+
+	heartbeatInterval = 60 * time.Second
+)
+
+type dataMessage struct {
+	header              messageHeader
+	flags               byte
+	previousChainLength uint32
+	ratchetID           uint32
+	messageID           uint32
+	ecdh                ed448.Point
+	dh                  *big.Int
+	nonce               []byte
+	encryptedMessage    []byte
+	authenticator       []byte
+	oldMACKeys          [][]byte
+}
+
+// serializeBody serializes every section of the message covered by the
+// authenticator
+func (m *dataMessage) serializeBody() []byte {
+	out := m.header.serialize()
+	out = append(out, m.flags)
+	out = appendWord32(out, m.previousChainLength)
+	out = appendWord32(out, m.ratchetID)
+	out = appendWord32(out, m.messageID)
+	out = appendBytes(out, m.ecdh)
+
+	if m.dh != nil {
+		out = appendMPI(out, m.dh)
+	} else {
+		out = appendData(out, nil)
+	}
+
+	out = append(out, m.nonce...)
+	return appendData(out, m.encryptedMessage)
+}
+
+func (m *dataMessage) serialize() []byte {
+	out := append(m.serializeBody(), m.authenticator...)
+
+	var keys []byte
+	for _, k := range m.oldMACKeys {
+		keys = append(keys, k...)
+	}
+
+	return appendData(out, keys)
+}
+
+func (m *dataMessage) deserialize(msg []byte) error {
+	var ok1, ok2, ok3, ok4, ok5, ok6, ok7 bool
+	var dh []byte
+
+	cursor, header, ok1 := extractHeader(msg)
+	if !ok1 || header.messageType != dataMsgType || len(cursor) < 1 {
+		return errMalformedMessage
+	}
+
+	m.header = header
+	m.flags = cursor[0]
+
+	cursor, m.previousChainLength, ok2 = extractWord32(cursor[1:])
+	cursor, m.ratchetID, ok3 = extractWord32(cursor)
+	cursor, m.messageID, ok4 = extractWord32(cursor)
+	cursor, m.ecdh, ok5 = extractEncodedPoint(cursor)
+	cursor, dh, ok6 = extractData(cursor)
+
+	if !(ok2 && ok3 && ok4 && ok5 && ok6) || len(cursor) < nonceBytes {
+		return errMalformedMessage
+	}
+
+	m.dh = nil
+	if len(dh) > 0 {
+		m.dh = new(big.Int).SetBytes(dh)
+	}
+
+	m.nonce = cursor[:nonceBytes]
+
+	cursor, m.encryptedMessage, ok7 = extractData(cursor[nonceBytes:])
+	if !ok7 || len(cursor) < macBytes {
+		return errMalformedMessage
+	}
+
+	m.authenticator = cursor[:macBytes]
+
+	cursor, keys, ok := extractData(cursor[macBytes:])
+	if !ok || len(cursor) != 0 || len(keys)%macKeyBytes != 0 {
+		return errMalformedMessage
+	}
+
+	m.oldMACKeys = nil
+	for ; len(keys) > 0; keys = keys[macKeyBytes:] {
+		m.oldMACKeys = append(m.oldMACKeys, keys[:macKeyBytes])
+	}
+
+	return nil
+}
+
+func authenticator(macKey, body []byte) []byte {
+	return hcmac(usageAuthenticator, macKey, body)
+}
+
+func (c *Conversation) createDataMessage(plaintext []byte, flags byte) ([]byte, error) {
+	msg, _, err := c.createDataMessageWithExtraKey(plaintext, flags)
+	return msg, err
+}
+
+// createDataMessageWithExtraKey returns a data message and its extra
+// symmetric key
+func (c *Conversation) createDataMessageWithExtraKey(plaintext []byte, flags byte) ([]byte, []byte, error) {
+	i, j, encKey, macKey, err := c.sendingKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := c.ratchet
+	m := &dataMessage{
+		header:              c.header(dataMsgType),
+		flags:               flags,
+		previousChainLength: r.pn,
+		ratchetID:           i,
+		messageID:           j,
+		ecdh:                r.ourECDH.pub.h,
+	}
+
+	if isDHRatchet(i) {
+		m.dh = r.ourDH.pub
+	}
+
+	m.nonce, err = randNonce(c.rand())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.encryptedMessage = encrypt(encKey, m.nonce, c.padPayload(plaintext))
+	m.authenticator = authenticator(macKey, m.serializeBody())
+	extraKey := extraSymmetricKey(encKey)
+	wipeBytes(encKey)
+
+	m.oldMACKeys = r.oldMACKeys
+	r.oldMACKeys = nil
+	c.lastSent = time.Now()
+
+	return m.serialize(), extraKey, nil
+}
+
+// receiveDataMessage returns the decrypted payload of a data message and its
+// extra symmetric key
+func (c *Conversation) receiveDataMessage(msg []byte) (payload, extraKey []byte, err error) {
+	if c.ratchet == nil {
+		return nil, nil, errUnexpectedMessage
+	}
+
+	m := &dataMessage{}
+	err = m.deserialize(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the ratchet is only updated once the message is authenticated
+	saved := *c.ratchet
+
+	encKey, macKey, err := c.ratchet.receivingKeys(m.ratchetID, m.messageID, m.previousChainLength, m.ecdh, m.dh)
+	if err != nil {
+		*c.ratchet = saved
+		return nil, nil, err
+	}
+
+	if subtle.ConstantTimeCompare(m.authenticator, authenticator(macKey, m.serializeBody())) != 1 {
+		*c.ratchet = saved
+		return nil, nil, errInvalidMAC
+	}
+
+	if len(m.encryptedMessage) > 0 {
+		payload = decrypt(encKey, m.nonce, m.encryptedMessage)
+	}
+
+	c.ratchet.commitReceivedKeys(macKey)
+	c.ratchet.wipeReplacedKeys(&saved)
+	extraKey = extraSymmetricKey(encKey)
+	wipeBytes(encKey)
+
+	return payload, extraKey, nil
+}
+
+// processDataMessage receives a data message and handles the TLVs it carries,
+// returning the plaintext and the reply to the TLVs, if any
+func (c *Conversation) processDataMessage(msg []byte) (plaintext, reply []byte, err error) {
+	payload, extraKey, err := c.receiveDataMessage(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, tlvs := parsePayload(payload)
+
+	replies := c.processTLVs(tlvs, extraKey)
+	if len(replies) == 0 {
+		return plaintext, nil, nil
+	}
+
+	reply, err = c.createDataMessage(appendTLVs(nil, replies), flagIgnoreUnreadable)
+	return plaintext, reply, err
+}
+
+// shouldSendHeartbeat tells whether MAC keys are waiting to be revealed and
+// nothing has been sent to the peer for a while
+func (c *Conversation) shouldSendHeartbeat() bool {
+	if c.ratchet == nil || len(c.ratchet.oldMACKeys) == 0 {
+		return false
+	}
+
+	return time.Since(c.lastSent) >= heartbeatInterval
+}
+
+func (c *Conversation) createHeartbeat() ([]byte, error) {
+	return c.createDataMessage(nil, flagIgnoreUnreadable)
+}
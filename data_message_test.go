@@ -0,0 +1,268 @@
+package otr4
+
+import (
+	"math/big"
+
+	. "gopkg.in/check.v1"
+)
+
+func testDataMessage(dh *big.Int) *dataMessage {
+	return &dataMessage{
+		header: messageHeader{
+			version:             otrVersion,
+			messageType:         dataMsgType,
+			senderInstanceTag:   0x101,
+			receiverInstanceTag: 0x102,
+		},
+		flags:               flagIgnoreUnreadable,
+		previousChainLength: 3,
+		ratchetID:           6,
+		messageID:           2,
+		ecdh:                testPubA.h,
+		dh:                  dh,
+		nonce:               make([]byte, nonceBytes),
+		encryptedMessage:    []byte{0x01, 0x02, 0x03},
+		authenticator:       make([]byte, macBytes),
+	}
+}
+
+func (s *OTR4Suite) Test_DataMessageSerialization(c *C) {
+	for _, dh := range []*big.Int{nil, big.NewInt(0x0304)} {
+		m := testDataMessage(dh)
+		ser := m.serialize()
+
+		m2 := &dataMessage{}
+		err := m2.deserialize(ser)
+
+		c.Assert(err, IsNil)
+		c.Assert(m2.header, Equals, m.header)
+		c.Assert(m2.flags, Equals, m.flags)
+		c.Assert(m2.previousChainLength, Equals, m.previousChainLength)
+		c.Assert(m2.ratchetID, Equals, m.ratchetID)
+		c.Assert(m2.messageID, Equals, m.messageID)
+		c.Assert(m2.ecdh.Equals(m.ecdh), Equals, true)
+		c.Assert(m2.dh, DeepEquals, dh)
+		c.Assert(m2.nonce, DeepEquals, m.nonce)
+		c.Assert(m2.encryptedMessage, DeepEquals, m.encryptedMessage)
+		c.Assert(m2.authenticator, DeepEquals, m.authenticator)
+		c.Assert(m2.serialize(), DeepEquals, ser)
+	}
+}
+
+func (s *OTR4Suite) Test_DataMessageRejectsTruncatedInput(c *C) {
+	ser := testDataMessage(big.NewInt(0x0304)).serialize()
+	m := &dataMessage{}
+
+	for l := 0; l < len(ser); l++ {
+		c.Assert(m.deserialize(ser[:l]), Equals, errMalformedMessage)
+	}
+
+	c.Assert(m.deserialize(append(ser, 0x00)), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_DataMessageRejectsWrongType(c *C) {
+	m := testDataMessage(nil)
+	m.header.messageType = identityMsgType
+
+	c.Assert(m.deserialize(m.serialize()), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_SendAndReceiveDataMessages(c *C) {
+	alice, bob := establishTestSession(c)
+
+	for n := 0; n < 4; n++ {
+		toSend, err := alice.Send([]byte("hi bob"))
+		c.Assert(err, IsNil)
+		c.Assert(toSend, HasLen, 1)
+		c.Assert(toSend[0], Not(DeepEquals), []byte("hi bob"))
+
+		plain, _, err := bob.Receive(toSend[0])
+		c.Assert(err, IsNil)
+		c.Assert(plain, DeepEquals, []byte("hi bob"))
+
+		toSend, err = bob.Send([]byte("hi alice"))
+		c.Assert(err, IsNil)
+
+		plain, _, err = alice.Receive(toSend[0])
+		c.Assert(err, IsNil)
+		c.Assert(plain, DeepEquals, []byte("hi alice"))
+	}
+}
+
+func (s *OTR4Suite) Test_SendPadsDataMessages(c *C) {
+	alice, bob := establishTestSession(c)
+	alice.Padding = 64
+
+	for _, msg := range []string{"hi", "a somewhat longer message"} {
+		toSend, err := alice.Send([]byte(msg))
+		c.Assert(err, IsNil)
+
+		m := &dataMessage{}
+		c.Assert(m.deserialize(decodeTestMessage(c, toSend[0])), IsNil)
+		c.Assert(m.encryptedMessage, HasLen, 64)
+
+		plain, _, err := bob.Receive(toSend[0])
+		c.Assert(err, IsNil)
+		c.Assert(plain, DeepEquals, []byte(msg))
+	}
+}
+
+func (s *OTR4Suite) Test_DataMessageCarriesDHKeyOnDHRatchets(c *C) {
+	alice, bob := establishTestSession(c)
+
+	toSend, _ := alice.Send([]byte("hi"))
+	m := &dataMessage{}
+	c.Assert(m.deserialize(decodeTestMessage(c, toSend[0])), IsNil)
+
+	c.Assert(m.ratchetID, Equals, uint32(0))
+	c.Assert(m.dh, DeepEquals, alice.ratchet.ourDH.pub)
+
+	bob.Receive(toSend[0])
+	toSend, _ = bob.Send([]byte("hi"))
+	c.Assert(m.deserialize(decodeTestMessage(c, toSend[0])), IsNil)
+
+	c.Assert(m.ratchetID, Equals, uint32(1))
+	c.Assert(m.dh, IsNil)
+}
+
+func (s *OTR4Suite) Test_ReceiveDataMessageRejectsInvalidMAC(c *C) {
+	alice, bob := establishTestSession(c)
+
+	toSend, _ := alice.Send([]byte("hi bob"))
+	forged := decodeTestMessage(c, toSend[0])
+	forged[len(forged)-macBytes-1] ^= 0x01
+
+	_, _, err := bob.Receive(encodeMessage(forged))
+
+	c.Assert(err, Equals, errInvalidMAC)
+	c.Assert(bob.ratchet.receivingChain, IsNil)
+
+	plain, _, err := bob.Receive(toSend[0])
+
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hi bob"))
+}
+
+func (s *OTR4Suite) Test_ReceiveDataMessageWithoutSession(c *C) {
+	alice, _ := establishTestSession(c)
+	toSend, _ := alice.Send([]byte("hi bob"))
+
+	carol := newTestConversation(c, 0x102)
+	_, _, err := carol.Receive(toSend[0])
+
+	c.Assert(err, Equals, errUnexpectedMessage)
+}
+
+func exchangeMessage(c *C, sender, receiver *Conversation, msg string) *dataMessage {
+	toSend, err := sender.Send([]byte(msg))
+	c.Assert(err, IsNil)
+
+	plain, _, err := receiver.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte(msg))
+
+	m := &dataMessage{}
+	c.Assert(m.deserialize(decodeTestMessage(c, toSend[0])), IsNil)
+	return m
+}
+
+func (s *OTR4Suite) Test_DataMessageSerializesOldMACKeys(c *C) {
+	m := testDataMessage(nil)
+	m.oldMACKeys = [][]byte{make([]byte, macKeyBytes), make([]byte, macKeyBytes)}
+	m.oldMACKeys[1][0] = 0x01
+
+	m2 := &dataMessage{}
+	err := m2.deserialize(m.serialize())
+
+	c.Assert(err, IsNil)
+	c.Assert(m2.oldMACKeys, DeepEquals, m.oldMACKeys)
+
+	ser := m.serialize()
+
+	c.Assert(m2.deserialize(ser[:len(ser)-1]), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_MACKeysAreRevealedOnceRatchetIsRetired(c *C) {
+	alice, bob := establishTestSession(c)
+
+	exchangeMessage(c, alice, bob, "one")
+	exchangeMessage(c, alice, bob, "two")
+
+	c.Assert(bob.ratchet.receivedMACKeys, HasLen, 2)
+	c.Assert(bob.ratchet.oldMACKeys, HasLen, 0)
+
+	m := exchangeMessage(c, bob, alice, "three")
+
+	c.Assert(m.oldMACKeys, HasLen, 0)
+
+	exchangeMessage(c, alice, bob, "four")
+	received := bob.ratchet.oldMACKeys
+
+	c.Assert(received, HasLen, 2)
+	c.Assert(bob.ratchet.receivedMACKeys, HasLen, 1)
+
+	m = exchangeMessage(c, bob, alice, "five")
+
+	c.Assert(m.oldMACKeys, DeepEquals, received)
+	c.Assert(bob.ratchet.oldMACKeys, HasLen, 0)
+
+	m = exchangeMessage(c, bob, alice, "six")
+
+	c.Assert(m.oldMACKeys, HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_HeartbeatRevealsMACKeysWhenIdle(c *C) {
+	alice, bob := establishTestSession(c)
+
+	exchangeMessage(c, alice, bob, "one")
+	exchangeMessage(c, bob, alice, "two")
+
+	toSend, _ := alice.Send([]byte("three"))
+	_, replies, err := bob.Receive(toSend[0])
+
+	c.Assert(err, IsNil)
+	c.Assert(replies, HasLen, 0)
+
+	bob.lastSent = bob.lastSent.Add(-heartbeatInterval)
+	toSend, _ = alice.Send([]byte("four"))
+	_, replies, err = bob.Receive(toSend[0])
+
+	c.Assert(err, IsNil)
+	c.Assert(replies, HasLen, 1)
+
+	m := &dataMessage{}
+	c.Assert(m.deserialize(decodeTestMessage(c, replies[0])), IsNil)
+	c.Assert(m.flags&flagIgnoreUnreadable, Equals, byte(flagIgnoreUnreadable))
+	c.Assert(m.oldMACKeys, HasLen, 1)
+
+	plain, _, err := alice.Receive(replies[0])
+
+	c.Assert(err, IsNil)
+	c.Assert(plain, IsNil)
+}
+
+func (s *OTR4Suite) Test_RevealedMACKeyAllowsForgery(c *C) {
+	alice, bob := establishTestSession(c)
+
+	original, _ := alice.Send([]byte("I owe you nothing"))
+	_, _, err := bob.Receive(original[0])
+	c.Assert(err, IsNil)
+
+	exchangeMessage(c, bob, alice, "ok")
+	exchangeMessage(c, alice, bob, "bye")
+	revealing := exchangeMessage(c, bob, alice, "bye")
+
+	c.Assert(revealing.oldMACKeys, HasLen, 1)
+
+	// a third party who saw both messages on the wire can now forge the
+	// first one
+	macKey := revealing.oldMACKeys[0]
+	forged := &dataMessage{}
+	c.Assert(forged.deserialize(decodeTestMessage(c, original[0])), IsNil)
+	forged.encryptedMessage = []byte("I owe you a million")
+	forged.authenticator = authenticator(macKey, forged.serializeBody())
+
+	parsed := &dataMessage{}
+	c.Assert(parsed.deserialize(forged.serialize()), IsNil)
+	c.Assert(parsed.authenticator, DeepEquals, authenticator(macKey, parsed.serializeBody()))
+}
@@ -10,38 +10,6 @@ import (
 	. "gopkg.in/check.v1"
 )
 
-func (s *OTR4Suite) Test_ShakeToScalar(c *C) {
-	scalar := shakeToScalar(testByteSlice)
-
-	exp := ed448.NewScalar([]byte{
-		0x1e, 0xda, 0x47, 0xce, 0x5a, 0x2a, 0x10, 0xdb,
-		0x67, 0x8a, 0x38, 0x2c, 0xe2, 0x70, 0x2f, 0xea,
-		0x92, 0x8d, 0x6a, 0x4c, 0x11, 0x27, 0xfd, 0x7c,
-		0xb0, 0x6f, 0x1a, 0x0b, 0x71, 0x82, 0x6b, 0x90,
-		0xe3, 0x6b, 0xdd, 0x7d, 0x17, 0xab, 0xfd, 0x9e,
-		0xad, 0xf2, 0x04, 0x0d, 0x97, 0x19, 0x46, 0x09,
-		0x3d, 0xb3, 0xa3, 0x67, 0xca, 0x01, 0x8d, 0x95,
-	})
-
-	c.Assert(scalar, DeepEquals, exp)
-}
-
-func (s *OTR4Suite) Test_HashToScalar(c *C) {
-	scalar := hashToScalar(byte(01), testPoint)
-
-	exp := ed448.NewScalar([]byte{
-		0xd4, 0x9b, 0xec, 0x13, 0xe4, 0xba, 0xdb, 0x6a,
-		0x0c, 0x32, 0x8d, 0x4b, 0x57, 0x3d, 0x22, 0x23,
-		0x23, 0x74, 0x90, 0xec, 0x91, 0x05, 0xe9, 0xd2,
-		0xd2, 0x9e, 0xa8, 0x86, 0xc9, 0x6b, 0x8f, 0x60,
-		0x67, 0x9b, 0xa6, 0xbd, 0x2d, 0x38, 0xc1, 0x23,
-		0x7a, 0xdd, 0x01, 0x94, 0xfa, 0xb5, 0x8c, 0x9e,
-		0x80, 0xc4, 0x11, 0x50, 0x64, 0xac, 0x1e, 0x1f,
-	})
-
-	c.Assert(scalar, DeepEquals, exp)
-}
-
 func (s *OTR4Suite) Test_AppendBytes(c *C) {
 	empty := []byte{}
 	bs := []byte{
@@ -73,17 +41,8 @@ func (s *OTR4Suite) Test_AppendBytes(c *C) {
 }
 
 func (s *OTR4Suite) Test_AppendAndHash(c *C) {
-	hash := appendAndHash(testPrivA.r, testPubA.h)
-
-	exp := ed448.NewScalar([]byte{
-		0x2c, 0x0f, 0x06, 0xd6, 0x81, 0xc0, 0x62, 0xe2,
-		0xdd, 0x5d, 0xb3, 0x3f, 0x87, 0x5b, 0x8d, 0xb5,
-		0x1c, 0x2c, 0xb1, 0x3f, 0x7a, 0x72, 0xaa, 0x87,
-		0x25, 0xe6, 0x10, 0xd7, 0xa5, 0x7c, 0x36, 0x98,
-		0xd1, 0x39, 0xf4, 0x82, 0xd9, 0x95, 0x65, 0x8a,
-		0x66, 0x47, 0x44, 0xa4, 0x2c, 0x2f, 0xff, 0xa9,
-		0xa1, 0xb9, 0x56, 0x97, 0x19, 0x50, 0xf9, 0x4,
-	})
+	hash := appendAndHash(usageAuth, testByteSlice[:32], testByteSlice[32:])
+	exp := ed448.NewScalar(hexToBytes("9d9326238f856ba209e373924f96f96094a458c6fb4d311e31fef922aca9bdfb128cc3be6910cc3179b3bc0a703e8c5ea1baaa42249c6d31"))
 
 	c.Assert(hash, DeepEquals, exp)
 }
@@ -273,10 +232,14 @@ func (s *OTR4Suite) Test_ExtractWord64(c *C) {
 	bs = []byte{0x12, 0x14, 0x15, 0xff, 0x03,
 		0x12, 0x14, 0x15, 0xff, 0x03,
 	}
-	_, rslt, ok = extractWord64(bs)
+	cursor, rslt, ok := extractWord64(bs)
 
 	c.Assert(rslt, DeepEquals, uint64(0x121415ff03121415))
 	c.Assert(ok, Equals, true)
+	c.Assert(cursor, DeepEquals, []byte{0xff, 0x03})
+
+	_, _, ok = extractWord64(bs[:7])
+	c.Assert(ok, Equals, false)
 }
 
 func (s *OTR4Suite) Test_ExtractData(c *C) {
@@ -388,3 +351,49 @@ func (s *OTR4Suite) Test_BytesToString(c *C) {
 
 	c.Assert(bytesToString(bs), DeepEquals, exp)
 }
+
+func (s *OTR4Suite) Test_AppendShort(c *C) {
+	rslt := appendShort([]byte{0xcc}, 0x0104)
+
+	c.Assert(rslt, DeepEquals, []byte{0xcc, 0x01, 0x04})
+}
+
+func (s *OTR4Suite) Test_ExtractShort(c *C) {
+	i, rslt, ok := extractShort([]byte{0x12})
+
+	c.Assert(i, IsNil)
+	c.Assert(rslt, Equals, uint16(0))
+	c.Assert(ok, Equals, false)
+
+	i, rslt, ok = extractShort([]byte{0x12, 0x14, 0x15})
+
+	c.Assert(i, DeepEquals, []byte{0x15})
+	c.Assert(rslt, Equals, uint16(0x1214))
+	c.Assert(ok, Equals, true)
+}
+
+func (s *OTR4Suite) Test_ExtractMPI(c *C) {
+	bs := []byte{0x00, 0x00, 0x00, 0x02, 0x01, 0x02, 0x03}
+	cursor, mpi, ok := extractMPI(bs)
+
+	c.Assert(ok, Equals, true)
+	c.Assert(mpi, DeepEquals, big.NewInt(0x0102))
+	c.Assert(cursor, DeepEquals, []byte{0x03})
+
+	_, _, ok = extractMPI(bs[:5])
+
+	c.Assert(ok, Equals, false)
+}
+
+func (s *OTR4Suite) Test_ExtractScalar(c *C) {
+	bs := append(testPrivA.r.Encode(), 0x01)
+	cursor, scalar, ok := extractScalar(bs)
+
+	c.Assert(ok, Equals, true)
+	c.Assert(scalar, DeepEquals, testPrivA.r)
+	c.Assert(cursor, DeepEquals, []byte{0x01})
+
+	_, _, ok = extractScalar(bs[:fieldBytes-1])
+
+	c.Assert(ok, Equals, false)
+}
@@ -1,6 +1,9 @@
 package otr4
 
-import "math/big"
+import (
+	"io"
+	"math/big"
+)
 
 var (
 	p         *big.Int // prime field, assigned in RFC3526 with id 15
@@ -54,3 +57,38 @@ func init() {
 func isGroupElement(n *big.Int) bool {
 	return greatOrEqual(n, g3) && lessOrEqual(n, pMinusTwo)
 }
+
+const dhPrivBytes = 80
+
+type dhKeyPair struct {
+	pub  *big.Int
+	priv *big.Int
+}
+
+func generateDHKeyPair(rand io.Reader) (*dhKeyPair, error) {
+	var b [dhPrivBytes]byte
+
+	_, err := io.ReadFull(rand, b[:])
+	if err != nil {
+		return nil, notEnoughEntropy
+	}
+
+	priv := new(big.Int).SetBytes(b[:])
+
+	return &dhKeyPair{
+		pub:  new(big.Int).Exp(g3, priv, p),
+		priv: priv,
+	}, nil
+}
+
+func (k *dhKeyPair) sharedSecret(theirPub *big.Int) *big.Int {
+	return new(big.Int).Exp(theirPub, k.priv, p)
+}
+
+func isValidDHPublicKey(n *big.Int) bool {
+	if n == nil || !isGroupElement(n) {
+		return false
+	}
+
+	return new(big.Int).Exp(n, q, p).Cmp(big.NewInt(1)) == 0
+}
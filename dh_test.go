@@ -31,3 +31,33 @@ func (s *OTR4Suite) Test_ValidationOfDHGroupElement(c *C) {
 	valid = isGroupElement(big.NewInt(2))
 	c.Assert(valid, Equals, true)
 }
+
+func (s *OTR4Suite) Test_GenerateDHKeyPair(c *C) {
+	r := make([]byte, dhPrivBytes)
+	r[dhPrivBytes-1] = 0x03
+
+	k, err := generateDHKeyPair(fixedRand(r))
+
+	c.Assert(err, IsNil)
+	c.Assert(k.priv, DeepEquals, big.NewInt(3))
+	c.Assert(k.pub, DeepEquals, big.NewInt(8))
+
+	_, err = generateDHKeyPair(fixedRand([]byte{0x01}))
+
+	c.Assert(err, ErrorMatches, ".*cannot source enough entropy")
+}
+
+func (s *OTR4Suite) Test_DHSharedSecret(c *C) {
+	a := &dhKeyPair{priv: big.NewInt(3), pub: big.NewInt(8)}
+	b := &dhKeyPair{priv: big.NewInt(5), pub: big.NewInt(32)}
+
+	c.Assert(a.sharedSecret(b.pub), DeepEquals, b.sharedSecret(a.pub))
+	c.Assert(a.sharedSecret(b.pub), DeepEquals, big.NewInt(32768))
+}
+
+func (s *OTR4Suite) Test_ValidationOfDHPublicKey(c *C) {
+	c.Assert(isValidDHPublicKey(nil), Equals, false)
+	c.Assert(isValidDHPublicKey(big.NewInt(1)), Equals, false)
+	c.Assert(isValidDHPublicKey(g3), Equals, true)
+	c.Assert(isValidDHPublicKey(sub(p, big.NewInt(1))), Equals, false)
+}
@@ -0,0 +1,102 @@
+package otr4
+
+import (
+	"crypto/subtle"
+
+	"github.com/otrv4/ed448"
+	"golang.org/x/crypto/sha3"
+)
+
+// Ed448 signatures, as defined in RFC 8032. The long-term key signs with the
+// "OTRv4" context, so its signatures cannot be mistaken for signatures made
+// for another protocol with the same key.
+//
+// The curve arithmetic is the constant-time one of the ed448 library. Its
+// points encode like RFC 8032 points multiplied by the cofactor, so scalars
+// are divided by it before multiplying the base point.
+
+var eddsaContext = []byte("OTRv4")
+
+// eddsaHash is SHAKE256(dom4(0, context) || in..., 114) reduced modulo the
+// order of the base point
+func eddsaHash(context []byte, in ...[]byte) ed448.Scalar {
+	h := sha3.NewShake256()
+	h.Write([]byte("SigEd448"))
+	h.Write([]byte{0x00, byte(len(context))})
+	h.Write(context)
+	for _, b := range in {
+		h.Write(b)
+	}
+
+	out := make([]byte, signatureSize)
+	h.Read(out)
+
+	return reduceToScalar(out)
+}
+
+// eddsaExpandKey returns the secret scalar and the nonce prefix derived from
+// a private key
+func eddsaExpandKey(sym []byte) (ed448.Scalar, []byte) {
+	h := make([]byte, 2*privateKeySize)
+	sha3.ShakeSum256(h, sym)
+
+	h[0] &= 0xfc
+	h[privateKeySize-1] = 0
+	h[privateKeySize-2] |= mask
+
+	return ed448.NewScalar(h[:privateKeySize]), h[privateKeySize:]
+}
+
+func divideByCofactor(s ed448.Scalar) ed448.Scalar {
+	out := s.Copy()
+	for c := uint(1); c < uint(ed448.Cofactor); c <<= 1 {
+		out.Halve(out)
+	}
+	return out
+}
+
+// eddsaBaseMul returns the RFC 8032 encoding of s*B
+func eddsaBaseMul(s ed448.Scalar) []byte {
+	return ed448.PrecomputedScalarMul(divideByCofactor(s)).DSAEncode()
+}
+
+func eddsaPublicKey(sym []byte) []byte {
+	s, _ := eddsaExpandKey(sym)
+	return eddsaBaseMul(s)
+}
+
+func eddsaSign(sym, pub, context, message []byte) []byte {
+	s, prefix := eddsaExpandKey(sym)
+
+	r := eddsaHash(context, prefix, message)
+	R := eddsaBaseMul(r)
+
+	k := eddsaHash(context, R, pub, message)
+	S := ed448.NewScalar()
+	S.Mul(k, s)
+	S.Add(S, r)
+
+	out := append(R, S.Encode()...)
+	return append(out, 0x00)
+}
+
+func eddsaVerify(pub ed448.Point, context, message, sig []byte) bool {
+	if len(sig) != signatureSize || sig[signatureSize-1] != 0 {
+		return false
+	}
+
+	// S must be reduced, to keep signatures non-malleable
+	encodedS := sig[publicKeySize : signatureSize-1]
+	S := ed448.NewScalar(encodedS)
+	if subtle.ConstantTimeCompare(S.Encode(), encodedS) != 1 {
+		return false
+	}
+
+	k := eddsaHash(context, sig[:publicKeySize], pub.DSAEncode(), message)
+	k.Sub(ed448.NewScalar(), k)
+
+	// R = S*B - k*A
+	R := ed448.PointDoubleScalarMul(ed448.BasePoint, pub, divideByCofactor(S), k)
+
+	return subtle.ConstantTimeCompare(R.DSAEncode(), sig[:publicKeySize]) == 1
+}
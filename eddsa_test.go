@@ -0,0 +1,144 @@
+package otr4
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/otrv4/ed448"
+	. "gopkg.in/check.v1"
+)
+
+// edL is the order of the base point
+var edL, _ = new(big.Int).SetString("3fffffffffffffffffffffffffffffffffffffffffffffffffffffff7cca23e9c44edb49aed63690216cc2728dc58f552378c292ab5844f3", 16)
+
+func littleEndian(n *big.Int, size int) []byte {
+	out := make([]byte, size)
+	b := n.Bytes()
+	for i := range b {
+		out[i] = b[len(b)-1-i]
+	}
+	return out
+}
+
+func fromLittleEndian(bs []byte) *big.Int {
+	b := make([]byte, len(bs))
+	for i := range bs {
+		b[i] = bs[len(bs)-1-i]
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+// eddsaPublicPoint returns the public key of a private key as a point, since
+// the library cannot decode RFC 8032 encodings
+func eddsaPublicPoint(sym []byte) ed448.Point {
+	s, _ := eddsaExpandKey(sym)
+	return ed448.PrecomputedScalarMul(divideByCofactor(s))
+}
+
+// test vectors from RFC 8032, section 7.4
+var eddsaTestVectors = []struct {
+	sym, pub, message, context, sig string
+}{
+	{
+		sym:     "6c82a562cb808d10d632be89c8513ebf6c929f34ddfa8c9f63c9960ef6e348a3528c8a3fcc2f044e39a3fc5b94492f8f032e7549a20098f95b",
+		pub:     "5fd7449b59b461fd2ce787ec616ad46a1da1342485a70e1f8a0ea75d80e96778edf124769b46c7061bd6783df1e50f6cd1fa1abeafe8256180",
+		message: "",
+		context: "",
+		sig:     "533a37f6bbe457251f023c0d88f976ae2dfb504a843e34d2074fd823d41a591f2b233f034f628281f2fd7a22ddd47d7828c59bd0a21bfd3980ff0d2028d4b18a9df63e006c5d1c2d345b925d8dc00b4104852db99ac5c7cdda8530a113a0f4dbb61149f05a7363268c71d95808ff2e652600",
+	},
+	{
+		sym:     "c4eab05d357007c632f3dbb48489924d552b08fe0c353a0d4a1f00acda2c463afbea67c5e8d2877c5e3bc397a659949ef8021e954e0a12274e",
+		pub:     "43ba28f430cdff456ae531545f7ecd0ac834a55d9358c0372bfa0c6c6798c0866aea01eb00742802b8438ea4cb82169c235160627b4c3a9480",
+		message: "03",
+		context: "",
+		sig:     "26b8f91727bd62897af15e41eb43c377efb9c610d48f2335cb0bd0087810f4352541b143c4b981b7e18f62de8ccdf633fc1bf037ab7cd779805e0dbcc0aae1cbcee1afb2e027df36bc04dcecbf154336c19f0af7e0a6472905e799f1953d2a0ff3348ab21aa4adafd1d234441cf807c03a00",
+	},
+	{
+		sym:     "c4eab05d357007c632f3dbb48489924d552b08fe0c353a0d4a1f00acda2c463afbea67c5e8d2877c5e3bc397a659949ef8021e954e0a12274e",
+		pub:     "43ba28f430cdff456ae531545f7ecd0ac834a55d9358c0372bfa0c6c6798c0866aea01eb00742802b8438ea4cb82169c235160627b4c3a9480",
+		message: "03",
+		context: "666f6f",
+		sig:     "d4f8f6131770dd46f40867d6fd5d5055de43541f8c5e35abbcd001b32a89f7d2151f7647f11d8ca2ae279fb842d607217fce6e042f6815ea000c85741de5c8da1144a6a1aba7f96de42505d7a7298524fda538fccbbb754f578c1cad10d54d0d5428407e85dcbc98a49155c13764e66c3c00",
+	},
+	{
+		sym:     "cd23d24f714274e744343237b93290f511f6425f98e64459ff203e8985083ffdf60500553abc0e05cd02184bdb89c4ccd67e187951267eb328",
+		pub:     "dcea9e78f35a1bf3499a831b10b86c90aac01cd84b67a0109b55a36e9328b1e365fce161d71ce7131a543ea4cb5f7e9f1d8b00696447001400",
+		message: "0c3e544074ec63b0265e0c",
+		context: "",
+		sig:     "1f0a8888ce25e8d458a21130879b840a9089d999aaba039eaf3e3afa090a09d389dba82c4ff2ae8ac5cdfb7c55e94d5d961a29fe0109941e00b8dbdeea6d3b051068df7254c0cdc129cbe62db2dc957dbb47b51fd3f213fb8698f064774250a5028961c9bf8ffd973fe5d5c206492b140e00",
+	},
+	{
+		sym:     "258cdd4ada32ed9c9ff54e63756ae582fb8fab2ac721f2c8e676a72768513d939f63dddb55609133f29adf86ec9929dccb52c1c5fd2ff7e21b",
+		pub:     "3ba16da0c6f2cc1f30187740756f5e798d6bc5fc015d7c63cc9510ee3fd44adc24d8e968b6e46e6f94d19b945361726bd75e149ef09817f580",
+		message: "64a65f3cdedcdd66811e2915",
+		context: "",
+		sig:     "7eeeab7c4e50fb799b418ee5e3197ff6bf15d43a14c34389b59dd1a7b1b85b4ae90438aca634bea45e3a2695f1270f07fdcdf7c62b8efeaf00b45c2c96ba457eb1a8bf075a3db28e5c24f6b923ed4ad747c3c9e03c7079efb87cb110d3a99861e72003cbae6d6b8b827e4e6c143064ff3c00",
+	},
+}
+
+func (s *OTR4Suite) Test_EdDSATestVectors(c *C) {
+	for _, v := range eddsaTestVectors {
+		sym := hexToBytes(v.sym)
+		pub := hexToBytes(v.pub)
+		message := hexToBytes(v.message)
+		context := hexToBytes(v.context)
+		sig := hexToBytes(v.sig)
+
+		c.Assert(eddsaPublicKey(sym), DeepEquals, pub)
+		c.Assert(eddsaSign(sym, pub, context, message), DeepEquals, sig)
+		c.Assert(eddsaVerify(eddsaPublicPoint(sym), context, message, sig), Equals, true)
+	}
+}
+
+func (s *OTR4Suite) Test_EdDSAVerifyRejectsWrongContext(c *C) {
+	v := eddsaTestVectors[2]
+	pub := eddsaPublicPoint(hexToBytes(v.sym))
+	message := hexToBytes(v.message)
+	sig := hexToBytes(v.sig)
+
+	c.Assert(eddsaVerify(pub, []byte("foo"), message, sig), Equals, true)
+	c.Assert(eddsaVerify(pub, nil, message, sig), Equals, false)
+	c.Assert(eddsaVerify(pub, eddsaContext, message, sig), Equals, false)
+}
+
+func (s *OTR4Suite) Test_EdDSAVerifyRejectsNonCanonicalScalars(c *C) {
+	v := eddsaTestVectors[0]
+	pub := eddsaPublicPoint(hexToBytes(v.sym))
+	sig := hexToBytes(v.sig)
+
+	c.Assert(eddsaVerify(pub, nil, nil, sig), Equals, true)
+
+	// S + L is a valid solution of the verification equation, but it must be
+	// rejected to keep signatures non-malleable
+	S := fromLittleEndian(sig[publicKeySize:])
+	S.Add(S, edL)
+	malleated := append(append([]byte{}, sig[:publicKeySize]...), littleEndian(S, privateKeySize)...)
+
+	c.Assert(eddsaVerify(pub, nil, nil, malleated), Equals, false)
+}
+
+func (s *OTR4Suite) Test_EdDSAVerifyRejectsMalformedSignatures(c *C) {
+	v := eddsaTestVectors[0]
+	pub := eddsaPublicPoint(hexToBytes(v.sym))
+	sig := hexToBytes(v.sig)
+
+	c.Assert(eddsaVerify(pub, nil, nil, sig[:signatureSize-1]), Equals, false)
+
+	bad := append([]byte{}, sig...)
+	bad[signatureSize-1] = 0x01
+	c.Assert(eddsaVerify(pub, nil, nil, bad), Equals, false)
+
+	bad = append([]byte{}, sig...)
+	bad[0] ^= 0x01
+	c.Assert(eddsaVerify(pub, nil, nil, bad), Equals, false)
+}
+
+func (s *OTR4Suite) Test_LongTermKeysAreEdDSAKeys(c *C) {
+	keys, err := generateKeyPair(rand.Reader)
+	c.Assert(err, IsNil)
+
+	c.Assert(eddsaPublicKey(keys.priv.sym), DeepEquals, keys.pub.h.DSAEncode())
+
+	sig := keys.sign([]byte("hi"))
+	c.Assert(eddsaVerify(keys.pub.h, eddsaContext, []byte("hi"), sig), Equals, true)
+}
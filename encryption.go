@@ -0,0 +1,34 @@
+package otr4
+
+import (
+	"io"
+
+	"golang.org/x/crypto/salsa20"
+)
+
+const nonceBytes = 24
+
+func encrypt(key, nonce, plain []byte) []byte {
+	var k [symKeyBytes]byte
+	copy(k[:], key)
+
+	out := make([]byte, len(plain))
+	salsa20.XORKeyStream(out, plain, nonce, &k)
+
+	return out
+}
+
+func decrypt(key, nonce, ciphertext []byte) []byte {
+	return encrypt(key, nonce, ciphertext)
+}
+
+func randNonce(rand io.Reader) ([]byte, error) {
+	var b [nonceBytes]byte
+
+	_, err := io.ReadFull(rand, b[:])
+	if err != nil {
+		return nil, notEnoughEntropy
+	}
+
+	return b[:], nil
+}
@@ -0,0 +1,31 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_EncryptAndDecrypt(c *C) {
+	key := make([]byte, symKeyBytes)
+	nonce := make([]byte, nonceBytes)
+	plain := []byte("our message")
+
+	ciphertext := encrypt(key, nonce, plain)
+
+	c.Assert(ciphertext, Not(DeepEquals), plain)
+	c.Assert(decrypt(key, nonce, ciphertext), DeepEquals, plain)
+
+	nonce[0] = 0x01
+
+	c.Assert(decrypt(key, nonce, ciphertext), Not(DeepEquals), plain)
+}
+
+func (s *OTR4Suite) Test_RandNonce(c *C) {
+	nonce, err := randNonce(fixedRand(randData))
+
+	c.Assert(err, IsNil)
+	c.Assert(nonce, DeepEquals, randData[:nonceBytes])
+
+	_, err = randNonce(fixedRand([]byte{0x01}))
+
+	c.Assert(err, ErrorMatches, ".*cannot source enough entropy")
+}
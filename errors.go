@@ -5,6 +5,37 @@ var errImpossibleToDecrypt = newOtrError("cannot decrypt the message")
 var errInvalidVersion = newOtrError("no valid version agreement could be found")
 var errInvalidLength = newOtrError("invalid length")
 var errCorruptEncryptedSignature = newOtrError("corrupted signature")
+var errUnknownMessageType = newOtrError("unknown message type")
+var errMalformedMessage = newOtrError("malformed message")
+var errInvalidPublicKey = newOtrError("invalid public key")
+var errInvalidRingSignature = newOtrError("invalid ring signature")
+var errUnexpectedMessage = newOtrError("unexpected message")
+var errInvalidMAC = newOtrError("invalid MAC")
+var errSessionNotReady = newOtrError("the session is not ready to send messages")
+var errTooManySkippedMessages = newOtrError("too many skipped messages")
+var errInvalidSMPProof = newOtrError("invalid SMP zero-knowledge proof")
+var errNoSMPRequest = newOtrError("no SMP request to answer")
+var errInvalidSignature = newOtrError("invalid signature")
+var errExpiredProfile = newOtrError("the profile has expired")
+var errClientProfileMismatch = newOtrError("the client profile does not match the published one")
+var errInstanceTagMismatch = newOtrError("instance tags do not match")
+var errInvalidInstanceTag = newOtrError("invalid instance tag")
+var errUnknownInstance = newOtrError("no conversation with this instance of the peer")
+var errPrekeyServerFailure = newOtrError("the prekey server could not fulfill the request")
+var errNoPrekeyEnsembles = newOtrError("no prekey ensembles available")
+var errNoPrekeyServer = newOtrError("no prekey server configured")
+var errUnknownPrekeyServer = newOtrError("the prekey server is not the expected one")
+var errInvalidFingerprint = newOtrError("invalid fingerprint")
+var errUnknownTrustLevel = newOtrError("unknown trust level")
+var errRevokedFingerprint = newOtrError("the peer used a revoked fingerprint")
+var errInvalidPassphrase = newOtrError("wrong passphrase or corrupted key file")
+var errUnsupportedKeyFileVersion = newOtrError("unsupported key file version")
+var errKeyFileTooCostly = newOtrError("the key file asks for a too costly key derivation")
+var errVersion3Unsupported = newOtrError("version 3 conversations are not supported")
+var errReservedTLVType = newOtrError("the TLV type is reserved by the protocol")
+var errMTUTooSmall = newOtrError("the MTU is too small to fragment the message")
+var errConversationFinished = newOtrError("the peer ended the encrypted conversation")
+var errEncryptionRequired = newOtrError("the policy requires encryption: the message was not sent")
 
 type otrError struct {
 	msg string
@@ -0,0 +1,51 @@
+package otr4
+
+// Every data message has an extra symmetric key, which the application can
+// use for out-of-band purposes, such as encrypting a file transfer. The
+// sender of a message tells the peer it uses the key with an Extra Symmetric
+// Key TLV, carrying a 4-byte usage and usage data.
+
+const (
+	extraSymmetricKeyBytes = 64
+	extraKeyUsageBytes     = 4
+)
+
+// extraSymmetricKey derives the extra symmetric key of a data message from
+// its encryption key
+func extraSymmetricKey(encKey []byte) []byte {
+	return kdf(usageExtraSymmetricKey, extraSymmetricKeyBytes, []byte{0xFF}, encKey)
+}
+
+// UseExtraSymmetricKey returns an extra symmetric key and the message telling
+// the peer about it, with the given usage and usage data.
+func (c *Conversation) UseExtraSymmetricKey(usage uint32, usageData []byte) (key []byte, toSend [][]byte, err error) {
+	if extraKeyUsageBytes+len(usageData) > 0xFFFF {
+		return nil, nil, errInvalidLength
+	}
+
+	t := tlv{
+		tlvType:  tlvTypeExtraSymmetricKey,
+		tlvValue: append(appendWord32(nil, usage), usageData...),
+	}
+
+	msg, key, err := c.createDataMessageWithExtraKey(appendTLVs(nil, []tlv{t}), flagIgnoreUnreadable)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	toSend, err = c.wireMessages(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, toSend, nil
+}
+
+func (c *Conversation) receiveExtraSymmetricKey(t tlv, key []byte) {
+	usageData, usage, ok := extractWord32(t.tlvValue)
+	if !ok || key == nil || c.ExtraSymmetricKeyReceived == nil {
+		return
+	}
+
+	c.ExtraSymmetricKeyReceived(usage, usageData, key)
+}
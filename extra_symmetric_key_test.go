@@ -0,0 +1,49 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_ExtraSymmetricKey(c *C) {
+	alice, bob := establishTestSession(c)
+
+	var usage uint32
+	var usageData, received []byte
+	bob.ExtraSymmetricKeyReceived = func(u uint32, data, key []byte) {
+		usage, usageData, received = u, data, key
+	}
+
+	key, toSend, err := alice.UseExtraSymmetricKey(0x00000001, []byte("file.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(key, HasLen, extraSymmetricKeyBytes)
+
+	plain, _, err := bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, HasLen, 0)
+	c.Assert(usage, Equals, uint32(0x00000001))
+	c.Assert(usageData, DeepEquals, []byte("file.txt"))
+	c.Assert(received, DeepEquals, key)
+
+	other, toSend, err := alice.UseExtraSymmetricKey(0x00000001, nil)
+	c.Assert(err, IsNil)
+	c.Assert(other, Not(DeepEquals), key)
+
+	_, _, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(received, DeepEquals, other)
+}
+
+func (s *OTR4Suite) Test_ExtraSymmetricKeyIsNotTheEncryptionKey(c *C) {
+	encKey := make([]byte, encKeyBytes)
+
+	c.Assert(extraSymmetricKey(encKey), HasLen, extraSymmetricKeyBytes)
+	c.Assert(extraSymmetricKey(encKey)[:encKeyBytes], Not(DeepEquals), encKey)
+}
+
+func (s *OTR4Suite) Test_ExtraSymmetricKeyTLVWithoutUsage(c *C) {
+	called := false
+	conv := &Conversation{ExtraSymmetricKeyReceived: func(uint32, []byte, []byte) { called = true }}
+
+	conv.processTLVs([]tlv{{tlvType: tlvTypeExtraSymmetricKey, tlvValue: []byte{0x01}}}, make([]byte, extraSymmetricKeyBytes))
+	c.Assert(called, Equals, false)
+}
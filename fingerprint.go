@@ -0,0 +1,95 @@
+package otr4
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"unicode"
+)
+
+const (
+	fingerprintBytes = 56
+
+	// a fingerprint is shown in blocks of this many hex digits
+	fingerprintBlockSize = 8
+)
+
+// Fingerprint identifies the long-term and forging keys of a client, or the
+// long-term key of a prekey server. Users compare fingerprints to know who
+// they are talking to.
+type Fingerprint [fingerprintBytes]byte
+
+func (pub *publicKey) fingerprint() Fingerprint {
+	var f Fingerprint
+	copy(f[:], kdf(usageFingerprint, fingerprintBytes, pub.h.Encode()))
+	return f
+}
+
+// clientFingerprint is KDF(usage_fingerprint, H || F, 56), for the long-term
+// key H and the forging key F of a client
+func clientFingerprint(pub, forgingKey *publicKey) Fingerprint {
+	var f Fingerprint
+	copy(f[:], kdf(usageFingerprint, fingerprintBytes, pub.h.Encode(), forgingKey.h.Encode()))
+	return f
+}
+
+func (p *clientProfile) fingerprint() Fingerprint {
+	return clientFingerprint(p.publicKey, p.forgingKey)
+}
+
+// String formats the fingerprint as upper case hex, in blocks of eight
+// digits separated by spaces.
+func (f Fingerprint) String() string {
+	h := strings.ToUpper(hex.EncodeToString(f[:]))
+
+	blocks := make([]string, 0, len(h)/fingerprintBlockSize)
+	for i := 0; i < len(h); i += fingerprintBlockSize {
+		blocks = append(blocks, h[i:i+fingerprintBlockSize])
+	}
+
+	return strings.Join(blocks, " ")
+}
+
+// Equal compares two fingerprints in constant time.
+func (f Fingerprint) Equal(other Fingerprint) bool {
+	return subtle.ConstantTimeCompare(f[:], other[:]) == 1
+}
+
+// ParseFingerprint reads a fingerprint typed by a user. Whitespace is ignored
+// and the hex digits can be in any case.
+func ParseFingerprint(s string) (Fingerprint, error) {
+	var f Fingerprint
+
+	h := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+
+	if hex.DecodedLen(len(h)) != fingerprintBytes {
+		return f, errInvalidFingerprint
+	}
+
+	_, err := hex.Decode(f[:], []byte(h))
+	if err != nil {
+		return f, errInvalidFingerprint
+	}
+
+	return f, nil
+}
+
+// OurFingerprint returns the fingerprint of our long-term and forging keys.
+func (c *Conversation) OurFingerprint() Fingerprint {
+	return clientFingerprint(&c.ourKeys.pub, &c.ourForgingKey.pub)
+}
+
+// TheirFingerprint returns the fingerprint of the long-term and forging keys
+// of the peer. It returns false if the peer is not known yet.
+func (c *Conversation) TheirFingerprint() (Fingerprint, bool) {
+	if c.theirProfile == nil {
+		return Fingerprint{}, false
+	}
+
+	return c.theirProfile.fingerprint(), true
+}
@@ -0,0 +1,99 @@
+package otr4
+
+import (
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+const testFingerprintString = "00010203 04050607 08090A0B 0C0D0E0F 10111213 14151617 18191A1B " +
+	"1C1D1E1F 20212223 24252627 28292A2B 2C2D2E2F 30313233 34353637"
+
+func testFingerprint() Fingerprint {
+	var f Fingerprint
+	for i := range f {
+		f[i] = byte(i)
+	}
+	return f
+}
+
+func (s *OTR4Suite) Test_PublicKeyFingerprint(c *C) {
+	f := testPubA.fingerprint()
+
+	c.Assert(f[:], DeepEquals, kdf(usageFingerprint, fingerprintBytes, testPubA.h.Encode()))
+	c.Assert(f.Equal(testPubB.fingerprint()), Equals, false)
+}
+
+func (s *OTR4Suite) Test_ClientProfileFingerprint(c *C) {
+	p := &clientProfile{publicKey: testPubA, forgingKey: testPubB}
+	other := &clientProfile{publicKey: testPubA, forgingKey: testPubA}
+
+	f := p.fingerprint()
+
+	c.Assert(f[:], DeepEquals, kdf(usageFingerprint, fingerprintBytes, testPubA.h.Encode(), testPubB.h.Encode()))
+	c.Assert(f.Equal(testPubA.fingerprint()), Equals, false)
+	c.Assert(f.Equal(other.fingerprint()), Equals, false)
+}
+
+func (s *OTR4Suite) Test_OurFingerprintSurvivesANewProfile(c *C) {
+	conv := newTestConversation(c, 0x101)
+	f := conv.OurFingerprint()
+
+	p, err := conv.clientProfile()
+	c.Assert(err, IsNil)
+	c.Assert(p.fingerprint(), Equals, f)
+
+	conv.ourProfile.expiration = time.Now().Add(-time.Second)
+	p, err = conv.clientProfile()
+	c.Assert(err, IsNil)
+	c.Assert(p.fingerprint(), Equals, f)
+}
+
+func (s *OTR4Suite) Test_FingerprintString(c *C) {
+	c.Assert(testFingerprint().String(), Equals, testFingerprintString)
+}
+
+func (s *OTR4Suite) Test_ParseFingerprint(c *C) {
+	f, err := ParseFingerprint(testFingerprintString)
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, testFingerprint())
+
+	f, err = ParseFingerprint("\t" + strings.ToLower(strings.Replace(testFingerprintString, " ", "\n", 3)) + " ")
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, testFingerprint())
+}
+
+func (s *OTR4Suite) Test_ParseInvalidFingerprint(c *C) {
+	_, err := ParseFingerprint(testFingerprintString[:len(testFingerprintString)-2])
+	c.Assert(err, Equals, errInvalidFingerprint)
+
+	_, err = ParseFingerprint(testFingerprintString + "00")
+	c.Assert(err, Equals, errInvalidFingerprint)
+
+	_, err = ParseFingerprint("X" + testFingerprintString[1:])
+	c.Assert(err, Equals, errInvalidFingerprint)
+}
+
+func (s *OTR4Suite) Test_FingerprintEqual(c *C) {
+	f := testFingerprint()
+	other := testFingerprint()
+	c.Assert(f.Equal(other), Equals, true)
+
+	other[fingerprintBytes-1] ^= 0x01
+	c.Assert(f.Equal(other), Equals, false)
+}
+
+func (s *OTR4Suite) Test_ConversationFingerprints(c *C) {
+	alice, bob := establishTestSession(c)
+
+	theirs, ok := alice.TheirFingerprint()
+	c.Assert(ok, Equals, true)
+	c.Assert(theirs.Equal(bob.OurFingerprint()), Equals, true)
+
+	conv, err := NewConversation(fixedRand(randData))
+	c.Assert(err, IsNil)
+
+	_, ok = conv.TheirFingerprint()
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,290 @@
+package otr4
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Encoded messages longer than the MTU of the transport are split into
+// fragments of the form
+//
+//	?OTR|identifier|sender instance tag|receiver instance tag,k,n,piece,
+//
+// where the fragment k of n carries a piece of the message. Fragments are
+// reassembled per sender instance and identifier, so fragments of several
+// messages can arrive interleaved.
+
+const (
+	// the length of a fragment, without its piece
+	fragmentOverhead = len("?OTR|00000000|00000000|00000000,00000,00000,,")
+
+	maxFragments = 65535
+
+	// limits on what is kept of incomplete messages
+	maxFragmentedMessages = 32
+	maxFragmentedBytes    = 1 << 20
+	fragmentTimeout       = 5 * time.Minute
+
+	// the size of the slice header kept for every fragment of an incomplete
+	// message, counted against maxFragmentedBytes
+	sliceHeaderBytes = 24
+)
+
+var fragmentPrefix = []byte("?OTR|")
+
+type fragment struct {
+	identifier  uint32
+	senderTag   uint32
+	receiverTag uint32
+	k, n        int
+	piece       []byte
+}
+
+func isFragment(msg []byte) bool {
+	return bytes.HasPrefix(msg, fragmentPrefix)
+}
+
+func (f *fragment) serialize() []byte {
+	return []byte(fmt.Sprintf("%s%08x|%08x|%08x,%05d,%05d,%s,", fragmentPrefix, f.identifier, f.senderTag, f.receiverTag, f.k, f.n, f.piece))
+}
+
+func parseFragment(msg []byte) (*fragment, error) {
+	if !isFragment(msg) || !bytes.HasSuffix(msg, []byte(",")) {
+		return nil, errMalformedMessage
+	}
+
+	fields := bytes.Split(msg[len(fragmentPrefix):len(msg)-1], []byte("|"))
+	if len(fields) != 3 {
+		return nil, errMalformedMessage
+	}
+
+	rest := bytes.Split(fields[2], []byte(","))
+	if len(rest) != 4 {
+		return nil, errMalformedMessage
+	}
+
+	f := &fragment{piece: rest[3]}
+	var err1, err2, err3, err4, err5 error
+
+	f.identifier, err1 = parseFragmentTag(fields[0])
+	f.senderTag, err2 = parseFragmentTag(fields[1])
+	f.receiverTag, err3 = parseFragmentTag(rest[0])
+	f.k, err4 = strconv.Atoi(string(rest[1]))
+	f.n, err5 = strconv.Atoi(string(rest[2]))
+	if firstError(err1, err2, err3, err4, err5) != nil {
+		return nil, errMalformedMessage
+	}
+
+	if f.k < 1 || f.n > maxFragments || f.k > f.n {
+		return nil, errMalformedMessage
+	}
+
+	return f, nil
+}
+
+func parseFragmentTag(bs []byte) (uint32, error) {
+	if len(bs) != 8 {
+		return 0, errMalformedMessage
+	}
+
+	v, err := strconv.ParseUint(string(bs), 16, 32)
+	return uint32(v), err
+}
+
+// fragmentMessage splits an encoded message into fragments no longer than
+// mtu. Messages that fit are returned as they are.
+func fragmentMessage(msg []byte, mtu int, identifier, senderTag, receiverTag uint32) ([][]byte, error) {
+	if mtu <= 0 || len(msg) <= mtu {
+		return [][]byte{msg}, nil
+	}
+
+	size := mtu - fragmentOverhead
+	if size <= 0 {
+		return nil, errMTUTooSmall
+	}
+
+	n := (len(msg) + size - 1) / size
+	if n > maxFragments {
+		return nil, errMTUTooSmall
+	}
+
+	out := make([][]byte, 0, n)
+	for k := 1; k <= n; k++ {
+		end := k * size
+		if end > len(msg) {
+			end = len(msg)
+		}
+
+		f := &fragment{
+			identifier:  identifier,
+			senderTag:   senderTag,
+			receiverTag: receiverTag,
+			k:           k,
+			n:           n,
+			piece:       msg[(k-1)*size : end],
+		}
+		out = append(out, f.serialize())
+	}
+
+	return out, nil
+}
+
+type fragmentKey struct {
+	senderTag  uint32
+	identifier uint32
+}
+
+// fragmentedMessage is a message of which only some fragments arrived
+type fragmentedMessage struct {
+	pieces   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// fragmentBuffer reassembles fragmented messages. It keeps a bounded number
+// of incomplete messages, of a bounded total size, for a bounded time, so a
+// peer cannot make us keep an unbounded amount of data.
+type fragmentBuffer struct {
+	messages map[fragmentKey]*fragmentedMessage
+	size     int
+}
+
+func newFragmentBuffer() *fragmentBuffer {
+	return &fragmentBuffer{messages: make(map[fragmentKey]*fragmentedMessage)}
+}
+
+func (b *fragmentBuffer) drop(key fragmentKey) {
+	if m, ok := b.messages[key]; ok {
+		b.size -= m.size
+		delete(b.messages, key)
+	}
+}
+
+// expire drops the messages started before deadline
+func (b *fragmentBuffer) expire(deadline time.Time) {
+	for key, m := range b.messages {
+		if m.started.Before(deadline) {
+			b.drop(key)
+		}
+	}
+}
+
+func (b *fragmentBuffer) dropOldest() {
+	var oldest fragmentKey
+	var started time.Time
+	for key, m := range b.messages {
+		if started.IsZero() || m.started.Before(started) {
+			oldest, started = key, m.started
+		}
+	}
+	b.drop(oldest)
+}
+
+// add stores a fragment and returns the message it completes, if any
+func (b *fragmentBuffer) add(f *fragment, now time.Time) ([]byte, bool) {
+	b.expire(now.Add(-fragmentTimeout))
+
+	if f.n == 1 {
+		return f.piece, true
+	}
+
+	key := fragmentKey{senderTag: f.senderTag, identifier: f.identifier}
+	if m, ok := b.messages[key]; ok && len(m.pieces) != f.n {
+		b.drop(key)
+	}
+
+	if m, ok := b.messages[key]; ok && m.pieces[f.k-1] != nil {
+		return nil, false
+	}
+
+	// a new message costs the slice of its pieces as well
+	cost := func() int {
+		if b.messages[key] == nil {
+			return len(f.piece) + f.n*sliceHeaderBytes
+		}
+		return len(f.piece)
+	}
+
+	if cost() > maxFragmentedBytes {
+		return nil, false
+	}
+
+	for len(b.messages) > 0 && (b.size+cost() > maxFragmentedBytes ||
+		b.messages[key] == nil && len(b.messages) >= maxFragmentedMessages) {
+		b.dropOldest()
+	}
+
+	size := cost()
+
+	m, ok := b.messages[key]
+	if !ok {
+		m = &fragmentedMessage{pieces: make([][]byte, f.n), started: now}
+		b.messages[key] = m
+	}
+
+	m.pieces[f.k-1] = append([]byte{}, f.piece...)
+	m.received++
+	m.size += size
+	b.size += size
+
+	if m.received < f.n {
+		return nil, false
+	}
+
+	b.drop(key)
+	return bytes.Join(m.pieces, nil), true
+}
+
+// receiveFragment handles a fragment sent to us, returning the message it
+// completes, if any
+func (c *Conversation) receiveFragment(msg []byte) ([]byte, bool, error) {
+	f, err := parseFragment(msg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !c.isForUs(f.receiverTag) {
+		return nil, false, nil
+	}
+
+	if c.fragments == nil {
+		c.fragments = newFragmentBuffer()
+	}
+
+	complete, ok := c.fragments.add(f, time.Now())
+	if ok && !isEncoded(complete) {
+		return nil, false, errMalformedMessage
+	}
+
+	return complete, ok, nil
+}
+
+// wireMessages encodes messages to be sent to the peer, fragmenting them if
+// they are longer than the MTU. Error messages are sent as they are.
+func (c *Conversation) wireMessages(msgs ...[]byte) ([][]byte, error) {
+	var out [][]byte
+
+	for _, msg := range msgs {
+		if isErrorMessage(msg) {
+			out = append(out, msg)
+			continue
+		}
+
+		identifier, err := randIdentifier(c.rand())
+		if err != nil {
+			return nil, err
+		}
+
+		fragments, err := fragmentMessage(encodeMessage(msg), c.MTU, identifier, c.ourInstanceTag, c.theirInstanceTag)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, fragments...)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,241 @@
+package otr4
+
+import (
+	"bytes"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func testFragment(identifier, senderTag uint32, k, n int, piece string) *fragment {
+	return &fragment{
+		identifier:  identifier,
+		senderTag:   senderTag,
+		receiverTag: 0x102,
+		k:           k,
+		n:           n,
+		piece:       []byte(piece),
+	}
+}
+
+func (s *OTR4Suite) Test_SerializeFragment(c *C) {
+	f := &fragment{
+		identifier:  0x0000abcd,
+		senderTag:   0x101,
+		receiverTag: 0x102,
+		k:           2,
+		n:           3,
+		piece:       []byte("AAQD/w"),
+	}
+
+	msg := f.serialize()
+	c.Assert(msg, DeepEquals, []byte("?OTR|0000abcd|00000101|00000102,00002,00003,AAQD/w,"))
+	c.Assert(isFragment(msg), Equals, true)
+
+	parsed, err := parseFragment(msg)
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, f)
+}
+
+func (s *OTR4Suite) Test_ParseMalformedFragment(c *C) {
+	for _, msg := range []string{
+		"?OTR|0000abcd|00000101|00000102,00002,00003,AAQD/w",
+		"?OTR|0000abcd|00000101,00002,00003,AAQD/w,",
+		"?OTR|0000abcd|00000101|00000102,00002,00003,AA,QD,",
+		"?OTR|0000abcd|0000101|00000102,00002,00003,AAQD/w,",
+		"?OTR|0000abcg|00000101|00000102,00002,00003,AAQD/w,",
+		"?OTR|0000abcd|00000101|00000102,0000x,00003,AAQD/w,",
+		"?OTR|0000abcd|00000101|00000102,00000,00003,AAQD/w,",
+		"?OTR|0000abcd|00000101|00000102,00004,00003,AAQD/w,",
+		"?OTR|0000abcd|00000101|00000102,00001,65536,AAQD/w,",
+		"?OTR:AAQD/w==.",
+	} {
+		_, err := parseFragment([]byte(msg))
+		c.Assert(err, Equals, errMalformedMessage)
+	}
+}
+
+func (s *OTR4Suite) Test_FragmentMessage(c *C) {
+	msg := encodeMessage(bytes.Repeat([]byte{0x42}, 300))
+
+	fragments, err := fragmentMessage(msg, 100, 0x1234, 0x101, 0x102)
+	c.Assert(err, IsNil)
+	c.Assert(len(fragments) > 1, Equals, true)
+
+	var pieces [][]byte
+	for i, m := range fragments {
+		c.Assert(len(m) <= 100, Equals, true)
+
+		f, err := parseFragment(m)
+		c.Assert(err, IsNil)
+		c.Assert(f.identifier, Equals, uint32(0x1234))
+		c.Assert(f.senderTag, Equals, uint32(0x101))
+		c.Assert(f.receiverTag, Equals, uint32(0x102))
+		c.Assert(f.k, Equals, i+1)
+		c.Assert(f.n, Equals, len(fragments))
+		pieces = append(pieces, f.piece)
+	}
+
+	c.Assert(bytes.Join(pieces, nil), DeepEquals, msg)
+}
+
+func (s *OTR4Suite) Test_FragmentMessageThatFits(c *C) {
+	msg := encodeMessage([]byte("short"))
+
+	fragments, err := fragmentMessage(msg, len(msg), 0x1234, 0x101, 0x102)
+	c.Assert(err, IsNil)
+	c.Assert(fragments, DeepEquals, [][]byte{msg})
+
+	fragments, err = fragmentMessage(msg, 0, 0x1234, 0x101, 0x102)
+	c.Assert(err, IsNil)
+	c.Assert(fragments, DeepEquals, [][]byte{msg})
+}
+
+func (s *OTR4Suite) Test_FragmentMessageWithTooSmallMTU(c *C) {
+	msg := encodeMessage(bytes.Repeat([]byte{0x42}, 300))
+
+	_, err := fragmentMessage(msg, fragmentOverhead, 0x1234, 0x101, 0x102)
+	c.Assert(err, Equals, errMTUTooSmall)
+}
+
+func (s *OTR4Suite) Test_FragmentBufferReassemblesInterleavedMessages(c *C) {
+	b := newFragmentBuffer()
+	now := time.Now()
+
+	_, ok := b.add(testFragment(1, 0x101, 2, 2, "world"), now)
+	c.Assert(ok, Equals, false)
+	_, ok = b.add(testFragment(1, 0x103, 1, 2, "good"), now)
+	c.Assert(ok, Equals, false)
+	_, ok = b.add(testFragment(1, 0x101, 2, 2, "world"), now)
+	c.Assert(ok, Equals, false)
+
+	msg, ok := b.add(testFragment(1, 0x101, 1, 2, "hello "), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(msg, DeepEquals, []byte("hello world"))
+
+	msg, ok = b.add(testFragment(1, 0x103, 2, 2, "bye"), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(msg, DeepEquals, []byte("goodbye"))
+
+	c.Assert(b.messages, HasLen, 0)
+	c.Assert(b.size, Equals, 0)
+}
+
+func (s *OTR4Suite) Test_FragmentBufferRestartsWhenTheNumberOfFragmentsChanges(c *C) {
+	b := newFragmentBuffer()
+	now := time.Now()
+
+	b.add(testFragment(1, 0x101, 1, 3, "stale"), now)
+
+	_, ok := b.add(testFragment(1, 0x101, 2, 2, "b"), now)
+	c.Assert(ok, Equals, false)
+
+	msg, ok := b.add(testFragment(1, 0x101, 1, 2, "a"), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(msg, DeepEquals, []byte("ab"))
+}
+
+func (s *OTR4Suite) Test_FragmentBufferLimitsTheNumberOfMessages(c *C) {
+	b := newFragmentBuffer()
+	now := time.Now()
+
+	for i := 0; i <= maxFragmentedMessages; i++ {
+		b.add(testFragment(uint32(i), 0x101, 1, 2, "a"), now.Add(time.Duration(i)*time.Second))
+	}
+
+	c.Assert(b.messages, HasLen, maxFragmentedMessages)
+	c.Assert(b.messages[fragmentKey{senderTag: 0x101, identifier: 0}], IsNil)
+
+	_, ok := b.add(testFragment(0, 0x101, 2, 2, "b"), now)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *OTR4Suite) Test_FragmentBufferLimitsTheBufferedBytes(c *C) {
+	b := newFragmentBuffer()
+	now := time.Now()
+	piece := string(bytes.Repeat([]byte{'a'}, maxFragmentedBytes/2+1))
+
+	b.add(testFragment(1, 0x101, 1, 2, piece), now)
+	b.add(testFragment(2, 0x101, 1, 2, piece), now.Add(time.Second))
+
+	c.Assert(b.messages, HasLen, 1)
+	c.Assert(b.messages[fragmentKey{senderTag: 0x101, identifier: 2}], NotNil)
+	c.Assert(b.size <= maxFragmentedBytes, Equals, true)
+
+	_, ok := b.add(testFragment(3, 0x101, 1, 2, piece+piece), now)
+	c.Assert(ok, Equals, false)
+	c.Assert(b.messages[fragmentKey{senderTag: 0x101, identifier: 3}], IsNil)
+}
+
+func (s *OTR4Suite) Test_FragmentBufferExpiresOldMessages(c *C) {
+	b := newFragmentBuffer()
+	now := time.Now()
+
+	b.add(testFragment(1, 0x101, 1, 2, "hello "), now)
+
+	_, ok := b.add(testFragment(1, 0x101, 2, 2, "world"), now.Add(fragmentTimeout+time.Second))
+	c.Assert(ok, Equals, false)
+	c.Assert(b.messages, HasLen, 1)
+	c.Assert(b.size, Equals, len("world")+2*sliceHeaderBytes)
+}
+
+func (s *OTR4Suite) Test_FragmentBufferCountsThePiecesOfEveryMessage(c *C) {
+	b := newFragmentBuffer()
+	now := time.Now()
+
+	_, ok := b.add(testFragment(1, 0x101, 1, maxFragments, "a"), now)
+	c.Assert(ok, Equals, false)
+	c.Assert(b.messages, HasLen, 0)
+	c.Assert(b.size, Equals, 0)
+
+	n := maxFragmentedBytes / sliceHeaderBytes / 2
+	b.add(testFragment(2, 0x101, 1, n, "a"), now)
+	c.Assert(b.size, Equals, 1+n*sliceHeaderBytes)
+
+	b.add(testFragment(3, 0x101, 1, n+1, "a"), now.Add(time.Second))
+	c.Assert(b.messages, HasLen, 1)
+	c.Assert(b.messages[fragmentKey{senderTag: 0x101, identifier: 3}], NotNil)
+	c.Assert(b.size <= maxFragmentedBytes, Equals, true)
+}
+
+func (s *OTR4Suite) Test_SendAndReceiveFragmentedMessages(c *C) {
+	alice, bob := establishTestSession(c)
+	alice.MTU = 100
+
+	toSend, err := alice.Send(bytes.Repeat([]byte("a long message "), 20))
+	c.Assert(err, IsNil)
+	c.Assert(len(toSend) > 2, Equals, true)
+
+	last := len(toSend) - 1
+	toSend[0], toSend[last] = toSend[last], toSend[0]
+
+	for _, m := range toSend[:last] {
+		c.Assert(len(m) <= alice.MTU, Equals, true)
+
+		plain, _, err := bob.Receive(m)
+		c.Assert(err, IsNil)
+		c.Assert(plain, IsNil)
+	}
+
+	plain, _, err := bob.Receive(toSend[last])
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, bytes.Repeat([]byte("a long message "), 20))
+}
+
+func (s *OTR4Suite) Test_ReceiveIgnoresFragmentsForAnotherInstance(c *C) {
+	conv := newTestConversation(c, 0x102)
+
+	f := &fragment{identifier: 1, senderTag: 0x101, receiverTag: 0x103, k: 1, n: 1, piece: encodeMessage([]byte{0x00})}
+	plain, toSend, err := conv.Receive(f.serialize())
+	c.Assert(err, IsNil)
+	c.Assert(plain, IsNil)
+	c.Assert(toSend, IsNil)
+}
+
+func (s *OTR4Suite) Test_ReceiveRejectsFragmentsOfPlaintext(c *C) {
+	conv := newTestConversation(c, 0x102)
+
+	f := &fragment{identifier: 1, senderTag: 0x101, receiverTag: 0x102, k: 1, n: 1, piece: []byte("hello")}
+	_, _, err := conv.Receive(f.serialize())
+	c.Assert(err, Equals, errMalformedMessage)
+}
@@ -0,0 +1,48 @@
+package otr4
+
+type messageHeader struct {
+	version             uint16
+	messageType         byte
+	senderInstanceTag   uint32
+	receiverInstanceTag uint32
+}
+
+func (c *Conversation) header(messageType byte) messageHeader {
+	return messageHeader{
+		version:             otrVersion,
+		messageType:         messageType,
+		senderInstanceTag:   c.ourInstanceTag,
+		receiverInstanceTag: c.theirInstanceTag,
+	}
+}
+
+func (h messageHeader) serialize() []byte {
+	out := appendShort(nil, h.version)
+	out = append(out, h.messageType)
+	out = appendWord32(out, h.senderInstanceTag)
+	return appendWord32(out, h.receiverInstanceTag)
+}
+
+func extractHeader(bs []byte) ([]byte, messageHeader, bool) {
+	h := messageHeader{}
+
+	cursor, version, ok := extractShort(bs)
+	if !ok || len(cursor) < 1 {
+		return bs, h, false
+	}
+
+	h.version = version
+	h.messageType = cursor[0]
+
+	cursor, h.senderInstanceTag, ok = extractWord32(cursor[1:])
+	if !ok {
+		return bs, h, false
+	}
+
+	cursor, h.receiverInstanceTag, ok = extractWord32(cursor)
+	if !ok {
+		return bs, h, false
+	}
+
+	return cursor, h, true
+}
@@ -0,0 +1,51 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_SerializeHeader(c *C) {
+	h := messageHeader{
+		version:             otrVersion,
+		messageType:         0x35,
+		senderInstanceTag:   0x00000101,
+		receiverInstanceTag: 0x00000102,
+	}
+
+	exp := []byte{
+		0x00, 0x04, 0x35,
+		0x00, 0x00, 0x01, 0x01,
+		0x00, 0x00, 0x01, 0x02,
+	}
+
+	c.Assert(h.serialize(), DeepEquals, exp)
+}
+
+func (s *OTR4Suite) Test_ExtractHeader(c *C) {
+	bs := []byte{
+		0x00, 0x04, 0x35,
+		0x00, 0x00, 0x01, 0x01,
+		0x00, 0x00, 0x01, 0x02,
+		0x01,
+	}
+	cursor, h, ok := extractHeader(bs)
+
+	exp := messageHeader{
+		version:             otrVersion,
+		messageType:         0x35,
+		senderInstanceTag:   0x00000101,
+		receiverInstanceTag: 0x00000102,
+	}
+
+	c.Assert(ok, Equals, true)
+	c.Assert(h, Equals, exp)
+	c.Assert(cursor, DeepEquals, []byte{0x01})
+
+	_, _, ok = extractHeader([]byte{0x00, 0x04})
+
+	c.Assert(ok, Equals, false)
+
+	_, _, ok = extractHeader(bs[:10])
+
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,46 @@
+package otr4
+
+import "io"
+
+// Every client instance has a random instance tag, so an account used on
+// several devices gets a separate conversation with each of them. Tags below
+// 0x100 are reserved: zero means the instance is not known yet.
+const minInstanceTag = uint32(0x100)
+
+func isValidInstanceTag(tag uint32) bool {
+	return tag >= minInstanceTag
+}
+
+func generateInstanceTag(rand io.Reader) (uint32, error) {
+	var b [4]byte
+
+	for {
+		_, err := io.ReadFull(rand, b[:])
+		if err != nil {
+			return 0, notEnoughEntropy
+		}
+
+		_, tag, _ := extractWord32(b[:])
+		if isValidInstanceTag(tag) {
+			return tag, nil
+		}
+	}
+}
+
+// InstanceTag returns the instance tag of our client
+func (c *Conversation) InstanceTag() uint32 {
+	return c.ourInstanceTag
+}
+
+// TheirInstanceTag returns the instance tag of the peer, or zero if it is not
+// known yet
+func (c *Conversation) TheirInstanceTag() uint32 {
+	return c.theirInstanceTag
+}
+
+// isForUs tells whether a message with the given receiver instance tag was
+// sent to our instance. Messages with no receiver instance tag were sent to
+// every instance of our account.
+func (c *Conversation) isForUs(receiverTag uint32) bool {
+	return receiverTag == 0 || c.ourInstanceTag == 0 || receiverTag == c.ourInstanceTag
+}
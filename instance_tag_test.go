@@ -0,0 +1,60 @@
+package otr4
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_GenerateInstanceTagSkipsReservedTags(c *C) {
+	tag, err := generateInstanceTag(bytes.NewReader([]byte{0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x01, 0x00}))
+
+	c.Assert(err, IsNil)
+	c.Assert(tag, Equals, uint32(0x100))
+
+	_, err = generateInstanceTag(bytes.NewReader([]byte{0x00, 0x00, 0x00}))
+	c.Assert(err, Equals, notEnoughEntropy)
+}
+
+func (s *OTR4Suite) Test_NewConversationGeneratesInstanceTag(c *C) {
+	conv, err := NewConversation(nil)
+
+	c.Assert(err, IsNil)
+	c.Assert(isValidInstanceTag(conv.InstanceTag()), Equals, true)
+	c.Assert(conv.TheirInstanceTag(), Equals, uint32(0))
+}
+
+func (s *OTR4Suite) Test_DAKELearnsTheirInstanceTag(c *C) {
+	alice, bob := establishTestSession(c)
+
+	c.Assert(alice.TheirInstanceTag(), Equals, bob.InstanceTag())
+	c.Assert(bob.TheirInstanceTag(), Equals, alice.InstanceTag())
+}
+
+func (s *OTR4Suite) Test_ReceiveIgnoresMessagesForAnotherInstance(c *C) {
+	conv := newTestConversation(c, 0x102)
+	msg := messageHeader{version: otrVersion, messageType: 0xFF, senderInstanceTag: 0x101, receiverInstanceTag: 0x103}.serialize()
+
+	plain, toSend, err := conv.Receive(encodeMessage(msg))
+
+	c.Assert(err, IsNil)
+	c.Assert(plain, IsNil)
+	c.Assert(toSend, IsNil)
+}
+
+func (s *OTR4Suite) Test_ReceiveRejectsReservedSenderInstanceTags(c *C) {
+	conv := newTestConversation(c, 0x102)
+	msg := messageHeader{version: otrVersion, messageType: dataMsgType, senderInstanceTag: 0xff, receiverInstanceTag: 0x102}.serialize()
+
+	_, _, err := conv.Receive(encodeMessage(msg))
+
+	c.Assert(err, Equals, errInvalidInstanceTag)
+}
+
+func (s *OTR4Suite) Test_ClientProfileWithReservedInstanceTagIsInvalid(c *C) {
+	profile, keys := newTestClientProfile(c)
+	profile.instanceTag = 0x01
+	profile.sign(keys)
+
+	c.Assert(profile.validate(), Equals, errInvalidInstanceTag)
+}
@@ -0,0 +1,106 @@
+package otr4
+
+import (
+	"github.com/otrv4/ed448"
+	"golang.org/x/crypto/sha3"
+)
+
+// Every value derived by hashing comes from
+//
+//	KDF(usageID || values, size) = SHAKE-256("OTRv4" || usageID || values, size)
+//
+// so values derived for different purposes never collide. HWC and HCMAC are
+// the same function with a size of 64 bytes, used for hashes and MACs.
+
+var kdfDomain = []byte("OTRv4")
+
+// usage IDs, from the spec
+const (
+	usageFingerprint                  byte = 0x00
+	usageThirdBraceKey                byte = 0x01
+	usageBraceKey                     byte = 0x02
+	usageSharedSecret                 byte = 0x03
+	usageSSID                         byte = 0x04
+	usageAuthRBobClientProfile        byte = 0x05
+	usageAuthRAliceClientProfile      byte = 0x06
+	usageAuthRPhi                     byte = 0x07
+	usageAuthIBobClientProfile        byte = 0x08
+	usageAuthIAliceClientProfile      byte = 0x09
+	usageAuthIPhi                     byte = 0x0A
+	usageFirstRootKey                 byte = 0x0B
+	usageTmpKey                       byte = 0x0C
+	usageAuthMACKey                   byte = 0x0D
+	usageNonIntAuthBobClientProfile   byte = 0x0E
+	usageNonIntAuthAliceClientProfile byte = 0x0F
+	usageNonIntAuthPhi                byte = 0x10
+	usageAuthMAC                      byte = 0x11
+	usageECDHFirstEphemeral           byte = 0x12
+	usageDHFirstEphemeral             byte = 0x13
+	usageRootKey                      byte = 0x14
+	usageChainKey                     byte = 0x15
+	usageNextChainKey                 byte = 0x16
+	usageMessageKey                   byte = 0x17
+	usageMACKey                       byte = 0x18
+	usageExtraSymmetricKey            byte = 0x19
+	usageAuthenticator                byte = 0x1A
+	usageSMPSecret                    byte = 0x1B
+	usageAuth                         byte = 0x1C
+)
+
+func shake256(domain []byte, usageID byte, size int, values ...[]byte) []byte {
+	h := sha3.NewShake256()
+	h.Write(domain)
+	h.Write([]byte{usageID})
+	for _, v := range values {
+		h.Write(v)
+	}
+
+	out := make([]byte, size)
+	h.Read(out)
+	return out
+}
+
+func kdf(usageID byte, size int, values ...[]byte) []byte {
+	return shake256(kdfDomain, usageID, size, values...)
+}
+
+func hwc(usageID byte, values ...[]byte) []byte {
+	return kdf(usageID, hashBytes, values...)
+}
+
+func hcmac(usageID byte, values ...[]byte) []byte {
+	return kdf(usageID, macBytes, values...)
+}
+
+// reduceChunkBytes is the size of the pieces reduceToScalar works on: they
+// stay below the order of the base point, and so does 2^(8*reduceChunkBytes)
+const reduceChunkBytes = fieldBytes - 1
+
+// reduceToScalar interprets a little-endian value modulo the order of the
+// base point. It uses the constant-time arithmetic of the library, since some
+// of the values reduced are secret.
+func reduceToScalar(bs []byte) ed448.Scalar {
+	var shift [fieldBytes]byte
+	shift[reduceChunkBytes] = 0x01
+	base := ed448.NewScalar(shift[:])
+
+	out := ed448.NewScalar()
+	for i := (len(bs) - 1) / reduceChunkBytes; i >= 0; i-- {
+		end := (i + 1) * reduceChunkBytes
+		if end > len(bs) {
+			end = len(bs)
+		}
+
+		var chunk [fieldBytes]byte
+		copy(chunk[:], bs[i*reduceChunkBytes:end])
+
+		out.Mul(out, base)
+		out.Add(out, ed448.NewScalar(chunk[:]))
+	}
+
+	return out
+}
+
+func hashToScalar(usageID byte, values ...[]byte) ed448.Scalar {
+	return reduceToScalar(hwc(usageID, values...))
+}
@@ -0,0 +1,64 @@
+package otr4
+
+import (
+	"github.com/otrv4/ed448"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_KDF(c *C) {
+	in := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+	c.Assert(kdf(usageSSID, 8, in), DeepEquals, hexToBytes("f18e8b0f364a1ba0"))
+	c.Assert(kdf(usageSSID, 8, in[:4], in[4:]), DeepEquals, kdf(usageSSID, 8, in))
+	c.Assert(kdf(usageSharedSecret, 8, in), Not(DeepEquals), kdf(usageSSID, 8, in))
+}
+
+func (s *OTR4Suite) Test_KDFSizes(c *C) {
+	c.Assert(hwc(usageFingerprint, testByteSlice), HasLen, hashBytes)
+	c.Assert(hcmac(usageAuthMAC, testByteSlice), HasLen, macBytes)
+	c.Assert(kdf(usageMessageKey, symKeyBytes, testByteSlice), HasLen, symKeyBytes)
+}
+
+func (s *OTR4Suite) Test_KDFIsBoundToItsDomain(c *C) {
+	c.Assert(shake256([]byte("OTR-Prekey-Server"), usageSSID, 8, testByteSlice), Not(DeepEquals), kdf(usageSSID, 8, testByteSlice))
+}
+
+func (s *OTR4Suite) Test_ReduceToScalar(c *C) {
+	bs := make([]byte, hashBytes)
+	for i := range bs {
+		bs[i] = 0xff
+	}
+
+	exp := ed448.NewScalar(hexToBytes("ffffffffffffffff33ec9e52b5f51c72abc2e9c835f64c7abf25a744d992c4ee5870d70c0200000000000000000000000000000000000000"))
+
+	c.Assert(reduceToScalar(bs), DeepEquals, exp)
+}
+
+func (s *OTR4Suite) Test_ReduceToScalarReducesLongValues(c *C) {
+	bs := make([]byte, signatureSize)
+	for i := range bs {
+		bs[i] = byte(0xff - i)
+	}
+
+	n := fromLittleEndian(bs)
+	n.Mod(n, edL)
+
+	c.Assert(reduceToScalar(bs).Encode(), DeepEquals, littleEndian(n, fieldBytes))
+}
+
+func (s *OTR4Suite) Test_HashToScalar(c *C) {
+	scalar := hashToScalar(0x01, testByteSlice)
+
+	exp := ed448.NewScalar([]byte{
+		0xa5, 0xb7, 0xf7, 0xe5, 0x81, 0xc8, 0x9b, 0xfc,
+		0x11, 0x63, 0xac, 0x9d, 0x69, 0x8b, 0xa8, 0xe8,
+		0x4e, 0x69, 0x85, 0x08, 0x2a, 0x3f, 0x03, 0x0f,
+		0x8e, 0x20, 0xdd, 0x7c, 0x7e, 0x5e, 0x21, 0x1d,
+		0x9c, 0x1c, 0x97, 0xfa, 0x4d, 0x0e, 0x27, 0x2b,
+		0xa3, 0xf2, 0xdb, 0x62, 0x12, 0x4b, 0x3d, 0x5c,
+		0x16, 0xd7, 0x82, 0x2e, 0x5e, 0xc0, 0xf3, 0x1e,
+	})
+
+	c.Assert(scalar, DeepEquals, exp)
+}
@@ -20,6 +20,9 @@ type publicKey struct {
 
 type privateKey struct {
 	r ed448.Scalar
+
+	// the random value r is derived from, needed to sign
+	sym []byte
 }
 
 func isValidPublicKey(pubs ...*publicKey) bool {
@@ -49,6 +52,7 @@ func generateKeys(rand io.Reader) (*publicKey, *privateKey, error) {
 	digest[privateKeySize-1] = 0
 	digest[privateKeySize-2] |= mask
 
+	priv.sym = privateKey
 	priv.r = ed448.NewScalar(digest[:])
 	for c := uint(1); c < uint(ed448.Cofactor); c <<= 1 {
 		priv.r.Halve(priv.r)
@@ -59,6 +63,15 @@ func generateKeys(rand io.Reader) (*publicKey, *privateKey, error) {
 	return pub, priv, nil
 }
 
+func generateKeyPair(rand io.Reader) (*keyPair, error) {
+	pub, priv, err := generateKeys(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyPair{pub: *pub, priv: *priv}, nil
+}
+
 var pubKeyType = []byte{0x00, 0x10}
 var pubKeyTypeValue = uint16(0x0010)
 
@@ -84,3 +97,12 @@ func deserialize(ser []byte) (*publicKey, error) {
 
 	return pub, err
 }
+
+// sign creates an Ed448 signature of message with the long-term key
+func (k *keyPair) sign(message []byte) []byte {
+	return eddsaSign(k.priv.sym, k.pub.h.DSAEncode(), eddsaContext, message)
+}
+
+func (pub *publicKey) verify(message, sig []byte) bool {
+	return eddsaVerify(pub.h, eddsaContext, message, sig)
+}
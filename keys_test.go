@@ -1,6 +1,8 @@
 package otr4
 
 import (
+	"crypto/rand"
+
 	"github.com/otrv4/ed448"
 
 	. "gopkg.in/check.v1"
@@ -89,3 +91,32 @@ func (s *OTR4Suite) Test_DeserializeLongTermPubKey(c *C) {
 
 	c.Assert(err, ErrorMatches, "*. invalid length")
 }
+
+func (s *OTR4Suite) Test_SignAndVerify(c *C) {
+	keys, err := generateKeyPair(rand.Reader)
+	c.Assert(err, IsNil)
+
+	message := []byte("our message")
+	sig := keys.sign(message)
+
+	c.Assert(sig, HasLen, signatureSize)
+	c.Assert(keys.sign(message), DeepEquals, sig)
+	c.Assert(keys.pub.verify(message, sig), Equals, true)
+}
+
+func (s *OTR4Suite) Test_VerifyRejectsInvalidSignatures(c *C) {
+	keys, _ := generateKeyPair(rand.Reader)
+	other, _ := generateKeyPair(rand.Reader)
+
+	message := []byte("our message")
+	sig := keys.sign(message)
+
+	c.Assert(keys.pub.verify([]byte("another message"), sig), Equals, false)
+	c.Assert(other.pub.verify(message, sig), Equals, false)
+	c.Assert(keys.pub.verify(message, sig[:signatureSize-1]), Equals, false)
+	c.Assert(keys.pub.verify(message, append(sig, 0x00)), Equals, false)
+
+	forged := append([]byte{}, sig...)
+	forged[signatureSize-2] ^= 0x01
+	c.Assert(keys.pub.verify(message, forged), Equals, false)
+}
@@ -0,0 +1,410 @@
+package otr4
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"math/big"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Our long-term key, forging key, profiles and prekey secrets are stored
+// encrypted with a key derived from a passphrase with Argon2id:
+//
+//	magic || version (SHORT) || time (INT) || memory (INT) || threads (BYTE) ||
+//	salt (DATA) || nonce || ciphertext (DATA) || MAC
+//
+// The MAC covers everything before it. Files written with an older version
+// are migrated when they are read.
+
+var keyFileMagic = []byte("OTR4KEYS")
+
+var keyStorageDomain = []byte("OTRv4-Key-Storage")
+
+const (
+	// version 1 only held the long-term key and the client profile
+	keyFileVersion1 = uint16(1)
+	// version 2 added the forging key, the instance tag, the prekey profile
+	// and the prekey secrets
+	keyFileVersion2 = uint16(2)
+
+	keyFileVersion = keyFileVersion2
+
+	keyFileSaltBytes = 16
+
+	usageKeyFileEncKey byte = 0x01
+	usageKeyFileMACKey byte = 0x02
+	usageKeyFileMAC    byte = 0x03
+)
+
+// argon2Params are the costs of deriving the key of a key file
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// defaultArgon2Params follow the recommendation of RFC 9106 for memory
+// constrained environments
+var defaultArgon2Params = argon2Params{time: 3, memory: 64 * 1024, threads: 4}
+
+// maxArgon2Params are the highest costs accepted when reading a key file, so
+// a crafted file cannot make us spend unbounded time or memory before its MAC
+// is checked. They allow the 2 GiB recommended first by RFC 9106.
+var maxArgon2Params = argon2Params{time: 16, memory: 2 * 1024 * 1024, threads: 16}
+
+// keyFileMigrations upgrade the payload of a key file from a version to the
+// next one
+var keyFileMigrations = map[uint16]func([]byte) ([]byte, error){
+	keyFileVersion1: migrateKeyFileV1,
+}
+
+func deriveKeyFileKeys(passphrase, salt []byte, params argon2Params) (encKey, macKey []byte) {
+	master := argon2.IDKey(passphrase, salt, params.time, params.memory, params.threads, hashBytes)
+
+	encKey = shake256(keyStorageDomain, usageKeyFileEncKey, symKeyBytes, master)
+	macKey = shake256(keyStorageDomain, usageKeyFileMACKey, macBytes, master)
+	return
+}
+
+func sealKeyFile(random []byte, version uint16, params argon2Params, passphrase, payload []byte) []byte {
+	salt, nonce := random[:keyFileSaltBytes], random[keyFileSaltBytes:]
+	encKey, macKey := deriveKeyFileKeys(passphrase, salt, params)
+
+	out := append([]byte{}, keyFileMagic...)
+	out = appendShort(out, version)
+	out = appendWord32(out, params.time)
+	out = appendWord32(out, params.memory)
+	out = append(out, params.threads)
+	out = appendData(out, salt)
+	out = append(out, nonce...)
+	out = appendData(out, encrypt(encKey, nonce, payload))
+
+	return append(out, shake256(keyStorageDomain, usageKeyFileMAC, macBytes, macKey, out)...)
+}
+
+// openKeyFile decrypts a key file, returning its payload in the current
+// version
+func openKeyFile(bs, passphrase []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bs, keyFileMagic) {
+		return nil, errMalformedMessage
+	}
+
+	var params argon2Params
+	var salt, ciphertext []byte
+	var version uint16
+	var ok1, ok2, ok3, ok4, ok5 bool
+
+	cursor := bs[len(keyFileMagic):]
+	cursor, version, ok1 = extractShort(cursor)
+	cursor, params.time, ok2 = extractWord32(cursor)
+	cursor, params.memory, ok3 = extractWord32(cursor)
+	if !(ok1 && ok2 && ok3) || len(cursor) < 1 {
+		return nil, errMalformedMessage
+	}
+
+	params.threads = cursor[0]
+	cursor, salt, ok4 = extractData(cursor[1:])
+	if !ok4 || len(cursor) < nonceBytes {
+		return nil, errMalformedMessage
+	}
+
+	nonce := cursor[:nonceBytes]
+	cursor, ciphertext, ok5 = extractData(cursor[nonceBytes:])
+	if !ok5 || len(cursor) != macBytes {
+		return nil, errMalformedMessage
+	}
+
+	if version == 0 || version > keyFileVersion {
+		return nil, errUnsupportedKeyFileVersion
+	}
+
+	if params.time == 0 || params.threads == 0 {
+		return nil, errMalformedMessage
+	}
+
+	if params.time > maxArgon2Params.time || params.memory > maxArgon2Params.memory || params.threads > maxArgon2Params.threads {
+		return nil, errKeyFileTooCostly
+	}
+
+	encKey, macKey := deriveKeyFileKeys(passphrase, salt, params)
+
+	mac := shake256(keyStorageDomain, usageKeyFileMAC, macBytes, macKey, bs[:len(bs)-macBytes])
+	if subtle.ConstantTimeCompare(mac, cursor) != 1 {
+		return nil, errInvalidPassphrase
+	}
+
+	payload := decrypt(encKey, nonce, ciphertext)
+	for ; version < keyFileVersion; version++ {
+		var err error
+		payload, err = keyFileMigrations[version](payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return payload, nil
+}
+
+// migrateKeyFileV1 adds the fields introduced by version 2, taking our
+// instance tag from the client profile
+func migrateKeyFileV1(payload []byte) ([]byte, error) {
+	cursor, sym, ok1 := extractData(payload)
+	cursor, profile, ok2 := extractData(cursor)
+	if !(ok1 && ok2) || len(cursor) != 0 {
+		return nil, errMalformedMessage
+	}
+
+	var instanceTag uint32
+	if len(profile) > 0 {
+		p := &clientProfile{}
+		_, err := p.deserialize(profile)
+		if err != nil {
+			return nil, err
+		}
+		instanceTag = p.instanceTag
+	}
+
+	out := appendData(nil, sym)
+	out = appendData(out, nil)
+	out = appendData(out, profile)
+	out = appendWord32(out, instanceTag)
+	out = appendData(out, nil)
+	out = appendData(out, nil)
+	out = appendWord32(out, 0)
+	return appendWord32(out, 0), nil
+}
+
+func keyPairSecret(k *keyPair) []byte {
+	if k == nil {
+		return nil
+	}
+	return k.priv.sym
+}
+
+// keyPairFromSecret recreates the key pair generated from a secret
+func keyPairFromSecret(sym []byte) (*keyPair, error) {
+	if len(sym) != privateKeySize {
+		return nil, errMalformedMessage
+	}
+	return generateKeyPair(bytes.NewReader(sym))
+}
+
+func dhKeyPairFromPrivate(priv *big.Int) *dhKeyPair {
+	return &dhKeyPair{
+		pub:  new(big.Int).Exp(g3, priv, p),
+		priv: priv,
+	}
+}
+
+func (c *Conversation) serializeKeys() []byte {
+	out := appendData(nil, c.ourKeys.priv.sym)
+	out = appendData(out, keyPairSecret(c.ourForgingKey))
+
+	var profile []byte
+	if c.ourProfile != nil {
+		profile = c.ourProfile.serialize()
+	}
+	out = appendData(out, profile)
+	out = appendWord32(out, c.ourInstanceTag)
+
+	var pp []byte
+	if c.ourPrekeyProfile != nil {
+		pp = c.ourPrekeyProfile.serialize()
+	}
+	out = appendData(out, pp)
+	out = appendData(out, keyPairSecret(c.sharedPrekey))
+
+	out = appendWord32(out, uint32(len(c.ourPrekeys)))
+	for id, secret := range c.ourPrekeys {
+		out = appendWord32(out, id)
+		out = appendData(out, secret.ecdh.priv.sym)
+		out = appendMPI(out, secret.dh.priv)
+	}
+
+	out = appendWord32(out, uint32(len(c.consumedPrekeys)))
+	for id := range c.consumedPrekeys {
+		out = appendWord32(out, id)
+	}
+
+	return out
+}
+
+// deserializeKeys replaces our keys, profiles and prekey secrets with the
+// ones in a key file payload. Nothing is changed if the payload is invalid.
+func (c *Conversation) deserializeKeys(bs []byte) error {
+	var sym, forging, profile, ppBytes, shared []byte
+	var instanceTag, n uint32
+	var ok1, ok2, ok3, ok4, ok5, ok6, ok7 bool
+
+	cursor, sym, ok1 := extractData(bs)
+	cursor, forging, ok2 = extractData(cursor)
+	cursor, profile, ok3 = extractData(cursor)
+	cursor, instanceTag, ok4 = extractWord32(cursor)
+	cursor, ppBytes, ok5 = extractData(cursor)
+	cursor, shared, ok6 = extractData(cursor)
+	cursor, n, ok7 = extractWord32(cursor)
+	if !(ok1 && ok2 && ok3 && ok4 && ok5 && ok6 && ok7) {
+		return errMalformedMessage
+	}
+
+	keys, err := keyPairFromSecret(sym)
+	if err != nil {
+		return err
+	}
+
+	// key files written before we had a forging key get a new one
+	var forgingKey, sharedPrekey *keyPair
+	if len(forging) > 0 {
+		forgingKey, err = keyPairFromSecret(forging)
+	} else {
+		forgingKey, err = generateKeyPair(c.rand())
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(shared) > 0 {
+		sharedPrekey, err = keyPairFromSecret(shared)
+		if err != nil {
+			return err
+		}
+	}
+
+	var p *clientProfile
+	if len(profile) > 0 {
+		p = &clientProfile{}
+		rest, err := p.deserialize(profile)
+		if err != nil {
+			return err
+		}
+
+		if len(rest) != 0 || !bytes.Equal(p.publicKey.h.Encode(), keys.pub.h.Encode()) {
+			return errMalformedMessage
+		}
+
+		// without the forging key it certifies, the profile is made again
+		// with the new one
+		if len(forging) == 0 {
+			p = nil
+		} else if !bytes.Equal(p.forgingKey.h.Encode(), forgingKey.pub.h.Encode()) {
+			return errMalformedMessage
+		}
+	}
+
+	var pp *prekeyProfile
+	if len(ppBytes) > 0 {
+		pp = &prekeyProfile{}
+		rest, err := pp.deserialize(ppBytes)
+		if err != nil {
+			return err
+		}
+
+		if len(rest) != 0 || sharedPrekey == nil {
+			return errMalformedMessage
+		}
+	}
+
+	prekeys := make(map[uint32]*prekeySecret, n)
+	for i := uint32(0); i < n; i++ {
+		var id uint32
+		var ecdh []byte
+		var dh *big.Int
+		var ok1, ok2, ok3 bool
+
+		cursor, id, ok1 = extractWord32(cursor)
+		cursor, ecdh, ok2 = extractData(cursor)
+		cursor, dh, ok3 = extractMPI(cursor)
+		if !(ok1 && ok2 && ok3) {
+			return errMalformedMessage
+		}
+
+		secret := &prekeySecret{dh: dhKeyPairFromPrivate(dh)}
+		secret.ecdh, err = keyPairFromSecret(ecdh)
+		if err != nil {
+			return err
+		}
+		prekeys[id] = secret
+	}
+
+	cursor, n, ok1 = extractWord32(cursor)
+	if !ok1 {
+		return errMalformedMessage
+	}
+
+	consumed := make(map[uint32]bool, n)
+	for i := uint32(0); i < n; i++ {
+		var id uint32
+		cursor, id, ok1 = extractWord32(cursor)
+		if !ok1 {
+			return errMalformedMessage
+		}
+		consumed[id] = true
+	}
+
+	if len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	c.ourKeys = keys
+	c.ourForgingKey = forgingKey
+	c.ourProfile = p
+	if isValidInstanceTag(instanceTag) {
+		c.ourInstanceTag = instanceTag
+	}
+	c.ourPrekeyProfile = pp
+	c.sharedPrekey = sharedPrekey
+	c.ourPrekeys = prekeys
+	c.consumedPrekeys = consumed
+
+	return nil
+}
+
+func (c *Conversation) exportKeys(passphrase []byte, params argon2Params) ([]byte, error) {
+	random := make([]byte, keyFileSaltBytes+nonceBytes)
+	_, err := io.ReadFull(c.rand(), random)
+	if err != nil {
+		return nil, notEnoughEntropy
+	}
+
+	return sealKeyFile(random, keyFileVersion, params, passphrase, c.serializeKeys()), nil
+}
+
+// ExportKeys returns our long-term key, forging key, profiles and prekey
+// secrets, encrypted with a key derived from passphrase.
+func (c *Conversation) ExportKeys(passphrase []byte) ([]byte, error) {
+	return c.exportKeys(passphrase, defaultArgon2Params)
+}
+
+// ImportKeys replaces our keys, profiles and prekey secrets with the ones
+// exported with ExportKeys. Data exported by older versions is migrated.
+func (c *Conversation) ImportKeys(data, passphrase []byte) error {
+	payload, err := openKeyFile(data, passphrase)
+	if err != nil {
+		return err
+	}
+
+	return c.deserializeKeys(payload)
+}
+
+// SaveKeys writes what ExportKeys returns to a file, replacing it atomically.
+func (c *Conversation) SaveKeys(path string, passphrase []byte) error {
+	data, err := c.ExportKeys(passphrase)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(path, data)
+}
+
+// LoadKeys imports the keys saved to a file with SaveKeys.
+func (c *Conversation) LoadKeys(path string, passphrase []byte) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return c.ImportKeys(data, passphrase)
+}
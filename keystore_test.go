@@ -0,0 +1,176 @@
+package otr4
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+var testArgon2Params = argon2Params{time: 1, memory: 64, threads: 1}
+
+func newTestConversationWithKeys(c *C) *Conversation {
+	conv := newTestConversation(c, 0x101)
+
+	_, err := conv.clientProfile()
+	c.Assert(err, IsNil)
+	_, err = conv.prekeyProfile()
+	c.Assert(err, IsNil)
+
+	ms, err := conv.generatePrekeyMessages(3)
+	c.Assert(err, IsNil)
+	conv.consumePrekey(ms[0].identifier)
+
+	return conv
+}
+
+func assertSameStoredKeys(c *C, conv, other *Conversation) {
+	c.Assert(other.ourKeys.priv.sym, DeepEquals, conv.ourKeys.priv.sym)
+	c.Assert(other.ourKeys.pub.h.Encode(), DeepEquals, conv.ourKeys.pub.h.Encode())
+	c.Assert(other.ourForgingKey.priv.sym, DeepEquals, conv.ourForgingKey.priv.sym)
+	c.Assert(other.ourProfile.serialize(), DeepEquals, conv.ourProfile.serialize())
+	c.Assert(other.ourInstanceTag, Equals, conv.ourInstanceTag)
+	c.Assert(other.ourPrekeyProfile.serialize(), DeepEquals, conv.ourPrekeyProfile.serialize())
+	c.Assert(other.sharedPrekey.priv.sym, DeepEquals, conv.sharedPrekey.priv.sym)
+	c.Assert(other.consumedPrekeys, DeepEquals, conv.consumedPrekeys)
+
+	c.Assert(other.ourPrekeys, HasLen, len(conv.ourPrekeys))
+	for id, secret := range conv.ourPrekeys {
+		c.Assert(other.ourPrekeys[id].ecdh.priv.sym, DeepEquals, secret.ecdh.priv.sym)
+		c.Assert(other.ourPrekeys[id].dh, DeepEquals, secret.dh)
+	}
+}
+
+func (s *OTR4Suite) Test_ExportAndImportKeys(c *C) {
+	conv := newTestConversationWithKeys(c)
+
+	data, err := conv.exportKeys([]byte("passphrase"), testArgon2Params)
+	c.Assert(err, IsNil)
+
+	other := newTestConversation(c, 0)
+	c.Assert(other.ImportKeys(data, []byte("passphrase")), IsNil)
+
+	assertSameStoredKeys(c, conv, other)
+}
+
+func (s *OTR4Suite) Test_ImportKeysWithAWrongPassphrase(c *C) {
+	conv := newTestConversationWithKeys(c)
+
+	data, err := conv.exportKeys([]byte("passphrase"), testArgon2Params)
+	c.Assert(err, IsNil)
+
+	other := newTestConversation(c, 0x102)
+	keys := other.ourKeys
+
+	c.Assert(other.ImportKeys(data, []byte("Passphrase")), Equals, errInvalidPassphrase)
+	c.Assert(other.ourKeys, Equals, keys)
+	c.Assert(other.ourInstanceTag, Equals, uint32(0x102))
+}
+
+func (s *OTR4Suite) Test_ImportTamperedKeys(c *C) {
+	conv := newTestConversationWithKeys(c)
+
+	data, err := conv.exportKeys([]byte("passphrase"), testArgon2Params)
+	c.Assert(err, IsNil)
+
+	for _, i := range []int{len(keyFileMagic) + 30, len(data) - macBytes - 1, len(data) - 1} {
+		tampered := append([]byte{}, data...)
+		tampered[i] ^= 0x01
+		c.Assert(newTestConversation(c, 0).ImportKeys(tampered, []byte("passphrase")), Equals, errInvalidPassphrase)
+	}
+
+	c.Assert(newTestConversation(c, 0).ImportKeys(data[:len(data)-1], []byte("passphrase")), Equals, errMalformedMessage)
+	c.Assert(newTestConversation(c, 0).ImportKeys(data[1:], []byte("passphrase")), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_ImportKeysFromAnUnsupportedVersion(c *C) {
+	conv := newTestConversationWithKeys(c)
+
+	random := make([]byte, keyFileSaltBytes+nonceBytes)
+	data := sealKeyFile(random, keyFileVersion+1, testArgon2Params, []byte("passphrase"), conv.serializeKeys())
+
+	c.Assert(newTestConversation(c, 0).ImportKeys(data, []byte("passphrase")), Equals, errUnsupportedKeyFileVersion)
+}
+
+func (s *OTR4Suite) Test_ImportKeysRejectsTooCostlyParameters(c *C) {
+	conv := newTestConversationWithKeys(c)
+
+	data, err := conv.exportKeys([]byte("passphrase"), testArgon2Params)
+	c.Assert(err, IsNil)
+
+	// time, memory and threads follow the magic and the version
+	offset := len(keyFileMagic) + 2
+	fields := []struct {
+		at   int
+		size int
+		max  uint32
+	}{
+		{offset, 4, maxArgon2Params.time},
+		{offset + 4, 4, maxArgon2Params.memory},
+		{offset + 8, 1, uint32(maxArgon2Params.threads)},
+	}
+
+	for _, f := range fields {
+		tampered := append([]byte{}, data...)
+		if f.size == 4 {
+			copy(tampered[f.at:], appendWord32(nil, f.max+1))
+		} else {
+			tampered[f.at] = byte(f.max + 1)
+		}
+
+		c.Assert(newTestConversation(c, 0).ImportKeys(tampered, []byte("passphrase")), Equals, errKeyFileTooCostly)
+	}
+}
+
+func (s *OTR4Suite) Test_ImportKeysMigratesVersion1(c *C) {
+	conv := newTestConversationWithKeys(c)
+
+	payload := appendData(nil, conv.ourKeys.priv.sym)
+	payload = appendData(payload, conv.ourProfile.serialize())
+
+	random := make([]byte, keyFileSaltBytes+nonceBytes)
+	data := sealKeyFile(random, keyFileVersion1, testArgon2Params, []byte("passphrase"), payload)
+
+	other := newTestConversation(c, 0)
+	c.Assert(other.ImportKeys(data, []byte("passphrase")), IsNil)
+
+	c.Assert(other.ourKeys.pub.h.Encode(), DeepEquals, conv.ourKeys.pub.h.Encode())
+	c.Assert(other.ourProfile, IsNil)
+	c.Assert(other.ourInstanceTag, Equals, uint32(0x101))
+	c.Assert(other.ourForgingKey, NotNil)
+	c.Assert(other.ourPrekeyProfile, IsNil)
+	c.Assert(other.ourPrekeys, HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_ImportKeysRejectsAProfileOfAnotherKey(c *C) {
+	conv := newTestConversationWithKeys(c)
+	conv.ourProfile = newTestConversationWithKeys(c).ourProfile
+
+	data, err := conv.exportKeys([]byte("passphrase"), testArgon2Params)
+	c.Assert(err, IsNil)
+
+	c.Assert(newTestConversation(c, 0).ImportKeys(data, []byte("passphrase")), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_SaveAndLoadKeys(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "keys")
+
+	conv := newTestConversationWithKeys(c)
+	c.Assert(conv.SaveKeys(path, []byte("passphrase")), IsNil)
+
+	info, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+
+	other := newTestConversation(c, 0)
+	c.Assert(other.LoadKeys(path, []byte("passphrase")), IsNil)
+	assertSameStoredKeys(c, conv, other)
+
+	c.Assert(other.LoadKeys(filepath.Join(dir, "missing"), []byte("passphrase")), NotNil)
+}
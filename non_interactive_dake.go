@@ -0,0 +1,338 @@
+package otr4
+
+import (
+	"crypto/subtle"
+	"io"
+	"math/big"
+
+	"github.com/otrv4/ed448"
+)
+
+// In the non-interactive DAKE, Bob publishes prekey ensembles in advance and
+// Alice uses one of them to send a Non-Interactive-Auth message. It carries
+// the first data message of the session, so Bob can reply right away.
+
+const macBytes = 64
+
+type prekeyMessage struct {
+	identifier  uint32
+	instanceTag uint32
+	y           ed448.Point
+	b           *big.Int
+}
+
+type prekeySecret struct {
+	ecdh *keyPair
+	dh   *dhKeyPair
+}
+
+type nonInteractiveAuthMessage struct {
+	header           messageHeader
+	profile          *clientProfile
+	x                ed448.Point
+	a                *big.Int
+	sigma            *authMessage
+	prekeyIdentifier uint32
+	authMAC          []byte
+	dataMessage      []byte
+}
+
+func (m *prekeyMessage) serialize() []byte {
+	out := appendShort(nil, otrVersion)
+	out = append(out, prekeyMsgType)
+	out = appendWord32(out, m.identifier)
+	out = appendWord32(out, m.instanceTag)
+	out = appendBytes(out, m.y)
+	return appendMPI(out, m.b)
+}
+
+func (m *prekeyMessage) deserialize(msg []byte) error {
+	var ok1, ok2, ok3, ok4, ok5 bool
+	var version uint16
+
+	cursor, version, ok1 := extractShort(msg)
+	if !ok1 || version != otrVersion || len(cursor) < 1 || cursor[0] != prekeyMsgType {
+		return errMalformedMessage
+	}
+
+	cursor, m.identifier, ok2 = extractWord32(cursor[1:])
+	cursor, m.instanceTag, ok3 = extractWord32(cursor)
+	cursor, m.y, ok4 = extractEncodedPoint(cursor)
+	cursor, m.b, ok5 = extractMPI(cursor)
+
+	if !(ok2 && ok3 && ok4 && ok5) || len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	return nil
+}
+
+func (m *nonInteractiveAuthMessage) serialize() []byte {
+	out := m.header.serialize()
+	out = append(out, m.profile.serialize()...)
+	out = appendBytes(out, m.x)
+	out = appendMPI(out, m.a)
+	out = append(out, m.sigma.serialize()...)
+	out = appendWord32(out, m.prekeyIdentifier)
+	out = append(out, m.authMAC...)
+	return appendData(out, m.dataMessage)
+}
+
+func (m *nonInteractiveAuthMessage) deserialize(msg []byte) error {
+	var ok1, ok3, ok4, ok5, ok6 bool
+
+	m.profile = &clientProfile{}
+	m.sigma = &authMessage{}
+
+	cursor, header, ok1 := extractHeader(msg)
+	cursor, err := m.profile.deserialize(cursor)
+	cursor, m.x, ok3 = extractEncodedPoint(cursor)
+	cursor, m.a, ok4 = extractMPI(cursor)
+	cursor, ok5 = m.sigma.deserialize(cursor)
+	cursor, m.prekeyIdentifier, ok6 = extractWord32(cursor)
+
+	if !(ok1 && err == nil && ok3 && ok4 && ok5 && ok6) || header.messageType != nonIntAuthMsgType {
+		return errMalformedMessage
+	}
+
+	if len(cursor) < macBytes {
+		return errMalformedMessage
+	}
+
+	m.header = header
+	m.authMAC = cursor[:macBytes]
+
+	var ok bool
+	cursor, m.dataMessage, ok = extractData(cursor[macBytes:])
+	if !ok || len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	return nil
+}
+
+// deriveNonInteractiveKeys mixes the ECDH with the shared prekey of the prekey
+// profile into the shared secret of a non-interactive DAKE, so only the owner
+// of the prekey profile can derive it. It returns the resulting shared secret
+// and the key that authenticates the Non-Interactive-Auth message.
+func deriveNonInteractiveKeys(sharedSecret []byte, kSharedPrekey ed448.Point) (secret, macKey []byte, err error) {
+	k := kSharedPrekey.Encode()
+	if isZero(k) {
+		err = errInvalidPublicKey
+		return
+	}
+
+	secret = kdf(usageTmpKey, sharedSecretBytes, k, sharedSecret)
+	macKey = kdf(usageAuthMACKey, macBytes, secret)
+	return
+}
+
+// authMAC authenticates the transcript of a Non-Interactive-Auth message
+// and the data message attached to it
+func authMAC(macKey, t, dataMessage []byte) []byte {
+	return hcmac(usageAuthMAC, macKey, t, appendData(nil, dataMessage))
+}
+
+func randIdentifier(rand io.Reader) (uint32, error) {
+	var b [4]byte
+
+	_, err := io.ReadFull(rand, b[:])
+	if err != nil {
+		return 0, notEnoughEntropy
+	}
+
+	_, id, _ := extractWord32(b[:])
+	return id, nil
+}
+
+func (c *Conversation) generatePrekeyMessage() (*prekeyMessage, error) {
+	secret, err := generatePrekeySecret(c.rand())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := c.newPrekeyIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ourPrekeys == nil {
+		c.ourPrekeys = make(map[uint32]*prekeySecret)
+	}
+	c.ourPrekeys[id] = secret
+
+	m := &prekeyMessage{
+		identifier:  id,
+		instanceTag: c.ourInstanceTag,
+		y:           secret.ecdh.pub.h,
+		b:           secret.dh.pub,
+	}
+
+	return m, nil
+}
+
+// sendNonInteractiveAuth consumes a prekey ensemble published by the peer and
+// returns a Non-Interactive-Auth message with the given plaintext attached,
+// as the first data message of the session. Without a plaintext, a data
+// message the peer ignores is attached, for the peer to get our ratchet keys.
+func (c *Conversation) sendNonInteractiveAuth(ensemble, plaintext []byte) ([]byte, error) {
+	e := &prekeyEnsemble{}
+	err := e.deserialize(ensemble)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	pm := e.prekeyMessage
+	err = c.checkTrust(e.clientProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := c.clientProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	c.theirInstanceTag = pm.instanceTag
+	c.theirProfile = e.clientProfile
+	c.theirKey = e.clientProfile.publicKey
+	c.theirECDH = pm.y
+	c.theirDH = pm.b
+
+	err = c.generateEphemeralKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	t := c.transcriptAsAlice(0x02)
+
+	sigma := &authMessage{}
+	err = sigma.auth(c.rand(), c.ourKeys.pub.h, c.theirProfile.forgingKey.h, c.theirECDH, c.ourKeys.priv.r, t)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.deriveSharedSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	kSharedPrekey := ed448.PointScalarMul(e.prekeyProfile.sharedPrekey.h, c.ourECDH.priv.r)
+	sharedSecret, macKey, err := deriveNonInteractiveKeys(c.sharedSecret, kSharedPrekey)
+	if err != nil {
+		return nil, err
+	}
+	c.sharedSecret = sharedSecret
+
+	err = c.initializeRatchet(true)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0)
+	if plaintext == nil {
+		flags = flagIgnoreUnreadable
+	}
+
+	dataMessage, err := c.createDataMessage(plaintext, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &nonInteractiveAuthMessage{
+		header:           c.header(nonIntAuthMsgType),
+		profile:          profile,
+		x:                c.ourECDH.pub.h,
+		a:                c.ourDH.pub,
+		sigma:            sigma,
+		prekeyIdentifier: pm.identifier,
+		dataMessage:      dataMessage,
+	}
+	m.authMAC = authMAC(macKey, t, m.dataMessage)
+
+	c.sessionEstablished()
+
+	return m.serialize(), nil
+}
+
+// receiveNonInteractiveAuthMessage establishes the session and returns the
+// plaintext of the data message attached, with the reply it needs, if any
+func (c *Conversation) receiveNonInteractiveAuthMessage(msg []byte) (plaintext, reply []byte, err error) {
+	m := &nonInteractiveAuthMessage{}
+	err = m.deserialize(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, ok := c.ourPrekeys[m.prekeyIdentifier]
+	if !ok || c.consumedPrekeys[m.prekeyIdentifier] || c.sharedPrekey == nil || c.ourProfile == nil {
+		return nil, nil, errUnexpectedMessage
+	}
+
+	err = validateSenderProfile(m.profile, m.header.senderInstanceTag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !isValidPublicKey(&publicKey{h: m.x}) || !isValidDHPublicKey(m.a) {
+		return nil, nil, errInvalidPublicKey
+	}
+
+	// nothing is stored before the message is authenticated, so that forged
+	// messages cannot replace the keys of the current session
+	t := authTranscript(0x02, c.ourProfile, m.profile,
+		secret.ecdh.pub.h, m.x, secret.dh.pub, m.a,
+		phi(c.ourInstanceTag, m.header.senderInstanceTag))
+	if !m.sigma.verify(m.profile.publicKey.h, c.ourProfile.forgingKey.h, secret.ecdh.pub.h, t) {
+		return nil, nil, errInvalidRingSignature
+	}
+
+	braceKey, sharedSecret, ssid, err := dakeSecrets(secret.ecdh, m.x, secret.dh, m.a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kSharedPrekey := ed448.PointScalarMul(m.x, c.sharedPrekey.priv.r)
+	sharedSecret, macKey, err := deriveNonInteractiveKeys(sharedSecret, kSharedPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare(m.authMAC, authMAC(macKey, t, m.dataMessage)) != 1 {
+		return nil, nil, errInvalidMAC
+	}
+
+	err = c.checkTrust(m.profile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.theirInstanceTag = m.header.senderInstanceTag
+	c.theirProfile = m.profile
+	c.theirKey = m.profile.publicKey
+	c.theirECDH = m.x
+	c.theirDH = m.a
+	c.ourECDH = secret.ecdh
+	c.ourDH = secret.dh
+	c.braceKey, c.sharedSecret, c.ssid = braceKey, sharedSecret, ssid
+
+	err = c.initializeRatchet(false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.dake = dakeWaitingDataMessage
+	c.consumePrekey(m.prekeyIdentifier)
+
+	plaintext, reply, err = c.processDataMessage(m.dataMessage)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.sessionEstablished()
+	return plaintext, reply, nil
+}
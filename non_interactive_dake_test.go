@@ -0,0 +1,223 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_NonInteractiveDAKE(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	prekey, err := bob.generatePrekeyEnsemble()
+	c.Assert(err, IsNil)
+
+	auth, err := alice.sendNonInteractiveAuth(prekey, []byte("hi bob"))
+	c.Assert(err, IsNil)
+
+	plain, toSend, err := bob.Receive(encodeMessage(auth))
+
+	c.Assert(err, IsNil)
+	c.Assert(toSend, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hi bob"))
+	c.Assert(bob.theirInstanceTag, Equals, uint32(0x101))
+	c.Assert(alice.theirInstanceTag, Equals, uint32(0x102))
+	c.Assert(alice.sharedSecret, DeepEquals, bob.sharedSecret)
+	c.Assert(alice.ssid, DeepEquals, bob.ssid)
+	c.Assert(bob.ourPrekeys, HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveAuthCarriesAFirstDataMessage(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+	auth, err := alice.sendNonInteractiveAuth(prekey, []byte("hi bob"))
+	c.Assert(err, IsNil)
+
+	m := &nonInteractiveAuthMessage{}
+	c.Assert(m.deserialize(auth), IsNil)
+
+	dm := &dataMessage{}
+	c.Assert(dm.deserialize(m.dataMessage), IsNil)
+	c.Assert(dm.ratchetID, Equals, uint32(0))
+	c.Assert(dm.messageID, Equals, uint32(0))
+	c.Assert(dm.header.receiverInstanceTag, Equals, uint32(0x102))
+
+	_, _, err = bob.Receive(encodeMessage(auth))
+	c.Assert(err, IsNil)
+
+	exchangeMessage(c, bob, alice, "hi alice")
+	exchangeMessage(c, alice, bob, "how are you?")
+}
+
+func (s *OTR4Suite) Test_NonInteractiveDAKEWithoutMessage(c *C) {
+
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+	auth, err := alice.sendNonInteractiveAuth(prekey, nil)
+	c.Assert(err, IsNil)
+
+	plain, toSend, err := bob.Receive(encodeMessage(auth))
+
+	c.Assert(err, IsNil)
+	c.Assert(plain, IsNil)
+	c.Assert(toSend, IsNil)
+	c.Assert(alice.sharedSecret, DeepEquals, bob.sharedSecret)
+	c.Assert(bob.State(), Equals, StateEncryptedMessages)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveAuthConsumesPrekey(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+	auth, _ := alice.sendNonInteractiveAuth(prekey, []byte("hi"))
+
+	_, _, err := bob.Receive(encodeMessage(auth))
+	c.Assert(err, IsNil)
+
+	_, _, err = bob.Receive(encodeMessage(auth))
+	c.Assert(err, Equals, errUnexpectedMessage)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveAuthRejectsInvalidMAC(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+	auth, _ := alice.sendNonInteractiveAuth(prekey, nil)
+
+	m := &nonInteractiveAuthMessage{}
+	c.Assert(m.deserialize(auth), IsNil)
+	m.authMAC[0] ^= 0x01
+
+	_, _, err := bob.Receive(encodeMessage(m.serialize()))
+
+	c.Assert(err, Equals, errInvalidMAC)
+	c.Assert(bob.ourPrekeys, HasLen, 1)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveAuthRejectsTamperedMessage(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+	auth, _ := alice.sendNonInteractiveAuth(prekey, []byte("hi bob"))
+
+	m := &nonInteractiveAuthMessage{}
+	c.Assert(m.deserialize(auth), IsNil)
+	m.dataMessage[len(m.dataMessage)-1] ^= 0x01
+
+	_, _, err := bob.Receive(encodeMessage(m.serialize()))
+	c.Assert(err, Equals, errInvalidMAC)
+
+	c.Assert(m.deserialize(auth), IsNil)
+	m.dataMessage = nil
+
+	_, _, err = bob.Receive(encodeMessage(m.serialize()))
+	c.Assert(err, Equals, errInvalidMAC)
+	c.Assert(bob.ourPrekeys, HasLen, 1)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveAuthRejectsTamperedSharedPrekey(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+	mallory := newTestConversation(c, 0x102)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+
+	// a shared prekey Bob does not own, in a profile he signed
+	e := &prekeyEnsemble{}
+	c.Assert(e.deserialize(prekey), IsNil)
+	_, err := mallory.prekeyProfile()
+	c.Assert(err, IsNil)
+	e.prekeyProfile.sharedPrekey = &mallory.sharedPrekey.pub
+	e.prekeyProfile.sign(bob.ourKeys)
+
+	auth, err := alice.sendNonInteractiveAuth(e.serialize(), []byte("hi bob"))
+	c.Assert(err, IsNil)
+
+	_, _, err = bob.Receive(encodeMessage(auth))
+	c.Assert(err, Equals, errInvalidMAC)
+	c.Assert(bob.ourPrekeys, HasLen, 1)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveAuthRejectsInvalidSignature(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+	mallory := newTestConversation(c, 0x101)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+	auth, _ := alice.sendNonInteractiveAuth(prekey, nil)
+
+	m := &nonInteractiveAuthMessage{}
+	c.Assert(m.deserialize(auth), IsNil)
+	m.profile, _ = mallory.clientProfile()
+
+	_, _, err := bob.Receive(encodeMessage(m.serialize()))
+
+	c.Assert(err, Equals, errInvalidRingSignature)
+}
+
+func (s *OTR4Suite) Test_ForgedNonInteractiveAuthKeepsTheSession(c *C) {
+	alice, bob := establishTestSession(c)
+	mallory := newTestConversation(c, 0x101)
+	theirKey, sharedSecret := bob.theirKey, bob.sharedSecret
+
+	prekey, err := bob.generatePrekeyEnsemble()
+	c.Assert(err, IsNil)
+	auth, err := mallory.sendNonInteractiveAuth(prekey, nil)
+	c.Assert(err, IsNil)
+
+	m := &nonInteractiveAuthMessage{}
+	c.Assert(m.deserialize(auth), IsNil)
+	m.profile, _ = alice.clientProfile()
+
+	_, _, err = bob.Receive(encodeMessage(m.serialize()))
+	c.Assert(err, Equals, errInvalidRingSignature)
+
+	c.Assert(m.deserialize(auth), IsNil)
+	m.authMAC[0] ^= 0x01
+
+	_, _, err = bob.Receive(encodeMessage(m.serialize()))
+	c.Assert(err, Equals, errInvalidMAC)
+
+	c.Assert(bob.theirKey, Equals, theirKey)
+	c.Assert(bob.sharedSecret, DeepEquals, sharedSecret)
+	exchangeMessage(c, alice, bob, "still here")
+	exchangeMessage(c, bob, alice, "me too")
+}
+
+func (s *OTR4Suite) Test_PrekeyMessageSerialization(c *C) {
+	bob := newTestConversation(c, 0x102)
+	pm, err := bob.generatePrekeyMessage()
+	c.Assert(err, IsNil)
+	prekey := pm.serialize()
+
+	m := &prekeyMessage{}
+	err = m.deserialize(prekey)
+
+	c.Assert(err, IsNil)
+	c.Assert(m.instanceTag, Equals, uint32(0x102))
+	c.Assert(bob.ourPrekeys[m.identifier], NotNil)
+	c.Assert(m.y.Equals(bob.ourPrekeys[m.identifier].ecdh.pub.h), Equals, true)
+	c.Assert(m.serialize(), DeepEquals, prekey)
+
+	c.Assert(m.deserialize(prekey[:len(prekey)-1]), Equals, errMalformedMessage)
+	c.Assert(m.deserialize(append(prekey, 0x00)), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveAuthMessageRejectsTruncated(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+	auth, _ := alice.sendNonInteractiveAuth(prekey, []byte("hi"))
+
+	m := &nonInteractiveAuthMessage{}
+
+	c.Assert(m.deserialize(auth[:len(auth)-1]), Equals, errMalformedMessage)
+	c.Assert(m.deserialize(auth[:len(auth)-10]), Equals, errMalformedMessage)
+}
@@ -0,0 +1,197 @@
+package otr4
+
+// Policy configures which versions of the protocol a conversation accepts
+// and how it offers and starts encrypted conversations.
+type Policy uint32
+
+const (
+	// AllowV3 accepts peers offering version 3 of the protocol, which is not
+	// implemented: starting such a conversation fails, so that it can be
+	// handed to an OTRv3 implementation. It is never advertised.
+	AllowV3 Policy = 1 << iota
+	// AllowV4 allows conversations with version 4 of the protocol.
+	AllowV4
+	// RequireEncryption refuses to send messages in plaintext: a query
+	// message is sent instead, to start an encrypted conversation.
+	RequireEncryption
+	// SendWhitespaceTag appends a whitespace tag to the plaintext messages
+	// sent, to offer an encrypted conversation, until the peer answers
+	// without one.
+	SendWhitespaceTag
+	// WhitespaceStartDAKE starts a DAKE when a whitespace tag is received.
+	WhitespaceStartDAKE
+	// ErrorStartDAKE answers error messages with a query message, to start a
+	// new encrypted conversation.
+	ErrorStartDAKE
+	// PreferNonInteractive starts conversations with a Non-Interactive-Auth
+	// message carrying the first message, when the peer has published prekey
+	// ensembles on the prekey server set with Conversation.UsePrekeyServer.
+	// Without one, conversations start as if it was not set.
+	PreferNonInteractive
+)
+
+// DefaultPolicy is used by conversations with no policy set.
+const DefaultPolicy = AllowV4 | WhitespaceStartDAKE | ErrorStartDAKE
+
+func (p Policy) has(flags Policy) bool {
+	return p&flags == flags
+}
+
+// versions returns the versions allowed, most preferred first
+func (p Policy) versions() string {
+	var v string
+	if p.has(AllowV4) {
+		v += "4"
+	}
+	if p.has(AllowV3) {
+		v += "3"
+	}
+	return v
+}
+
+// advertisedVersions returns the versions offered in query messages and
+// whitespace tags, which leave out version 3 since we cannot start it
+func (p Policy) advertisedVersions() string {
+	if p.has(AllowV4) {
+		return "4"
+	}
+	return ""
+}
+
+// Policies holds the policies set for accounts and for the peers of an
+// account. The policy of a peer takes precedence over the one of the account,
+// which takes precedence over Default. The zero value is ready to use.
+type Policies struct {
+	// Default is the policy of accounts without one. If zero, DefaultPolicy
+	// is used.
+	Default Policy
+
+	accounts map[string]Policy
+	peers    map[string]map[string]Policy
+}
+
+// SetAccountPolicy sets the policy of the conversations of an account. A zero
+// policy removes it.
+func (p *Policies) SetAccountPolicy(account string, policy Policy) {
+	if policy == 0 {
+		delete(p.accounts, account)
+		return
+	}
+
+	if p.accounts == nil {
+		p.accounts = make(map[string]Policy)
+	}
+	p.accounts[account] = policy
+}
+
+// SetPeerPolicy sets the policy of the conversations of an account with a
+// peer. A zero policy removes it.
+func (p *Policies) SetPeerPolicy(account, peer string, policy Policy) {
+	if policy == 0 {
+		delete(p.peers[account], peer)
+		return
+	}
+
+	if p.peers == nil {
+		p.peers = make(map[string]map[string]Policy)
+	}
+
+	peers, ok := p.peers[account]
+	if !ok {
+		peers = make(map[string]Policy)
+		p.peers[account] = peers
+	}
+	peers[peer] = policy
+}
+
+// Policy returns the policy of the conversations of an account with a peer
+func (p *Policies) Policy(account, peer string) Policy {
+	if policy, ok := p.peers[account][peer]; ok {
+		return policy
+	}
+
+	if policy, ok := p.accounts[account]; ok {
+		return policy
+	}
+
+	if p.Default != 0 {
+		return p.Default
+	}
+	return DefaultPolicy
+}
+
+func (c *Conversation) policy() Policy {
+	switch {
+	case c.Policy != 0:
+		return c.Policy
+	case c.Policies != nil:
+		return c.Policies.Policy(c.Account, c.Peer)
+	}
+	return DefaultPolicy
+}
+
+// sendPlaintext returns the messages to send for a message of the user when
+// there is no encrypted session, as the policy dictates
+func (c *Conversation) sendPlaintext(plaintext []byte) ([][]byte, error) {
+	policy := c.policy()
+
+	if policy.has(PreferNonInteractive) && c.prekeyServer != nil && c.Peer != "" {
+		toSend, err := c.startNonInteractive(plaintext)
+		if err != errNoPrekeyEnsembles {
+			return toSend, err
+		}
+	}
+
+	if policy.has(RequireEncryption) {
+		return [][]byte{c.QueryMessage()}, errEncryptionRequired
+	}
+
+	if policy.has(SendWhitespaceTag) && !c.whitespaceTagRejected {
+		return [][]byte{append(append([]byte{}, plaintext...), whitespaceTag(policy.advertisedVersions())...)}, nil
+	}
+
+	return [][]byte{plaintext}, nil
+}
+
+// startNonInteractive sends a Non-Interactive-Auth message carrying plaintext
+// to an instance of the peer with a prekey ensemble on the prekey server
+func (c *Conversation) startNonInteractive(plaintext []byte) ([][]byte, error) {
+	ensembles, err := retrievePrekeyEnsembles(c.prekeyServer, c.Peer, c.policy().advertisedVersions())
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.sendNonInteractiveAuth(c.chooseEnsemble(ensembles), plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.wireMessages(msg)
+}
+
+// chooseEnsemble picks the ensemble of the instance we last talked to, if the
+// prekey server returned one, or else the one of the instance with the lowest
+// instance tag, so that the choice does not depend on the order the server
+// returned them in
+func (c *Conversation) chooseEnsemble(ensembles [][]byte) []byte {
+	chosen := ensembles[0]
+	chosenTag := uint32(0)
+
+	for _, ensemble := range ensembles {
+		e := &prekeyEnsemble{}
+		if e.deserialize(ensemble) != nil {
+			continue
+		}
+
+		tag := e.prekeyMessage.instanceTag
+		if c.theirInstanceTag != 0 && tag == c.theirInstanceTag {
+			return ensemble
+		}
+
+		if chosenTag == 0 || tag < chosenTag {
+			chosen, chosenTag = ensemble, tag
+		}
+	}
+
+	return chosen
+}
@@ -0,0 +1,145 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_PoliciesPrecedence(c *C) {
+	p := &Policies{}
+	c.Assert(p.Policy("alice", "bob"), Equals, DefaultPolicy)
+
+	p.Default = AllowV3
+	c.Assert(p.Policy("alice", "bob"), Equals, AllowV3)
+
+	p.SetAccountPolicy("alice", AllowV4|RequireEncryption)
+	c.Assert(p.Policy("alice", "bob"), Equals, AllowV4|RequireEncryption)
+	c.Assert(p.Policy("carol", "bob"), Equals, AllowV3)
+
+	p.SetPeerPolicy("alice", "bob", AllowV4|SendWhitespaceTag)
+	c.Assert(p.Policy("alice", "bob"), Equals, AllowV4|SendWhitespaceTag)
+	c.Assert(p.Policy("alice", "dave"), Equals, AllowV4|RequireEncryption)
+
+	p.SetPeerPolicy("alice", "bob", 0)
+	c.Assert(p.Policy("alice", "bob"), Equals, AllowV4|RequireEncryption)
+
+	p.SetAccountPolicy("alice", 0)
+	c.Assert(p.Policy("alice", "bob"), Equals, AllowV3)
+}
+
+func (s *OTR4Suite) Test_ConversationPolicyFromPolicies(c *C) {
+	p := &Policies{}
+	p.SetPeerPolicy("alice", "bob", AllowV3|AllowV4)
+	conv := &Conversation{Policies: p, Account: "alice", Peer: "bob"}
+
+	c.Assert(conv.policy(), Equals, AllowV3|AllowV4)
+
+	conv.Policy = AllowV4
+	c.Assert(conv.policy(), Equals, AllowV4)
+}
+
+func (s *OTR4Suite) Test_RequireEncryptionRefusesPlaintext(c *C) {
+	alice := newTestConversation(c, 0x101)
+	alice.Policy = AllowV4 | RequireEncryption
+	events := watchState(alice)
+
+	toSend, err := alice.Send([]byte("hello"))
+	c.Assert(err, Equals, errEncryptionRequired)
+	c.Assert(toSend, DeepEquals, [][]byte{[]byte("?OTRv4?")})
+
+	plain, _, err := alice.Receive([]byte("not encrypted"))
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("not encrypted"))
+	c.Assert(events.warnings, DeepEquals, []Warning{WarnUnencryptedMessage})
+}
+
+func (s *OTR4Suite) Test_SendWhitespaceTagUntilRejected(c *C) {
+	alice := newTestConversation(c, 0x101)
+	alice.Policy = AllowV4 | SendWhitespaceTag
+
+	toSend, err := alice.Send([]byte("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(toSend, DeepEquals, [][]byte{append([]byte("hello"), whitespaceTag("4")...)})
+
+	_, _, err = alice.Receive([]byte("hi, no OTR here"))
+	c.Assert(err, IsNil)
+
+	toSend, err = alice.Send([]byte("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(toSend, DeepEquals, [][]byte{[]byte("hello")})
+}
+
+func (s *OTR4Suite) Test_WhitespaceTagDoesNotOfferVersion3(c *C) {
+	alice := newTestConversation(c, 0x101)
+	alice.Policy = AllowV3 | AllowV4 | SendWhitespaceTag
+
+	toSend, err := alice.Send([]byte("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(toSend, DeepEquals, [][]byte{append([]byte("hello"), whitespaceTag("4")...)})
+}
+
+func (s *OTR4Suite) Test_WhitespaceStartDAKEPolicy(c *C) {
+	alice := newTestConversation(c, 0x101)
+	alice.Policy = AllowV4 | SendWhitespaceTag
+	bob := newTestConversation(c, 0x102)
+	bob.Policy = AllowV4
+
+	tagged, err := alice.Send([]byte("hello"))
+	c.Assert(err, IsNil)
+
+	plain, toSend, err := bob.Receive(tagged[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hello"))
+	c.Assert(toSend, IsNil)
+	c.Assert(bob.dake, Equals, dakeIdle)
+
+	bob.Policy = AllowV4 | WhitespaceStartDAKE
+	plain, toSend, err = bob.Receive(tagged[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hello"))
+	c.Assert(toSend, HasLen, 1)
+	c.Assert(bob.dake, Equals, dakeWaitingAuthR)
+}
+
+func (s *OTR4Suite) Test_PreferNonInteractive(c *C) {
+	_, t := newTestPrekeyServer(c)
+	alice := newTestConversation(c, 0x101)
+	alice.Policy = AllowV4 | PreferNonInteractive | RequireEncryption
+	alice.Peer = "bob@example.org"
+	bob := newTestConversation(c, 0x102)
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 1), IsNil)
+
+	// without a prekey server, the policy has no effect
+	toSend, err := alice.Send([]byte("hello"))
+	c.Assert(err, Equals, errEncryptionRequired)
+	c.Assert(toSend, DeepEquals, [][]byte{[]byte("?OTRv4?")})
+
+	alice.PrekeyBatchSize = 1
+	c.Assert(alice.UsePrekeyServer(t, "alice@example.org"), IsNil)
+
+	toSend, err = alice.Send([]byte("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(alice.State(), Equals, StateEncryptedMessages)
+
+	plain, _, err := bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hello"))
+}
+
+func (s *OTR4Suite) Test_ChooseEnsemble(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bobPhone := newTestConversation(c, 0x103)
+	bobLaptop := newTestConversation(c, 0x102)
+
+	phone, err := bobPhone.generatePrekeyEnsemble()
+	c.Assert(err, IsNil)
+	laptop, err := bobLaptop.generatePrekeyEnsemble()
+	c.Assert(err, IsNil)
+
+	// the instance with the lowest tag, whatever the order
+	c.Assert(alice.chooseEnsemble([][]byte{phone, laptop}), DeepEquals, laptop)
+	c.Assert(alice.chooseEnsemble([][]byte{laptop, phone}), DeepEquals, laptop)
+
+	// the instance we last talked to
+	alice.theirInstanceTag = 0x103
+	c.Assert(alice.chooseEnsemble([][]byte{laptop, phone}), DeepEquals, phone)
+}
@@ -0,0 +1,274 @@
+package otr4
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/otrv4/ed448"
+)
+
+// A PrekeyTransport carries messages to a prekey server and returns its
+// replies. Use NewHTTPPrekeyTransport, NewUnixPrekeyTransport or
+// NewLocalPrekeyTransport to create one.
+//
+// A transport also knows the identity and the fingerprint of the prekey
+// server it leads to: a server that authenticates with other ones is
+// rejected.
+type PrekeyTransport interface {
+	roundTrip(msg []byte) ([]byte, error)
+	expectedServer() (identity string, fingerprint Fingerprint)
+}
+
+// prekeyServerID is the prekey server a transport expects
+type prekeyServerID struct {
+	identity    string
+	fingerprint Fingerprint
+}
+
+func (id prekeyServerID) expectedServer() (string, Fingerprint) {
+	return id.identity, id.fingerprint
+}
+
+// localPrekeyTransport talks to a prekey server in the same process
+type localPrekeyTransport struct {
+	prekeyServerID
+	server *PrekeyServer
+}
+
+// NewLocalPrekeyTransport returns a transport to a prekey server running in
+// the same process
+func NewLocalPrekeyTransport(server *PrekeyServer) PrekeyTransport {
+	return localPrekeyTransport{
+		prekeyServerID: prekeyServerID{server.Identity(), server.Fingerprint()},
+		server:         server,
+	}
+}
+
+func (t localPrekeyTransport) roundTrip(msg []byte) ([]byte, error) {
+	return t.server.handle(msg)
+}
+
+// httpPrekeyTransport talks to a prekey server served with ServeHTTP
+type httpPrekeyTransport struct {
+	prekeyServerID
+	url    string
+	client *http.Client
+}
+
+// NewHTTPPrekeyTransport returns a transport to the prekey server with the
+// given identity and fingerprint, served with ServeHTTP at url
+func NewHTTPPrekeyTransport(url, identity string, fingerprint Fingerprint) PrekeyTransport {
+	return &httpPrekeyTransport{
+		prekeyServerID: prekeyServerID{identity, fingerprint},
+		url:            url,
+		client:         http.DefaultClient,
+	}
+}
+
+// NewUnixPrekeyTransport returns a transport to the prekey server with the
+// given identity and fingerprint, served with ServeHTTP on the Unix socket at
+// path
+func NewUnixPrekeyTransport(path, identity string, fingerprint Fingerprint) PrekeyTransport {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+
+	return &httpPrekeyTransport{
+		prekeyServerID: prekeyServerID{identity, fingerprint},
+		url:            "http://prekey-server/",
+		client:         &http.Client{Transport: &http.Transport{DialContext: dial}},
+	}
+}
+
+func (t *httpPrekeyTransport) roundTrip(msg []byte) ([]byte, error) {
+	resp, err := t.client.Post(t.url, "application/octet-stream", bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errPrekeyServerFailure
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// prekeyServerRequest authenticates to the prekey server with a DAKE and sends
+// it the message built by request with the MAC key of the DAKE. It returns the
+// reply of the server, once authenticated.
+func (c *Conversation) prekeyServerRequest(t PrekeyTransport, account string, request func(macKey []byte) []byte) (*prekeyServerReply, error) {
+	profile, err := c.clientProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := generateKeyPair(c.rand())
+	if err != nil {
+		return nil, err
+	}
+
+	m1 := &prekeyDAKE1Message{
+		header:  prekeyServerHeader(prekeyDAKE1MsgType, c.ourInstanceTag, 0),
+		account: account,
+		profile: profile,
+		i:       ephemeral.pub.h,
+	}
+
+	msg, err := t.roundTrip(m1.serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	m2 := &prekeyDAKE2Message{}
+	err = m2.deserialize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if m2.header.receiverInstanceTag != c.ourInstanceTag {
+		return nil, errInstanceTagMismatch
+	}
+
+	if !isValidPublicKey(m2.serverKey, &publicKey{h: m2.s}) {
+		return nil, errInvalidPublicKey
+	}
+
+	identity, fingerprint := t.expectedServer()
+	if m2.serverIdentity != identity || !m2.serverKey.fingerprint().Equal(fingerprint) {
+		return nil, errUnknownPrekeyServer
+	}
+
+	t0 := prekeyServerTranscript(0x00, account, profile, m2.serverIdentity, m2.serverKey, ephemeral.pub.h, m2.s)
+	if !m2.sigma.verify(m2.serverKey.h, c.ourKeys.pub.h, ephemeral.pub.h, t0) {
+		return nil, errInvalidRingSignature
+	}
+
+	macKey := derivePrekeyServerMACKey(ed448.PointScalarMul(m2.s, ephemeral.priv.r))
+
+	t1 := prekeyServerTranscript(0x01, account, profile, m2.serverIdentity, m2.serverKey, ephemeral.pub.h, m2.s)
+
+	sigma := &authMessage{}
+	err = sigma.auth(c.rand(), c.ourKeys.pub.h, m2.serverKey.h, m2.s, c.ourKeys.priv.r, t1)
+	if err != nil {
+		return nil, err
+	}
+
+	m3 := &prekeyDAKE3Message{
+		header:  prekeyServerHeader(prekeyDAKE3MsgType, c.ourInstanceTag, 0),
+		s:       m2.s,
+		sigma:   sigma,
+		message: request(macKey),
+	}
+
+	msg, err = t.roundTrip(m3.serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &prekeyServerReply{}
+	err = reply.deserialize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare(reply.mac, reply.authenticate(macKey)) != 1 {
+		return nil, errInvalidMAC
+	}
+
+	return reply, nil
+}
+
+// publishPrekeys generates n prekey messages and publishes them to the prekey
+// server, together with our current profiles
+func (c *Conversation) publishPrekeys(t PrekeyTransport, account string, n int) error {
+	if n > maxStoredPrekeyMessages {
+		return errInvalidLength
+	}
+
+	pp, err := c.prekeyProfile()
+	if err != nil {
+		return err
+	}
+
+	ms, err := c.generatePrekeyMessages(n)
+	if err != nil {
+		return err
+	}
+
+	pub := &prekeyPublicationMessage{
+		prekeyMessages: ms,
+		prekeyProfile:  pp,
+	}
+
+	pub.sign(c.ourKeys)
+
+	reply, err := c.prekeyServerRequest(t, account, func(macKey []byte) []byte {
+		pub.mac = prekeyServerMAC(usagePublicationMAC, macKey, pub.serializeBody())
+		return pub.serialize()
+	})
+
+	if err == nil && reply.header.messageType != prekeySuccessMsgType {
+		err = errPrekeyServerFailure
+	}
+
+	if err != nil {
+		c.forgetPrekeys(ms)
+	}
+
+	return err
+}
+
+// prekeyStorageStatus asks the prekey server how many of our prekey messages
+// it still stores
+func (c *Conversation) prekeyStorageStatus(t PrekeyTransport, account string) (uint32, error) {
+	reply, err := c.prekeyServerRequest(t, account, func(macKey []byte) []byte {
+		m := &storageInformationRequest{
+			mac: prekeyServerMAC(usageStorageInfoMAC, macKey, []byte{storageInformationRequestMsgType}),
+		}
+		return m.serialize()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if reply.header.messageType != storageStatusMsgType {
+		return 0, errPrekeyServerFailure
+	}
+
+	return reply.stored, nil
+}
+
+// retrievePrekeyEnsembles asks the prekey server for an ensemble of every
+// instance of account supporting one of versions. The ensembles are returned
+// serialized, as sendNonInteractiveAuth expects them.
+func retrievePrekeyEnsembles(t PrekeyTransport, account, versions string) ([][]byte, error) {
+	q := &ensembleQueryMessage{
+		header:   prekeyServerHeader(ensembleQueryMsgType, 0, 0),
+		account:  account,
+		versions: versions,
+	}
+
+	msg, err := t.roundTrip(q.serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	none := &noPrekeyEnsemblesMessage{}
+	if none.deserialize(msg) == nil {
+		return nil, errNoPrekeyEnsembles
+	}
+
+	m := &ensembleRetrievalMessage{}
+	err = m.deserialize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.ensembles, nil
+}
@@ -0,0 +1,114 @@
+package otr4
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_PrekeyServerOverUnixSocket(c *C) {
+	dir, err := ioutil.TempDir("", "otr4")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "prekeys.sock")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	server, _ := newTestPrekeyServer(c)
+	go http.Serve(l, server)
+
+	t := NewUnixPrekeyTransport(path, server.Identity(), server.Fingerprint())
+	bob := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 2), IsNil)
+
+	stored, err := bob.prekeyStorageStatus(t, "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(stored, Equals, uint32(2))
+}
+
+func (s *OTR4Suite) Test_NonInteractiveDAKEThroughPrekeyServer(c *C) {
+	_, t := newTestPrekeyServer(c)
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 1), IsNil)
+
+	ensembles, err := retrievePrekeyEnsembles(t, "bob@example.org", "4")
+	c.Assert(err, IsNil)
+	c.Assert(ensembles, HasLen, 1)
+
+	msg, err := alice.sendNonInteractiveAuth(ensembles[0], []byte("hi bob"))
+	c.Assert(err, IsNil)
+
+	plaintext, _, err := bob.receiveNonInteractiveAuthMessage(msg)
+	c.Assert(err, IsNil)
+	c.Assert(plaintext, DeepEquals, []byte("hi bob"))
+}
+
+func (s *OTR4Suite) Test_PrekeyServerRequestRejectsForgedDAKE2(c *C) {
+	_, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	intercept := interceptedTransport{t, func(msg []byte) ([]byte, error) {
+		reply, err := t.roundTrip(msg)
+		if err != nil || reply[2] != prekeyDAKE2MsgType {
+			return reply, err
+		}
+
+		m := &prekeyDAKE2Message{}
+		c.Assert(m.deserialize(reply), IsNil)
+		m.sigma.c1, m.sigma.c2 = m.sigma.c2, m.sigma.c1
+		return m.serialize(), nil
+	}}
+
+	_, err := bob.prekeyStorageStatus(intercept, "bob@example.org")
+	c.Assert(err, Equals, errInvalidRingSignature)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerRequestRejectsAnotherServer(c *C) {
+	server, t := newTestPrekeyServer(c)
+	other, _ := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	// another server, answering with its own key
+	impostor := interceptedTransport{t, NewLocalPrekeyTransport(other).roundTrip}
+	_, err := bob.prekeyStorageStatus(impostor, "bob@example.org")
+	c.Assert(err, Equals, errUnknownPrekeyServer)
+
+	renamed, err := NewPrekeyServer("evil.example.org", nil)
+	c.Assert(err, IsNil)
+	renamed.keys = server.keys
+	impostor = interceptedTransport{t, NewLocalPrekeyTransport(renamed).roundTrip}
+	_, err = bob.prekeyStorageStatus(impostor, "bob@example.org")
+	c.Assert(err, Equals, errUnknownPrekeyServer)
+
+	_, err = bob.prekeyStorageStatus(t, "bob@example.org")
+	c.Assert(err, IsNil)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerRequestRejectsForgedReply(c *C) {
+	_, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	intercept := interceptedTransport{t, func(msg []byte) ([]byte, error) {
+		reply, err := t.roundTrip(msg)
+		if err != nil || reply[2] != storageStatusMsgType {
+			return reply, err
+		}
+
+		m := &prekeyServerReply{}
+		c.Assert(m.deserialize(reply), IsNil)
+		m.stored = 100
+		return m.serialize(), nil
+	}}
+
+	_, err := bob.prekeyStorageStatus(intercept, "bob@example.org")
+	c.Assert(err, Equals, errInvalidMAC)
+}
@@ -0,0 +1,92 @@
+package otr4
+
+// A prekey ensemble is what Alice needs to start a non-interactive DAKE with
+// Bob: his client profile, his prekey profile and one of his prekey messages.
+
+type prekeyEnsemble struct {
+	clientProfile *clientProfile
+	prekeyProfile *prekeyProfile
+	prekeyMessage *prekeyMessage
+}
+
+func (e *prekeyEnsemble) serialize() []byte {
+	out := e.clientProfile.serialize()
+	out = append(out, e.prekeyProfile.serialize()...)
+	return append(out, e.prekeyMessage.serialize()...)
+}
+
+func (e *prekeyEnsemble) deserialize(bs []byte) error {
+	e.clientProfile = &clientProfile{}
+	e.prekeyProfile = &prekeyProfile{}
+	e.prekeyMessage = &prekeyMessage{}
+
+	cursor, err := e.clientProfile.deserialize(bs)
+	if err != nil {
+		return err
+	}
+
+	cursor, err = e.prekeyProfile.deserialize(cursor)
+	if err != nil {
+		return err
+	}
+
+	return e.prekeyMessage.deserialize(cursor)
+}
+
+// validate checks the three parts of the ensemble together: both profiles
+// must be valid and signed by the same long-term key, all parts must belong to
+// the same client instance, the prekey message must use a version the client
+// supports, and every key must be valid.
+func (e *prekeyEnsemble) validate() error {
+	err := e.clientProfile.validate()
+	if err != nil {
+		return err
+	}
+
+	err = e.prekeyProfile.validate(e.clientProfile.publicKey)
+	if err != nil {
+		return err
+	}
+
+	tag := e.clientProfile.instanceTag
+	if e.prekeyProfile.instanceTag != tag || e.prekeyMessage.instanceTag != tag {
+		return errInstanceTagMismatch
+	}
+
+	if !e.clientProfile.supportsVersion(otrVersion) {
+		return errInvalidVersion
+	}
+
+	if !isValidPublicKey(&publicKey{h: e.prekeyMessage.y}) || !isValidDHPublicKey(e.prekeyMessage.b) {
+		return errInvalidPublicKey
+	}
+
+	return nil
+}
+
+// generatePrekeyEnsemble creates a new prekey message and returns it together
+// with our current profiles
+func (c *Conversation) generatePrekeyEnsemble() ([]byte, error) {
+	cp, err := c.clientProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	pp, err := c.prekeyProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := c.generatePrekeyMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &prekeyEnsemble{
+		clientProfile: cp,
+		prekeyProfile: pp,
+		prekeyMessage: m,
+	}
+
+	return e.serialize(), nil
+}
@@ -0,0 +1,99 @@
+package otr4
+
+import (
+	"crypto/rand"
+	"math/big"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func newTestPrekeyEnsemble(c *C) (*prekeyEnsemble, *Conversation) {
+	bob := newTestConversation(c, 0x102)
+
+	ser, err := bob.generatePrekeyEnsemble()
+	c.Assert(err, IsNil)
+
+	e := &prekeyEnsemble{}
+	c.Assert(e.deserialize(ser), IsNil)
+	c.Assert(e.serialize(), DeepEquals, ser)
+
+	return e, bob
+}
+
+func (s *OTR4Suite) Test_PrekeyEnsemble(c *C) {
+	e, bob := newTestPrekeyEnsemble(c)
+
+	c.Assert(e.validate(), IsNil)
+	c.Assert(e.clientProfile.publicKey.h.Equals(bob.ourKeys.pub.h), Equals, true)
+	c.Assert(e.prekeyProfile.sharedPrekey.h.Equals(bob.sharedPrekey.pub.h), Equals, true)
+	c.Assert(bob.ourPrekeys[e.prekeyMessage.identifier], NotNil)
+}
+
+func (s *OTR4Suite) Test_PrekeyEnsembleRejectsTruncatedInput(c *C) {
+	e, _ := newTestPrekeyEnsemble(c)
+	ser := e.serialize()
+
+	c.Assert((&prekeyEnsemble{}).deserialize(ser[:len(ser)-1]), Equals, errMalformedMessage)
+	c.Assert((&prekeyEnsemble{}).deserialize(append(ser, 0x00)), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_PrekeyEnsembleRejectsMismatchedInstanceTags(c *C) {
+	e, bob := newTestPrekeyEnsemble(c)
+	e.prekeyMessage.instanceTag = 0x103
+	c.Assert(e.validate(), Equals, errInstanceTagMismatch)
+
+	e, bob = newTestPrekeyEnsemble(c)
+	e.prekeyProfile.instanceTag = 0x103
+	e.prekeyProfile.sign(bob.ourKeys)
+	c.Assert(e.validate(), Equals, errInstanceTagMismatch)
+}
+
+func (s *OTR4Suite) Test_PrekeyEnsembleRejectsProfilesFromDifferentKeys(c *C) {
+	e, _ := newTestPrekeyEnsemble(c)
+	mallory, _ := generateKeyPair(rand.Reader)
+
+	e.prekeyProfile.sign(mallory)
+	c.Assert(e.validate(), Equals, errInvalidSignature)
+}
+
+func (s *OTR4Suite) Test_PrekeyEnsembleRejectsExpiredProfiles(c *C) {
+	e, bob := newTestPrekeyEnsemble(c)
+	e.clientProfile.expiration = time.Now().Add(-time.Second)
+	e.clientProfile.sign(bob.ourKeys)
+	c.Assert(e.validate(), Equals, errExpiredProfile)
+
+	e, bob = newTestPrekeyEnsemble(c)
+	e.prekeyProfile.expiration = time.Now().Add(-time.Second)
+	e.prekeyProfile.sign(bob.ourKeys)
+	c.Assert(e.validate(), Equals, errExpiredProfile)
+}
+
+func (s *OTR4Suite) Test_PrekeyEnsembleRequiresVersion4(c *C) {
+	e, bob := newTestPrekeyEnsemble(c)
+	c.Assert(e.clientProfile.supportsVersion(otrVersion), Equals, true)
+
+	e.clientProfile.versions = "3"
+	e.clientProfile.sign(bob.ourKeys)
+
+	c.Assert(e.clientProfile.supportsVersion(otrVersion), Equals, false)
+	c.Assert(e.validate(), Equals, errInvalidVersion)
+}
+
+func (s *OTR4Suite) Test_PrekeyEnsembleRejectsInvalidKeys(c *C) {
+	e, _ := newTestPrekeyEnsemble(c)
+	e.prekeyMessage.b = big.NewInt(1)
+
+	c.Assert(e.validate(), Equals, errInvalidPublicKey)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveAuthValidatesTheEnsemble(c *C) {
+	e, _ := newTestPrekeyEnsemble(c)
+	alice := newTestConversation(c, 0x101)
+
+	e.prekeyMessage.instanceTag = 0x103
+	_, err := alice.sendNonInteractiveAuth(e.serialize(), nil)
+
+	c.Assert(err, Equals, errInstanceTagMismatch)
+	c.Assert(alice.ratchet, IsNil)
+}
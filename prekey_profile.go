@@ -0,0 +1,106 @@
+package otr4
+
+import (
+	"time"
+)
+
+// A prekey profile publishes the shared prekey of a client, signed by its
+// long-term key, to be used in non-interactive DAKEs until it expires.
+
+const (
+	sharedPrekeyTypeValue = uint16(0x0011)
+
+	defaultPrekeyProfileExpiration = 7 * 24 * time.Hour
+)
+
+type prekeyProfile struct {
+	instanceTag  uint32
+	expiration   time.Time
+	sharedPrekey *publicKey
+
+	sig []byte
+}
+
+// newPrekeyProfile creates a prekey profile signed with keys
+func newPrekeyProfile(keys *keyPair, sharedPrekey *publicKey, instanceTag uint32, expiration time.Time) *prekeyProfile {
+	p := &prekeyProfile{
+		instanceTag:  instanceTag,
+		expiration:   time.Unix(expiration.Unix(), 0),
+		sharedPrekey: sharedPrekey,
+	}
+	p.sign(keys)
+
+	return p
+}
+
+func (p *prekeyProfile) serializeBody() []byte {
+	out := appendWord32(nil, p.instanceTag)
+	out = appendWord64(out, p.expiration.Unix())
+	return appendKey(out, sharedPrekeyTypeValue, p.sharedPrekey)
+}
+
+func (p *prekeyProfile) serialize() []byte {
+	return append(p.serializeBody(), p.sig...)
+}
+
+// deserialize reads a prekey profile from the start of bs, returning what
+// follows it
+func (p *prekeyProfile) deserialize(bs []byte) ([]byte, error) {
+	var ok1, ok2, ok3 bool
+	var expiration uint64
+
+	cursor, instanceTag, ok1 := extractWord32(bs)
+	cursor, expiration, ok2 = extractWord64(cursor)
+	cursor, sharedPrekey, ok3 := extractKey(cursor, sharedPrekeyTypeValue)
+
+	if !(ok1 && ok2 && ok3) || len(cursor) < signatureSize {
+		return bs, errMalformedMessage
+	}
+
+	p.instanceTag = instanceTag
+	p.expiration = time.Unix(int64(expiration), 0)
+	p.sharedPrekey = sharedPrekey
+	p.sig = cursor[:signatureSize]
+
+	return cursor[signatureSize:], nil
+}
+
+func (p *prekeyProfile) sign(keys *keyPair) {
+	p.sig = keys.sign(p.serializeBody())
+}
+
+// validate checks that the profile was signed by the given long-term key,
+// holds a valid shared prekey and has not expired
+func (p *prekeyProfile) validate(longTermKey *publicKey) error {
+	if !isValidPublicKey(p.sharedPrekey) {
+		return errInvalidPublicKey
+	}
+
+	if !longTermKey.verify(p.serializeBody(), p.sig) {
+		return errInvalidSignature
+	}
+
+	if !time.Now().Before(p.expiration) {
+		return errExpiredProfile
+	}
+
+	return nil
+}
+
+// prekeyProfile returns our current prekey profile, creating a new one if it
+// does not exist or has expired
+func (c *Conversation) prekeyProfile() (*prekeyProfile, error) {
+	if c.ourPrekeyProfile != nil && time.Now().Before(c.ourPrekeyProfile.expiration) {
+		return c.ourPrekeyProfile, nil
+	}
+
+	sharedPrekey, err := generateKeyPair(c.rand())
+	if err != nil {
+		return nil, err
+	}
+
+	c.sharedPrekey = sharedPrekey
+	c.ourPrekeyProfile = newPrekeyProfile(c.ourKeys, &sharedPrekey.pub, c.ourInstanceTag, time.Now().Add(defaultPrekeyProfileExpiration))
+
+	return c.ourPrekeyProfile, nil
+}
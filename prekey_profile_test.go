@@ -0,0 +1,69 @@
+package otr4
+
+import (
+	"crypto/rand"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_PrekeyProfileSerialization(c *C) {
+	keys, _ := generateKeyPair(rand.Reader)
+	shared, _ := generateKeyPair(rand.Reader)
+
+	profile := newPrekeyProfile(keys, &shared.pub, 0x102, time.Now().Add(time.Hour))
+	ser := profile.serialize()
+
+	c.Assert(ser[:4], DeepEquals, []byte{0x00, 0x00, 0x01, 0x02})
+	c.Assert(ser[12:14], DeepEquals, []byte{0x00, 0x11})
+
+	p := &prekeyProfile{}
+	rest, err := p.deserialize(append(ser, 0x01))
+
+	c.Assert(err, IsNil)
+	c.Assert(rest, DeepEquals, []byte{0x01})
+	c.Assert(p.instanceTag, Equals, uint32(0x102))
+	c.Assert(p.expiration, Equals, profile.expiration)
+	c.Assert(p.sharedPrekey.h.Equals(shared.pub.h), Equals, true)
+	c.Assert(p.serialize(), DeepEquals, ser)
+
+	for l := 0; l < len(ser); l++ {
+		_, err = p.deserialize(ser[:l])
+		c.Assert(err, Equals, errMalformedMessage)
+	}
+}
+
+func (s *OTR4Suite) Test_ValidatePrekeyProfile(c *C) {
+	keys, _ := generateKeyPair(rand.Reader)
+	other, _ := generateKeyPair(rand.Reader)
+	shared, _ := generateKeyPair(rand.Reader)
+
+	profile := newPrekeyProfile(keys, &shared.pub, 0x102, time.Now().Add(time.Hour))
+
+	c.Assert(profile.validate(&keys.pub), IsNil)
+	c.Assert(profile.validate(&other.pub), Equals, errInvalidSignature)
+
+	profile.instanceTag = 0x103
+	c.Assert(profile.validate(&keys.pub), Equals, errInvalidSignature)
+
+	profile.expiration = time.Now().Add(-time.Second)
+	profile.sign(keys)
+	c.Assert(profile.validate(&keys.pub), Equals, errExpiredProfile)
+}
+
+func (s *OTR4Suite) Test_ConversationReusesPrekeyProfile(c *C) {
+	bob := newTestConversation(c, 0x102)
+
+	p1, err := bob.prekeyProfile()
+	c.Assert(err, IsNil)
+	c.Assert(p1.validate(&bob.ourKeys.pub), IsNil)
+	c.Assert(p1.sharedPrekey.h.Equals(bob.sharedPrekey.pub.h), Equals, true)
+
+	p2, _ := bob.prekeyProfile()
+	c.Assert(p2, Equals, p1)
+
+	p1.expiration = time.Now().Add(-time.Second)
+	p3, _ := bob.prekeyProfile()
+	c.Assert(p3, Not(Equals), p1)
+	c.Assert(p3.validate(&bob.ourKeys.pub), IsNil)
+}
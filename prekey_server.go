@@ -0,0 +1,425 @@
+package otr4
+
+import (
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/otrv4/ed448"
+)
+
+const (
+	maxStoredPrekeyMessages = 255
+	maxPrekeyServerRequest  = 1 << 20
+
+	// limits on the DAKEs waiting for their DAKE-3, since anyone can start
+	// one with a client profile it has seen
+	maxPendingPrekeyServerDAKEs = 1024
+	prekeyServerDAKETimeout     = time.Minute
+)
+
+// PrekeyServer is an in-memory prekey server. It stores the client profiles,
+// prekey profiles and prekey messages published by clients, and hands out
+// prekey ensembles built from them, consuming one prekey message each time.
+//
+// Publication is authenticated with a DAKE between the client and the server,
+// and signed with the long-term key of the client profile. Once an instance
+// has published, only the owner of the same long-term key can publish for it
+// again. The account name a client publishes for is taken as is, though: the
+// server does not check that the client owns it.
+type PrekeyServer struct {
+	identity string
+	random   io.Reader
+	keys     *keyPair
+
+	lock sync.Mutex
+	// pending are the DAKEs waiting for their DAKE-3, by the encoding of the
+	// ephemeral key of the server
+	pending  map[string]*prekeyServerSession
+	accounts map[string]map[uint32]*prekeyStorage
+}
+
+// prekeyServerSession is a DAKE in progress with a client, waiting for its
+// DAKE-3
+type prekeyServerSession struct {
+	account string
+	profile *clientProfile
+	i       ed448.Point
+	s       *keyPair
+	started time.Time
+}
+
+// prekeyStorage holds what a client instance has published
+type prekeyStorage struct {
+	clientProfile  *clientProfile
+	prekeyProfile  *prekeyProfile
+	prekeyMessages []*prekeyMessage
+}
+
+// NewPrekeyServer creates a prekey server with a freshly generated long-term
+// key pair. If random is nil, crypto/rand will be used.
+func NewPrekeyServer(identity string, random io.Reader) (*PrekeyServer, error) {
+	s := &PrekeyServer{
+		identity: identity,
+		random:   random,
+		pending:  make(map[string]*prekeyServerSession),
+		accounts: make(map[string]map[uint32]*prekeyStorage),
+	}
+
+	keys, err := generateKeyPair(s.rand())
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+
+	return s, nil
+}
+
+// Identity returns the identity of the server, which clients must expect
+// together with its fingerprint.
+func (s *PrekeyServer) Identity() string {
+	return s.identity
+}
+
+// Fingerprint returns the fingerprint of the long-term key of the server, for
+// clients to authenticate it.
+func (s *PrekeyServer) Fingerprint() Fingerprint {
+	return s.keys.pub.fingerprint()
+}
+
+// ServeHTTP answers a message sent as the body of a POST request
+func (s *PrekeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	msg, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPrekeyServerRequest))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	reply, err := s.handle(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(reply)
+}
+
+// handle processes a message sent to the server and returns its reply
+func (s *PrekeyServer) handle(msg []byte) ([]byte, error) {
+	_, h, ok := extractHeader(msg)
+	if !ok {
+		return nil, errInvalidLength
+	}
+
+	if h.version != otrVersion {
+		return nil, errInvalidVersion
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch h.messageType {
+	case prekeyDAKE1MsgType:
+		return s.receiveDAKE1(msg)
+	case prekeyDAKE3MsgType:
+		return s.receiveDAKE3(msg)
+	case ensembleQueryMsgType:
+		return s.receiveEnsembleQuery(msg)
+	}
+
+	return nil, errUnknownMessageType
+}
+
+func (s *PrekeyServer) receiveDAKE1(msg []byte) ([]byte, error) {
+	m := &prekeyDAKE1Message{}
+	err := m.deserialize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.profile.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if m.header.senderInstanceTag != m.profile.instanceTag {
+		return nil, errInstanceTagMismatch
+	}
+
+	if !isValidPublicKey(&publicKey{h: m.i}) {
+		return nil, errInvalidPublicKey
+	}
+
+	ephemeral, err := generateKeyPair(s.rand())
+	if err != nil {
+		return nil, err
+	}
+
+	t := prekeyServerTranscript(0x00, m.account, m.profile, s.identity, &s.keys.pub, m.i, ephemeral.pub.h)
+
+	sigma := &authMessage{}
+	err = sigma.auth(s.rand(), s.keys.pub.h, m.profile.publicKey.h, m.i, s.keys.priv.r, t)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s.expirePending(now)
+	s.pending[string(ephemeral.pub.h.Encode())] = &prekeyServerSession{
+		account: m.account,
+		profile: m.profile,
+		i:       m.i,
+		s:       ephemeral,
+		started: now,
+	}
+
+	reply := &prekeyDAKE2Message{
+		header:         prekeyServerHeader(prekeyDAKE2MsgType, 0, m.profile.instanceTag),
+		serverIdentity: s.identity,
+		serverKey:      &s.keys.pub,
+		s:              ephemeral.pub.h,
+		sigma:          sigma,
+	}
+
+	return reply.serialize(), nil
+}
+
+func (s *PrekeyServer) receiveDAKE3(msg []byte) ([]byte, error) {
+	m := &prekeyDAKE3Message{}
+	err := m.deserialize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	key := string(m.s.Encode())
+	session, ok := s.pending[key]
+	if !ok || session.profile.instanceTag != m.header.senderInstanceTag {
+		return nil, errUnexpectedMessage
+	}
+	delete(s.pending, key)
+
+	if time.Since(session.started) > prekeyServerDAKETimeout {
+		return nil, errUnexpectedMessage
+	}
+
+	tag := session.profile.instanceTag
+
+	t := prekeyServerTranscript(0x01, session.account, session.profile, s.identity, &s.keys.pub, session.i, session.s.pub.h)
+	if !m.sigma.verify(session.profile.publicKey.h, s.keys.pub.h, session.s.pub.h, t) {
+		return nil, errInvalidRingSignature
+	}
+
+	ecdh := ed448.PointScalarMul(session.i, session.s.priv.r)
+	if isZero(ecdh.Encode()) {
+		return nil, errInvalidPublicKey
+	}
+	macKey := derivePrekeyServerMACKey(ecdh)
+
+	reply := &prekeyServerReply{
+		header: prekeyServerHeader(prekeySuccessMsgType, 0, tag),
+	}
+
+	if len(m.message) > 0 && m.message[0] == storageInformationRequestMsgType {
+		err = s.receiveStorageInformationRequest(session, macKey, m.message)
+		if err != nil {
+			return nil, err
+		}
+
+		reply.header.messageType = storageStatusMsgType
+		reply.stored = uint32(len(s.storage(session.account, tag).prekeyMessages))
+	} else if s.receivePublication(session, macKey, m.message) != nil {
+		reply.header.messageType = prekeyFailureMsgType
+	}
+
+	reply.mac = reply.authenticate(macKey)
+
+	return reply.serialize(), nil
+}
+
+// expirePending drops the DAKEs that were not finished in time, and then the
+// oldest ones until there is room for a new one
+func (s *PrekeyServer) expirePending(now time.Time) {
+	deadline := now.Add(-prekeyServerDAKETimeout)
+	for key, session := range s.pending {
+		if session.started.Before(deadline) {
+			delete(s.pending, key)
+		}
+	}
+
+	for len(s.pending) >= maxPendingPrekeyServerDAKEs {
+		var oldest string
+		var first *prekeyServerSession
+		for key, session := range s.pending {
+			if first == nil || session.started.Before(first.started) {
+				oldest, first = key, session
+			}
+		}
+		delete(s.pending, oldest)
+	}
+}
+
+func (s *PrekeyServer) receiveStorageInformationRequest(session *prekeyServerSession, macKey, msg []byte) error {
+	m := &storageInformationRequest{}
+	err := m.deserialize(msg)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(m.mac, prekeyServerMAC(usageStorageInfoMAC, macKey, []byte{storageInformationRequestMsgType})) != 1 {
+		return errInvalidMAC
+	}
+
+	return nil
+}
+
+// receivePublication stores the prekey messages and profiles published by a
+// client. Nothing is stored unless all of them are valid.
+func (s *PrekeyServer) receivePublication(session *prekeyServerSession, macKey, msg []byte) error {
+	m := &prekeyPublicationMessage{}
+	err := m.deserialize(msg)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(m.mac, prekeyServerMAC(usagePublicationMAC, macKey, m.serializeBody())) != 1 {
+		return errInvalidMAC
+	}
+
+	if !session.profile.publicKey.verify(m.serializeBody(), m.sig) {
+		return errInvalidSignature
+	}
+
+	tag := session.profile.instanceTag
+
+	if st, ok := s.accounts[session.account][tag]; ok && st.clientProfile != nil {
+		if !canReplaceClientProfile(st.clientProfile, session.profile) {
+			return errClientProfileMismatch
+		}
+	}
+
+	if m.prekeyProfile != nil {
+		err = m.prekeyProfile.validate(session.profile.publicKey)
+		if err != nil {
+			return err
+		}
+
+		if m.prekeyProfile.instanceTag != tag {
+			return errInstanceTagMismatch
+		}
+	}
+
+	for _, pm := range m.prekeyMessages {
+		if pm.instanceTag != tag {
+			return errInstanceTagMismatch
+		}
+
+		if !isValidPublicKey(&publicKey{h: pm.y}) || !isValidDHPublicKey(pm.b) {
+			return errInvalidPublicKey
+		}
+	}
+
+	st := s.storage(session.account, tag)
+	if len(st.prekeyMessages)+len(m.prekeyMessages) > maxStoredPrekeyMessages {
+		return errInvalidLength
+	}
+
+	st.clientProfile = session.profile
+	if m.prekeyProfile != nil {
+		st.prekeyProfile = m.prekeyProfile
+	}
+	st.prekeyMessages = append(st.prekeyMessages, m.prekeyMessages...)
+
+	return nil
+}
+
+// canReplaceClientProfile tells whether a published client profile can take
+// the place of the stored one: it must belong to the same long-term key, and
+// must not expire earlier, so an old profile cannot be published again
+func canReplaceClientProfile(stored, published *clientProfile) bool {
+	return stored.publicKey.h.Equals(published.publicKey.h) && !published.expiration.Before(stored.expiration)
+}
+
+// storage returns what has been published for an instance of an account,
+// creating an empty entry if there is none
+func (s *PrekeyServer) storage(account string, instanceTag uint32) *prekeyStorage {
+	instances, ok := s.accounts[account]
+	if !ok {
+		instances = make(map[uint32]*prekeyStorage)
+		s.accounts[account] = instances
+	}
+
+	st, ok := instances[instanceTag]
+	if !ok {
+		st = &prekeyStorage{}
+		instances[instanceTag] = st
+	}
+
+	return st
+}
+
+// receiveEnsembleQuery returns one ensemble for every instance of the account
+// that supports one of the requested versions and still has prekey messages.
+// The prekey messages handed out are deleted.
+func (s *PrekeyServer) receiveEnsembleQuery(msg []byte) ([]byte, error) {
+	m := &ensembleQueryMessage{}
+	err := m.deserialize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &ensembleRetrievalMessage{
+		header: prekeyServerHeader(ensembleRetrievalMsgType, 0, m.header.senderInstanceTag),
+	}
+
+	now := time.Now()
+	for _, st := range s.accounts[m.account] {
+		if st.clientProfile == nil || st.prekeyProfile == nil || len(st.prekeyMessages) == 0 {
+			continue
+		}
+
+		if !now.Before(st.clientProfile.expiration) || !now.Before(st.prekeyProfile.expiration) {
+			continue
+		}
+
+		if !supportsAnyVersion(st.clientProfile, m.versions) {
+			continue
+		}
+
+		e := &prekeyEnsemble{
+			clientProfile: st.clientProfile,
+			prekeyProfile: st.prekeyProfile,
+			prekeyMessage: st.prekeyMessages[0],
+		}
+		st.prekeyMessages = st.prekeyMessages[1:]
+
+		reply.ensembles = append(reply.ensembles, e.serialize())
+	}
+
+	if len(reply.ensembles) == 0 {
+		none := &noPrekeyEnsemblesMessage{
+			header:  prekeyServerHeader(noPrekeyEnsemblesMsgType, 0, m.header.senderInstanceTag),
+			message: "No prekey ensembles available for " + m.account,
+		}
+		return none.serialize(), nil
+	}
+
+	return reply.serialize(), nil
+}
+
+func supportsAnyVersion(p *clientProfile, versions string) bool {
+	for _, v := range parseToByte(versions) {
+		if p.supportsVersion(uint16(v)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,455 @@
+package otr4
+
+import "github.com/otrv4/ed448"
+
+// Clients authenticate to a prekey server with their own DAKE: the client
+// sends DAKE-1, the server answers with DAKE-2 and the client finishes it with
+// DAKE-3, which carries a prekey publication or a storage information request.
+// Ensembles are retrieved without authentication.
+
+const (
+	prekeyDAKE1MsgType               = 0x35
+	prekeyDAKE2MsgType               = 0x36
+	prekeyDAKE3MsgType               = 0x37
+	prekeyFailureMsgType             = 0x05
+	prekeySuccessMsgType             = 0x06
+	prekeyPublicationMsgType         = 0x08
+	storageInformationRequestMsgType = 0x09
+	storageStatusMsgType             = 0x0B
+	noPrekeyEnsemblesMsgType         = 0x0E
+	ensembleQueryMsgType             = 0x10
+	ensembleRetrievalMsgType         = 0x13
+)
+
+// The prekey server derives its values with the KDF of OTRv4 under its own
+// domain, with these usage IDs
+var prekeyServerDomain = []byte("OTR-Prekey-Server")
+
+const (
+	usagePrekeyServerClientProfile     byte = 0x02
+	usagePrekeyServerCompositeIdentity byte = 0x03
+	usagePrekeyServerPhi               byte = 0x04
+	usagePreMACKey                     byte = 0x08
+	usagePublicationMAC                byte = 0x09
+	usageStorageInfoMAC                byte = 0x0A
+	usageStatusMAC                     byte = 0x0B
+	usageSuccessMAC                    byte = 0x0C
+	usageFailureMAC                    byte = 0x0D
+)
+
+type prekeyDAKE1Message struct {
+	header  messageHeader
+	account string
+	profile *clientProfile
+	i       ed448.Point
+}
+
+type prekeyDAKE2Message struct {
+	header         messageHeader
+	serverIdentity string
+	serverKey      *publicKey
+	s              ed448.Point
+	sigma          *authMessage
+}
+
+// prekeyDAKE3Message names the DAKE it finishes by the ephemeral key the
+// server sent in its DAKE-2
+type prekeyDAKE3Message struct {
+	header  messageHeader
+	s       ed448.Point
+	sigma   *authMessage
+	message []byte
+}
+
+// prekeyPublicationMessage is signed with the long-term key of the client
+// profile it is published under, and authenticated with the MAC key of the
+// DAKE
+type prekeyPublicationMessage struct {
+	prekeyMessages []*prekeyMessage
+	prekeyProfile  *prekeyProfile
+	sig            []byte
+	mac            []byte
+}
+
+type storageInformationRequest struct {
+	mac []byte
+}
+
+// prekeyServerReply is the reply to a DAKE-3: a success, a failure or the
+// storage status, authenticated with the MAC key of the DAKE
+type prekeyServerReply struct {
+	header messageHeader
+	stored uint32
+	mac    []byte
+}
+
+type ensembleQueryMessage struct {
+	header   messageHeader
+	account  string
+	versions string
+}
+
+type ensembleRetrievalMessage struct {
+	header    messageHeader
+	ensembles [][]byte
+}
+
+type noPrekeyEnsemblesMessage struct {
+	header  messageHeader
+	message string
+}
+
+// prekeyServerHeader builds the header of a message exchanged with a prekey
+// server, which has no instance tag of its own
+func prekeyServerHeader(messageType byte, sender, receiver uint32) messageHeader {
+	return messageHeader{
+		version:             otrVersion,
+		messageType:         messageType,
+		senderInstanceTag:   sender,
+		receiverInstanceTag: receiver,
+	}
+}
+
+// extractPrekeyServerHeader reads the header of a message and checks that it
+// is of the expected type
+func extractPrekeyServerHeader(bs []byte, messageType byte) ([]byte, messageHeader, bool) {
+	cursor, h, ok := extractHeader(bs)
+	if !ok || h.version != otrVersion || h.messageType != messageType {
+		return bs, h, false
+	}
+
+	return cursor, h, true
+}
+
+func (m *prekeyDAKE1Message) serialize() []byte {
+	out := m.header.serialize()
+	out = appendData(out, []byte(m.account))
+	out = append(out, m.profile.serialize()...)
+	return appendBytes(out, m.i)
+}
+
+func (m *prekeyDAKE1Message) deserialize(msg []byte) error {
+	var ok1, ok2, ok3 bool
+	var account []byte
+
+	cursor, header, ok1 := extractPrekeyServerHeader(msg, prekeyDAKE1MsgType)
+	cursor, account, ok2 = extractData(cursor)
+	if !(ok1 && ok2) {
+		return errMalformedMessage
+	}
+
+	m.profile = &clientProfile{}
+	cursor, err := m.profile.deserialize(cursor)
+	if err != nil {
+		return err
+	}
+
+	cursor, m.i, ok3 = extractEncodedPoint(cursor)
+	if !ok3 || len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	m.header = header
+	m.account = string(account)
+
+	return nil
+}
+
+func (m *prekeyDAKE2Message) serialize() []byte {
+	out := m.header.serialize()
+	out = appendData(out, []byte(m.serverIdentity))
+	out = appendBytes(out, m.serverKey.h, m.s)
+	return append(out, m.sigma.serialize()...)
+}
+
+func (m *prekeyDAKE2Message) deserialize(msg []byte) error {
+	var ok1, ok2, ok3, ok4, ok5 bool
+	var identity []byte
+	var h ed448.Point
+
+	m.sigma = &authMessage{}
+
+	cursor, header, ok1 := extractPrekeyServerHeader(msg, prekeyDAKE2MsgType)
+	cursor, identity, ok2 = extractData(cursor)
+	cursor, h, ok3 = extractEncodedPoint(cursor)
+	cursor, m.s, ok4 = extractEncodedPoint(cursor)
+	cursor, ok5 = m.sigma.deserialize(cursor)
+
+	if !(ok1 && ok2 && ok3 && ok4 && ok5) || len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	m.header = header
+	m.serverIdentity = string(identity)
+	m.serverKey = &publicKey{h: h}
+
+	return nil
+}
+
+func (m *prekeyDAKE3Message) serialize() []byte {
+	out := m.header.serialize()
+	out = appendBytes(out, m.s)
+	out = append(out, m.sigma.serialize()...)
+	return appendData(out, m.message)
+}
+
+func (m *prekeyDAKE3Message) deserialize(msg []byte) error {
+	var ok1, ok2, ok3, ok4 bool
+
+	m.sigma = &authMessage{}
+
+	cursor, header, ok1 := extractPrekeyServerHeader(msg, prekeyDAKE3MsgType)
+	cursor, m.s, ok2 = extractEncodedPoint(cursor)
+	cursor, ok3 = m.sigma.deserialize(cursor)
+	cursor, m.message, ok4 = extractData(cursor)
+
+	if !(ok1 && ok2 && ok3 && ok4) || len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	m.header = header
+
+	return nil
+}
+
+func (m *prekeyPublicationMessage) serializeBody() []byte {
+	out := []byte{prekeyPublicationMsgType, byte(len(m.prekeyMessages))}
+	for _, pm := range m.prekeyMessages {
+		out = appendData(out, pm.serialize())
+	}
+
+	if m.prekeyProfile == nil {
+		return append(out, 0x00)
+	}
+
+	out = append(out, 0x01)
+	return append(out, m.prekeyProfile.serialize()...)
+}
+
+func (m *prekeyPublicationMessage) serialize() []byte {
+	out := append(m.serializeBody(), m.sig...)
+	return append(out, m.mac...)
+}
+
+func (m *prekeyPublicationMessage) sign(keys *keyPair) {
+	m.sig = keys.sign(m.serializeBody())
+}
+
+func (m *prekeyPublicationMessage) deserialize(msg []byte) error {
+	if len(msg) < 2 || msg[0] != prekeyPublicationMsgType {
+		return errMalformedMessage
+	}
+
+	n := int(msg[1])
+	cursor := msg[2:]
+
+	m.prekeyMessages = make([]*prekeyMessage, n)
+	for i := range m.prekeyMessages {
+		var ser []byte
+		var ok bool
+
+		cursor, ser, ok = extractData(cursor)
+		if !ok {
+			return errMalformedMessage
+		}
+
+		m.prekeyMessages[i] = &prekeyMessage{}
+		err := m.prekeyMessages[i].deserialize(ser)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(cursor) < 1 || cursor[0] > 1 {
+		return errMalformedMessage
+	}
+
+	m.prekeyProfile = nil
+	hasProfile := cursor[0] == 1
+	cursor = cursor[1:]
+
+	if hasProfile {
+		m.prekeyProfile = &prekeyProfile{}
+
+		var err error
+		cursor, err = m.prekeyProfile.deserialize(cursor)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(cursor) != signatureSize+macBytes {
+		return errMalformedMessage
+	}
+
+	m.sig = cursor[:signatureSize]
+	m.mac = cursor[signatureSize:]
+
+	return nil
+}
+
+func (m *storageInformationRequest) serialize() []byte {
+	return append([]byte{storageInformationRequestMsgType}, m.mac...)
+}
+
+func (m *storageInformationRequest) deserialize(msg []byte) error {
+	if len(msg) != 1+macBytes || msg[0] != storageInformationRequestMsgType {
+		return errMalformedMessage
+	}
+
+	m.mac = msg[1:]
+
+	return nil
+}
+
+func (m *prekeyServerReply) serializeBody() []byte {
+	out := m.header.serialize()
+	if m.header.messageType == storageStatusMsgType {
+		out = appendWord32(out, m.stored)
+	}
+	return out
+}
+
+// authenticate returns the MAC of the reply
+func (m *prekeyServerReply) authenticate(macKey []byte) []byte {
+	usageID := usageSuccessMAC
+	switch m.header.messageType {
+	case prekeyFailureMsgType:
+		usageID = usageFailureMAC
+	case storageStatusMsgType:
+		usageID = usageStatusMAC
+	}
+
+	return prekeyServerMAC(usageID, macKey, m.serializeBody())
+}
+
+func (m *prekeyServerReply) serialize() []byte {
+	return append(m.serializeBody(), m.mac...)
+}
+
+func (m *prekeyServerReply) deserialize(msg []byte) error {
+	cursor, header, ok := extractHeader(msg)
+	if !ok || header.version != otrVersion {
+		return errMalformedMessage
+	}
+
+	switch header.messageType {
+	case prekeySuccessMsgType, prekeyFailureMsgType:
+	case storageStatusMsgType:
+		cursor, m.stored, ok = extractWord32(cursor)
+		if !ok {
+			return errMalformedMessage
+		}
+	default:
+		return errMalformedMessage
+	}
+
+	if len(cursor) != macBytes {
+		return errMalformedMessage
+	}
+
+	m.header = header
+	m.mac = cursor
+
+	return nil
+}
+
+func (m *ensembleQueryMessage) serialize() []byte {
+	out := m.header.serialize()
+	out = appendData(out, []byte(m.account))
+	return appendData(out, parseToByte(m.versions))
+}
+
+func (m *ensembleQueryMessage) deserialize(msg []byte) error {
+	var ok1, ok2, ok3 bool
+	var account, versions []byte
+
+	cursor, header, ok1 := extractPrekeyServerHeader(msg, ensembleQueryMsgType)
+	cursor, account, ok2 = extractData(cursor)
+	cursor, versions, ok3 = extractData(cursor)
+
+	if !(ok1 && ok2 && ok3) || len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	m.header = header
+	m.account = string(account)
+	m.versions = bytesToString(versions)
+
+	return nil
+}
+
+func (m *ensembleRetrievalMessage) serialize() []byte {
+	out := m.header.serialize()
+	out = append(out, byte(len(m.ensembles)))
+	for _, e := range m.ensembles {
+		out = appendData(out, e)
+	}
+	return out
+}
+
+func (m *ensembleRetrievalMessage) deserialize(msg []byte) error {
+	cursor, header, ok := extractPrekeyServerHeader(msg, ensembleRetrievalMsgType)
+	if !ok || len(cursor) < 1 {
+		return errMalformedMessage
+	}
+
+	m.header = header
+	m.ensembles = make([][]byte, cursor[0])
+	cursor = cursor[1:]
+
+	for i := range m.ensembles {
+		cursor, m.ensembles[i], ok = extractData(cursor)
+		if !ok {
+			return errMalformedMessage
+		}
+	}
+
+	if len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	return nil
+}
+
+func (m *noPrekeyEnsemblesMessage) serialize() []byte {
+	return appendData(m.header.serialize(), []byte(m.message))
+}
+
+func (m *noPrekeyEnsemblesMessage) deserialize(msg []byte) error {
+	cursor, header, ok1 := extractPrekeyServerHeader(msg, noPrekeyEnsemblesMsgType)
+	cursor, message, ok2 := extractData(cursor)
+
+	if !(ok1 && ok2) || len(cursor) != 0 {
+		return errMalformedMessage
+	}
+
+	m.header = header
+	m.message = string(message)
+
+	return nil
+}
+
+// prekeyServerTranscript is what both sides sign in the DAKE with a prekey
+// server
+func prekeyServerTranscript(prefix byte, account string, profile *clientProfile, serverIdentity string, serverKey *publicKey, i, s ed448.Point) []byte {
+	t := []byte{prefix}
+	t = append(t, prekeyServerKDF(usagePrekeyServerClientProfile, hashBytes, profile.serialize())...)
+	t = append(t, prekeyServerKDF(usagePrekeyServerCompositeIdentity, hashBytes, []byte(serverIdentity), serverKey.h.Encode())...)
+	t = appendBytes(t, i, s)
+	return append(t, prekeyServerKDF(usagePrekeyServerPhi, hashBytes, []byte(account))...)
+}
+
+func prekeyServerKDF(usageID byte, size int, values ...[]byte) []byte {
+	return shake256(prekeyServerDomain, usageID, size, values...)
+}
+
+func prekeyServerMAC(usageID byte, macKey, body []byte) []byte {
+	return prekeyServerKDF(usageID, macBytes, macKey, body)
+}
+
+// derivePrekeyServerMACKey derives the key that authenticates the messages
+// sent after the DAKE with a prekey server
+func derivePrekeyServerMACKey(ecdh ed448.Point) []byte {
+	return prekeyServerKDF(usagePreMACKey, macBytes, ecdh.Encode())
+}
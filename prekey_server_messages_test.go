@@ -0,0 +1,134 @@
+package otr4
+
+import (
+	"crypto/rand"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_PrekeyDAKEMessagesSerialization(c *C) {
+	bob := newTestConversation(c, 0x102)
+	profile, err := bob.clientProfile()
+	c.Assert(err, IsNil)
+	server, _ := generateKeyPair(rand.Reader)
+	ephemeral, _ := generateKeyPair(rand.Reader)
+
+	m1 := &prekeyDAKE1Message{
+		header:  prekeyServerHeader(prekeyDAKE1MsgType, 0x102, 0),
+		account: "bob@example.org",
+		profile: profile,
+		i:       ephemeral.pub.h,
+	}
+
+	d1 := &prekeyDAKE1Message{}
+	c.Assert(d1.deserialize(m1.serialize()), IsNil)
+	c.Assert(d1.serialize(), DeepEquals, m1.serialize())
+	c.Assert(d1.account, Equals, "bob@example.org")
+
+	sigma := &authMessage{}
+	c.Assert(sigma.auth(rand.Reader, server.pub.h, profile.publicKey.h, ephemeral.pub.h, server.priv.r, []byte("t")), IsNil)
+
+	m2 := &prekeyDAKE2Message{
+		header:         prekeyServerHeader(prekeyDAKE2MsgType, 0, 0x102),
+		serverIdentity: "prekeys.example.org",
+		serverKey:      &server.pub,
+		s:              ephemeral.pub.h,
+		sigma:          sigma,
+	}
+
+	d2 := &prekeyDAKE2Message{}
+	c.Assert(d2.deserialize(m2.serialize()), IsNil)
+	c.Assert(d2.serialize(), DeepEquals, m2.serialize())
+
+	m3 := &prekeyDAKE3Message{
+		header:  prekeyServerHeader(prekeyDAKE3MsgType, 0x102, 0),
+		s:       ephemeral.pub.h,
+		sigma:   sigma,
+		message: []byte{0x01, 0x02},
+	}
+
+	d3 := &prekeyDAKE3Message{}
+	c.Assert(d3.deserialize(m3.serialize()), IsNil)
+	c.Assert(d3.serialize(), DeepEquals, m3.serialize())
+
+	c.Assert(d3.deserialize(m2.serialize()), Equals, errMalformedMessage)
+	c.Assert(d1.deserialize(append(m1.serialize(), 0x00)), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_PrekeyPublicationMessageSerialization(c *C) {
+	bob := newTestConversation(c, 0x102)
+	pp, err := bob.prekeyProfile()
+	c.Assert(err, IsNil)
+	pm, err := bob.generatePrekeyMessage()
+	c.Assert(err, IsNil)
+
+	m := &prekeyPublicationMessage{
+		prekeyMessages: []*prekeyMessage{pm, pm},
+		prekeyProfile:  pp,
+		mac:            make([]byte, macBytes),
+	}
+	m.sign(bob.ourKeys)
+
+	d := &prekeyPublicationMessage{}
+	c.Assert(d.deserialize(m.serialize()), IsNil)
+	c.Assert(d.serialize(), DeepEquals, m.serialize())
+	c.Assert(d.prekeyMessages, HasLen, 2)
+
+	m.prekeyProfile = nil
+	c.Assert(d.deserialize(m.serialize()), IsNil)
+	c.Assert(d.prekeyProfile, IsNil)
+
+	ser := m.serialize()
+	c.Assert(d.deserialize(ser[:len(ser)-1]), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerReplySerialization(c *C) {
+	m := &prekeyServerReply{
+		header: prekeyServerHeader(storageStatusMsgType, 0, 0x102),
+		stored: 42,
+		mac:    make([]byte, macBytes),
+	}
+
+	d := &prekeyServerReply{}
+	c.Assert(d.deserialize(m.serialize()), IsNil)
+	c.Assert(d.stored, Equals, uint32(42))
+
+	m.header.messageType = prekeySuccessMsgType
+	c.Assert(d.deserialize(m.serialize()), IsNil)
+	c.Assert(d.serialize(), DeepEquals, m.serialize())
+
+	m.header.messageType = dataMsgType
+	c.Assert(d.deserialize(m.serialize()), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_EnsembleQueryAndRetrievalSerialization(c *C) {
+	q := &ensembleQueryMessage{
+		header:   prekeyServerHeader(ensembleQueryMsgType, 0, 0),
+		account:  "bob@example.org",
+		versions: "4",
+	}
+
+	dq := &ensembleQueryMessage{}
+	c.Assert(dq.deserialize(q.serialize()), IsNil)
+	c.Assert(dq.account, Equals, "bob@example.org")
+	c.Assert(dq.versions, Equals, "4")
+
+	r := &ensembleRetrievalMessage{
+		header:    prekeyServerHeader(ensembleRetrievalMsgType, 0, 0),
+		ensembles: [][]byte{{0x01}, {0x02, 0x03}},
+	}
+
+	dr := &ensembleRetrievalMessage{}
+	c.Assert(dr.deserialize(r.serialize()), IsNil)
+	c.Assert(dr.ensembles, DeepEquals, r.ensembles)
+
+	n := &noPrekeyEnsemblesMessage{
+		header:  prekeyServerHeader(noPrekeyEnsemblesMsgType, 0, 0),
+		message: "none",
+	}
+
+	dn := &noPrekeyEnsemblesMessage{}
+	c.Assert(dn.deserialize(n.serialize()), IsNil)
+	c.Assert(dn.message, Equals, "none")
+	c.Assert(dr.deserialize(n.serialize()), Equals, errMalformedMessage)
+}
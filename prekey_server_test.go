@@ -0,0 +1,307 @@
+package otr4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// interceptedTransport passes the messages for the prekey server of a
+// transport through intercept
+type interceptedTransport struct {
+	PrekeyTransport
+	intercept func(msg []byte) ([]byte, error)
+}
+
+func (t interceptedTransport) roundTrip(msg []byte) ([]byte, error) {
+	return t.intercept(msg)
+}
+
+func newTestPrekeyServer(c *C) (*PrekeyServer, PrekeyTransport) {
+	server, err := NewPrekeyServer("prekeys.example.org", nil)
+	c.Assert(err, IsNil)
+
+	return server, NewLocalPrekeyTransport(server)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerStoresAndHandsOutEnsembles(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 3), IsNil)
+
+	st := server.accounts["bob@example.org"][0x102]
+	c.Assert(st.prekeyMessages, HasLen, 3)
+	c.Assert(st.clientProfile, NotNil)
+	c.Assert(st.prekeyProfile, NotNil)
+
+	ensembles, err := retrievePrekeyEnsembles(t, "bob@example.org", "4")
+	c.Assert(err, IsNil)
+	c.Assert(ensembles, HasLen, 1)
+
+	e := &prekeyEnsemble{}
+	c.Assert(e.deserialize(ensembles[0]), IsNil)
+	c.Assert(e.validate(), IsNil)
+	c.Assert(bob.ourPrekeys[e.prekeyMessage.identifier], NotNil)
+
+	c.Assert(st.prekeyMessages, HasLen, 2)
+	for _, pm := range st.prekeyMessages {
+		c.Assert(pm.identifier, Not(Equals), e.prekeyMessage.identifier)
+	}
+}
+
+func (s *OTR4Suite) Test_PrekeyServerReturnsAnEnsemblePerInstance(c *C) {
+	_, t := newTestPrekeyServer(c)
+	phone := newTestConversation(c, 0x102)
+	laptop := newTestConversation(c, 0x103)
+
+	c.Assert(phone.publishPrekeys(t, "bob@example.org", 1), IsNil)
+	c.Assert(laptop.publishPrekeys(t, "bob@example.org", 1), IsNil)
+
+	ensembles, err := retrievePrekeyEnsembles(t, "bob@example.org", "4")
+	c.Assert(err, IsNil)
+	c.Assert(ensembles, HasLen, 2)
+
+	_, err = retrievePrekeyEnsembles(t, "bob@example.org", "4")
+	c.Assert(err, Equals, errNoPrekeyEnsembles)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerReportsExhaustion(c *C) {
+	_, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 2), IsNil)
+
+	stored, err := bob.prekeyStorageStatus(t, "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(stored, Equals, uint32(2))
+
+	for i := 0; i < 2; i++ {
+		_, err = retrievePrekeyEnsembles(t, "bob@example.org", "4")
+		c.Assert(err, IsNil)
+	}
+
+	stored, err = bob.prekeyStorageStatus(t, "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(stored, Equals, uint32(0))
+
+	_, err = retrievePrekeyEnsembles(t, "bob@example.org", "4")
+	c.Assert(err, Equals, errNoPrekeyEnsembles)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerSkipsUnsupportedVersionsAndExpiredProfiles(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 1), IsNil)
+
+	_, err := retrievePrekeyEnsembles(t, "bob@example.org", "3")
+	c.Assert(err, Equals, errNoPrekeyEnsembles)
+
+	server.accounts["bob@example.org"][0x102].prekeyProfile.expiration = time.Now().Add(-time.Hour)
+	_, err = retrievePrekeyEnsembles(t, "bob@example.org", "4")
+	c.Assert(err, Equals, errNoPrekeyEnsembles)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerRejectsForgedDAKE3(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+	mallory := newTestConversation(c, 0x102)
+
+	intercept := interceptedTransport{t, func(msg []byte) ([]byte, error) {
+		if msg[2] == prekeyDAKE3MsgType {
+			m := &prekeyDAKE3Message{}
+			c.Assert(m.deserialize(msg), IsNil)
+			m.sigma.r1 = mallory.ourKeys.priv.r
+			msg = m.serialize()
+		}
+		return t.roundTrip(msg)
+	}}
+
+	c.Assert(bob.publishPrekeys(intercept, "bob@example.org", 1), Equals, errInvalidRingSignature)
+	c.Assert(server.accounts["bob@example.org"], IsNil)
+	c.Assert(bob.ourPrekeys, HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerKeepsConcurrentDAKEs(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	// someone replays the DAKE-1 of bob before bob finishes the DAKE
+	intercept := interceptedTransport{t, func(msg []byte) ([]byte, error) {
+		reply, err := t.roundTrip(msg)
+		if msg[2] == prekeyDAKE1MsgType {
+			_, replayErr := t.roundTrip(msg)
+			c.Assert(replayErr, IsNil)
+		}
+		return reply, err
+	}}
+
+	c.Assert(bob.publishPrekeys(intercept, "bob@example.org", 1), IsNil)
+	c.Assert(server.accounts["bob@example.org"][0x102].prekeyMessages, HasLen, 1)
+	c.Assert(server.pending, HasLen, 1)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerExpiresPendingDAKEs(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	intercept := interceptedTransport{t, func(msg []byte) ([]byte, error) {
+		if msg[2] == prekeyDAKE3MsgType {
+			for _, session := range server.pending {
+				session.started = session.started.Add(-prekeyServerDAKETimeout - time.Second)
+			}
+		}
+		return t.roundTrip(msg)
+	}}
+
+	c.Assert(bob.publishPrekeys(intercept, "bob@example.org", 1), Equals, errUnexpectedMessage)
+	c.Assert(server.accounts["bob@example.org"], IsNil)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerLimitsPendingDAKEs(c *C) {
+	server, _ := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	profile, err := bob.clientProfile()
+	c.Assert(err, IsNil)
+	m := &prekeyDAKE1Message{
+		header:  prekeyServerHeader(prekeyDAKE1MsgType, 0x102, 0),
+		account: "bob@example.org",
+		profile: profile,
+		i:       bob.ourKeys.pub.h,
+	}
+
+	now := time.Now()
+	for i := 0; i < maxPendingPrekeyServerDAKEs; i++ {
+		server.pending[string(rune(i))] = &prekeyServerSession{started: now.Add(time.Duration(i) * time.Millisecond)}
+	}
+
+	_, err = server.handle(m.serialize())
+	c.Assert(err, IsNil)
+	c.Assert(server.pending, HasLen, maxPendingPrekeyServerDAKEs)
+	c.Assert(server.pending[string(rune(0))], IsNil)
+	c.Assert(server.pending[string(rune(1))], NotNil)
+
+	// the DAKEs not finished in time are dropped when a new one starts
+	for _, session := range server.pending {
+		session.started = session.started.Add(-prekeyServerDAKETimeout - time.Second)
+	}
+	_, err = server.handle(m.serialize())
+	c.Assert(err, IsNil)
+	c.Assert(server.pending, HasLen, 1)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerRejectsPublicationsNotSignedByTheProfileKey(c *C) {
+	server, _ := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+	mallory := newTestConversation(c, 0x102)
+
+	profile, err := bob.clientProfile()
+	c.Assert(err, IsNil)
+	pp, err := bob.prekeyProfile()
+	c.Assert(err, IsNil)
+	ms, err := bob.generatePrekeyMessages(1)
+	c.Assert(err, IsNil)
+
+	session := &prekeyServerSession{account: "bob@example.org", profile: profile}
+	macKey := make([]byte, macBytes)
+
+	pub := &prekeyPublicationMessage{prekeyMessages: ms, prekeyProfile: pp}
+	pub.sign(mallory.ourKeys)
+	pub.mac = prekeyServerMAC(usagePublicationMAC, macKey, pub.serializeBody())
+
+	c.Assert(server.receivePublication(session, macKey, pub.serialize()), Equals, errInvalidSignature)
+	c.Assert(server.accounts["bob@example.org"], IsNil)
+
+	pub.sign(bob.ourKeys)
+	c.Assert(server.receivePublication(session, macKey, pub.serialize()), IsNil)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerKeepsTheProfileOfAnotherKey(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+	mallory := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 1), IsNil)
+	c.Assert(mallory.publishPrekeys(t, "bob@example.org", 1), Equals, errPrekeyServerFailure)
+
+	st := server.accounts["bob@example.org"][0x102]
+	c.Assert(st.clientProfile.publicKey.h.Equals(bob.ourKeys.pub.h), Equals, true)
+	c.Assert(st.prekeyMessages, HasLen, 1)
+	c.Assert(mallory.ourPrekeys, HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerRejectsOlderClientProfiles(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 1), IsNil)
+
+	stored := server.accounts["bob@example.org"][0x102].clientProfile
+	older := *stored
+	older.expiration = stored.expiration.Add(-time.Hour)
+
+	c.Assert(canReplaceClientProfile(stored, stored), Equals, true)
+	c.Assert(canReplaceClientProfile(stored, &older), Equals, false)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerRejectsUnexpectedMessages(c *C) {
+	server, _ := newTestPrekeyServer(c)
+	keys, _ := generateKeyPair(rand.Reader)
+
+	sigma := &authMessage{}
+	c.Assert(sigma.auth(rand.Reader, keys.pub.h, keys.pub.h, keys.pub.h, keys.priv.r, nil), IsNil)
+
+	m := &prekeyDAKE3Message{
+		header:  prekeyServerHeader(prekeyDAKE3MsgType, 0x102, 0),
+		s:       keys.pub.h,
+		sigma:   sigma,
+		message: []byte{storageInformationRequestMsgType},
+	}
+
+	_, err := server.handle(m.serialize())
+	c.Assert(err, Equals, errUnexpectedMessage)
+
+	_, err = server.handle(prekeyServerHeader(dataMsgType, 0x102, 0).serialize())
+	c.Assert(err, Equals, errUnknownMessageType)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerFailsPublicationOverTheLimit(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", maxStoredPrekeyMessages), IsNil)
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 1), Equals, errPrekeyServerFailure)
+	c.Assert(server.accounts["bob@example.org"][0x102].prekeyMessages, HasLen, maxStoredPrekeyMessages)
+	c.Assert(bob.ourPrekeys, HasLen, maxStoredPrekeyMessages)
+}
+
+func (s *OTR4Suite) Test_PrekeyServerOverHTTP(c *C) {
+	server, _ := newTestPrekeyServer(c)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	t := NewHTTPPrekeyTransport(ts.URL, server.Identity(), server.Fingerprint())
+	bob := newTestConversation(c, 0x102)
+
+	c.Assert(bob.publishPrekeys(t, "bob@example.org", 1), IsNil)
+
+	ensembles, err := retrievePrekeyEnsembles(t, "bob@example.org", "4")
+	c.Assert(err, IsNil)
+	c.Assert(ensembles, HasLen, 1)
+
+	resp, err := http.Get(ts.URL)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+
+	resp, err = http.Post(ts.URL, "application/octet-stream", bytes.NewReader([]byte{0x00}))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,134 @@
+package otr4
+
+import "io"
+
+// We keep the secret of every prekey message we publish until a
+// Non-Interactive-Auth uses it. Identifiers of consumed prekeys are
+// remembered so they are never accepted or handed out again.
+
+const (
+	defaultPrekeyBatchSize = 100
+	defaultMinPrekeys      = 20
+)
+
+func generatePrekeySecret(rand io.Reader) (*prekeySecret, error) {
+	secret := &prekeySecret{}
+	var err1, err2 error
+
+	secret.ecdh, err1 = generateKeyPair(rand)
+	secret.dh, err2 = generateDHKeyPair(rand)
+	if err := firstError(err1, err2); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// newPrekeyIdentifier returns a random identifier that none of our current
+// or consumed prekeys uses
+func (c *Conversation) newPrekeyIdentifier() (uint32, error) {
+	for {
+		id, err := randIdentifier(c.rand())
+		if err != nil {
+			return 0, err
+		}
+
+		if _, ok := c.ourPrekeys[id]; !ok && !c.consumedPrekeys[id] {
+			return id, nil
+		}
+	}
+}
+
+// generatePrekeyMessages creates a batch of n prekey messages, keeping their
+// secrets
+func (c *Conversation) generatePrekeyMessages(n int) ([]*prekeyMessage, error) {
+	ms := make([]*prekeyMessage, 0, n)
+
+	for i := 0; i < n; i++ {
+		m, err := c.generatePrekeyMessage()
+		if err != nil {
+			c.forgetPrekeys(ms)
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+
+	return ms, nil
+}
+
+// forgetPrekeys drops the secrets of prekey messages that were never
+// published
+func (c *Conversation) forgetPrekeys(ms []*prekeyMessage) {
+	for _, m := range ms {
+		delete(c.ourPrekeys, m.identifier)
+	}
+}
+
+func (c *Conversation) consumePrekey(id uint32) {
+	delete(c.ourPrekeys, id)
+
+	if c.consumedPrekeys == nil {
+		c.consumedPrekeys = make(map[uint32]bool)
+	}
+	c.consumedPrekeys[id] = true
+}
+
+func (c *Conversation) prekeyBatchSize() int {
+	if c.PrekeyBatchSize > 0 {
+		return c.PrekeyBatchSize
+	}
+	return defaultPrekeyBatchSize
+}
+
+func (c *Conversation) minPrekeys() int {
+	if c.MinPrekeys > 0 {
+		return c.MinPrekeys
+	}
+	return defaultMinPrekeys
+}
+
+// UsePrekeyServer makes the conversation keep prekey messages published for
+// account on the prekey server reached through t, so peers can start
+// conversations with us while we are offline. A first batch is published
+// right away; ReplenishPrekeys publishes more when Non-Interactive-Auth
+// messages consumed them. With the PreferNonInteractive policy, the prekey
+// server is also where the prekey ensembles of the peer are looked for.
+// Requests fail if the server is not the one t expects.
+func (c *Conversation) UsePrekeyServer(t PrekeyTransport, account string) error {
+	c.prekeyServer = t
+	c.prekeyAccount = account
+
+	_, err := c.ReplenishPrekeys()
+	return err
+}
+
+// ReplenishPrekeys publishes a new batch of prekey messages if the prekey
+// server set with UsePrekeyServer stores fewer than MinPrekeys of ours, and
+// returns how many were published. It waits for the prekey server, so it is
+// not done by Receive: it should be called when PrekeyConsumed is.
+func (c *Conversation) ReplenishPrekeys() (int, error) {
+	if c.prekeyServer == nil {
+		return 0, errNoPrekeyServer
+	}
+
+	stored, err := c.prekeyStorageStatus(c.prekeyServer, c.prekeyAccount)
+	if err != nil {
+		return 0, err
+	}
+
+	if int(stored) >= c.minPrekeys() {
+		return 0, nil
+	}
+
+	n := c.prekeyBatchSize()
+	if room := maxStoredPrekeyMessages - int(stored); n > room {
+		n = room
+	}
+
+	err = c.publishPrekeys(c.prekeyServer, c.prekeyAccount, n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
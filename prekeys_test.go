@@ -0,0 +1,131 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_GeneratePrekeyMessages(c *C) {
+	bob := newTestConversation(c, 0x102)
+
+	ms, err := bob.generatePrekeyMessages(5)
+	c.Assert(err, IsNil)
+	c.Assert(ms, HasLen, 5)
+	c.Assert(bob.ourPrekeys, HasLen, 5)
+
+	for _, m := range ms {
+		secret := bob.ourPrekeys[m.identifier]
+		c.Assert(secret, NotNil)
+		c.Assert(m.y.Equals(secret.ecdh.pub.h), Equals, true)
+		c.Assert(m.b.Cmp(secret.dh.pub), Equals, 0)
+		c.Assert(m.instanceTag, Equals, uint32(0x102))
+	}
+}
+
+func (s *OTR4Suite) Test_PrekeyIdentifiersAreNotReused(c *C) {
+	bob := newTestConversation(c, 0x102)
+	bob.consumedPrekeys = map[uint32]bool{0x01: true}
+	bob.ourPrekeys = map[uint32]*prekeySecret{0x02: {}}
+
+	random := make([]byte, 3*fieldBytes)
+	random[3] = 0x01
+	random[fieldBytes+3] = 0x02
+	random[2*fieldBytes+3] = 0x03
+	bob.random = fixedRand(random)
+
+	id, err := bob.newPrekeyIdentifier()
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, uint32(0x03))
+
+	_, err = bob.newPrekeyIdentifier()
+	c.Assert(err, Equals, notEnoughEntropy)
+}
+
+func (s *OTR4Suite) Test_ConsumedPrekeysAreRejected(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	prekey, _ := bob.generatePrekeyEnsemble()
+	auth, _ := alice.sendNonInteractiveAuth(prekey, nil)
+
+	e := &prekeyEnsemble{}
+	c.Assert(e.deserialize(prekey), IsNil)
+	id := e.prekeyMessage.identifier
+
+	_, _, err := bob.Receive(encodeMessage(auth))
+	c.Assert(err, IsNil)
+	c.Assert(bob.consumedPrekeys[id], Equals, true)
+
+	// even if the secret were still around, the prekey cannot be used twice
+	bob.ourPrekeys[id] = &prekeySecret{}
+	_, _, err = bob.Receive(encodeMessage(auth))
+	c.Assert(err, Equals, errUnexpectedMessage)
+}
+
+func (s *OTR4Suite) Test_ReplenishPrekeys(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+	bob.PrekeyBatchSize = 3
+	bob.MinPrekeys = 2
+
+	_, err := bob.ReplenishPrekeys()
+	c.Assert(err, Equals, errNoPrekeyServer)
+
+	c.Assert(bob.UsePrekeyServer(t, "bob@example.org"), IsNil)
+	c.Assert(server.accounts["bob@example.org"][0x102].prekeyMessages, HasLen, 3)
+
+	n, err := bob.ReplenishPrekeys()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+	c.Assert(server.accounts["bob@example.org"][0x102].prekeyMessages, HasLen, 3)
+	c.Assert(bob.ourPrekeys, HasLen, 3)
+}
+
+func (s *OTR4Suite) Test_ReplenishPrekeysRespectsTheServerLimit(c *C) {
+	server, t := newTestPrekeyServer(c)
+	bob := newTestConversation(c, 0x102)
+	bob.PrekeyBatchSize = maxStoredPrekeyMessages - 10
+	c.Assert(bob.UsePrekeyServer(t, "bob@example.org"), IsNil)
+
+	bob.PrekeyBatchSize = maxStoredPrekeyMessages
+	bob.MinPrekeys = maxStoredPrekeyMessages
+
+	n, err := bob.ReplenishPrekeys()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+	c.Assert(server.accounts["bob@example.org"][0x102].prekeyMessages, HasLen, maxStoredPrekeyMessages)
+}
+
+func (s *OTR4Suite) Test_PrekeysAreReplenishedOutsideReceive(c *C) {
+	server, t := newTestPrekeyServer(c)
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+	bob.PrekeyBatchSize = 2
+	bob.MinPrekeys = 2
+	c.Assert(bob.UsePrekeyServer(t, "bob@example.org"), IsNil)
+
+	ensembles, err := retrievePrekeyEnsembles(t, "bob@example.org", "4")
+	c.Assert(err, IsNil)
+
+	auth, err := alice.sendNonInteractiveAuth(ensembles[0], []byte("hi bob"))
+	c.Assert(err, IsNil)
+
+	consumed := 0
+	bob.PrekeyConsumed = func() { consumed++ }
+	bob.prekeyServer = interceptedTransport{t, func([]byte) ([]byte, error) {
+		c.Error("Receive contacted the prekey server")
+		return nil, errNoPrekeyServer
+	}}
+
+	plain, _, err := bob.Receive(encodeMessage(auth))
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hi bob"))
+	c.Assert(consumed, Equals, 1)
+	c.Assert(server.accounts["bob@example.org"][0x102].prekeyMessages, HasLen, 1)
+
+	bob.prekeyServer = t
+	n, err := bob.ReplenishPrekeys()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(server.accounts["bob@example.org"][0x102].prekeyMessages, HasLen, 3)
+	c.Assert(bob.ourPrekeys, HasLen, 3)
+}
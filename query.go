@@ -0,0 +1,168 @@
+package otr4
+
+import (
+	"bytes"
+	"strings"
+)
+
+// A client advertises the versions it supports with a query message, such as
+// "?OTRv43?", or with a whitespace tag appended to a plaintext message.
+
+const (
+	queryMessagePrefix = "?OTRv"
+
+	whitespaceTagVersionBytes = 8
+)
+
+var whitespaceTagBase = []byte("\x20\x09\x20\x20\x09\x09\x09\x09\x20\x09\x20\x09\x20\x09\x20\x20")
+
+var whitespaceTagVersions = map[byte][]byte{
+	'3': []byte("\x20\x20\x09\x09\x20\x20\x09\x09"),
+	'4': []byte("\x20\x20\x09\x09\x20\x09\x20\x20"),
+}
+
+func queryMessage(versions string) []byte {
+	return []byte(queryMessagePrefix + versions + "?")
+}
+
+// parseQueryMessage returns the versions advertised by a query message
+// anywhere in msg. Versions we do not know are ignored.
+func parseQueryMessage(msg []byte) (string, bool) {
+	i := bytes.Index(msg, []byte(queryMessagePrefix))
+	if i < 0 {
+		return "", false
+	}
+
+	rest := msg[i+len(queryMessagePrefix):]
+	end := bytes.IndexByte(rest, '?')
+	if end < 0 {
+		return "", false
+	}
+
+	var versions string
+	for _, v := range rest[:end] {
+		if _, ok := whitespaceTagVersions[v]; ok && !strings.ContainsRune(versions, rune(v)) {
+			versions += string(v)
+		}
+	}
+
+	return versions, true
+}
+
+func whitespaceTag(versions string) []byte {
+	out := append([]byte{}, whitespaceTagBase...)
+	for _, v := range []byte(versions) {
+		out = append(out, whitespaceTagVersions[v]...)
+	}
+	return out
+}
+
+// extractWhitespaceTag removes a whitespace tag from a plaintext message,
+// returning the message without it and the versions advertised
+func extractWhitespaceTag(msg []byte) ([]byte, string, bool) {
+	i := bytes.Index(msg, whitespaceTagBase)
+	if i < 0 {
+		return msg, "", false
+	}
+
+	var versions string
+	cursor := msg[i+len(whitespaceTagBase):]
+	for len(cursor) >= whitespaceTagVersionBytes {
+		v, ok := whitespaceTagVersion(cursor[:whitespaceTagVersionBytes])
+		if !ok {
+			break
+		}
+
+		if !strings.ContainsRune(versions, rune(v)) {
+			versions += string(v)
+		}
+		cursor = cursor[whitespaceTagVersionBytes:]
+	}
+
+	plain := append(append([]byte{}, msg[:i]...), cursor...)
+	return plain, versions, true
+}
+
+func whitespaceTagVersion(tag []byte) (byte, bool) {
+	for v, t := range whitespaceTagVersions {
+		if bytes.Equal(tag, t) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// negotiateVersion picks the highest version advertised by the peer that our
+// policy allows
+func negotiateVersion(theirs string, policy Policy) (uint16, error) {
+	for _, v := range policy.versions() {
+		if strings.ContainsRune(theirs, v) {
+			return uint16(v - '0'), nil
+		}
+	}
+	return 0, errInvalidVersion
+}
+
+// QueryMessage returns a message asking the peer to start a conversation
+// with one of the versions our policy allows.
+func (c *Conversation) QueryMessage() []byte {
+	return queryMessage(c.policy().advertisedVersions())
+}
+
+// offersConversation tells whether a plaintext message asks to start a
+// conversation
+func offersConversation(msg []byte) bool {
+	_, isQuery := parseQueryMessage(msg)
+	return isQuery || bytes.Contains(msg, whitespaceTagBase)
+}
+
+// receivePlaintext handles a message that is not encoded, starting a DAKE if
+// it is a query message or carries a whitespace tag
+func (c *Conversation) receivePlaintext(message []byte) (plaintext []byte, toSend [][]byte, err error) {
+	if versions, ok := parseQueryMessage(message); ok {
+		toSend, err = c.startNegotiatedDAKE(versions)
+		return nil, toSend, err
+	}
+
+	policy := c.policy()
+	plaintext, versions, ok := extractWhitespaceTag(message)
+	if len(plaintext) > 0 && (c.msgState != StateStart || policy.has(RequireEncryption)) {
+		c.warn(WarnUnencryptedMessage)
+	}
+
+	if !ok {
+		if c.msgState == StateStart {
+			c.whitespaceTagRejected = true
+		}
+		return message, nil, nil
+	}
+
+	if !policy.has(WhitespaceStartDAKE) {
+		return plaintext, nil, nil
+	}
+
+	if _, err = negotiateVersion(versions, policy); err != nil {
+		return plaintext, nil, nil
+	}
+
+	toSend, err = c.startNegotiatedDAKE(versions)
+	return plaintext, toSend, err
+}
+
+func (c *Conversation) startNegotiatedDAKE(versions string) ([][]byte, error) {
+	version, err := negotiateVersion(versions, c.policy())
+	if err != nil {
+		return nil, err
+	}
+
+	if version != otrVersion {
+		return nil, errVersion3Unsupported
+	}
+
+	identity, err := c.startDAKE()
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{identity}, nil
+}
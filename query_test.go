@@ -0,0 +1,119 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_QueryMessage(c *C) {
+	c.Assert(queryMessage("43"), DeepEquals, []byte("?OTRv43?"))
+
+	conv := &Conversation{}
+	c.Assert(conv.QueryMessage(), DeepEquals, []byte("?OTRv4?"))
+
+	// version 3 is not offered, since it cannot be started
+	conv.Policy = AllowV3 | AllowV4
+	c.Assert(conv.QueryMessage(), DeepEquals, []byte("?OTRv4?"))
+}
+
+func (s *OTR4Suite) Test_ParseQueryMessage(c *C) {
+	versions, ok := parseQueryMessage([]byte("?OTRv4?"))
+	c.Assert(ok, Equals, true)
+	c.Assert(versions, Equals, "4")
+
+	versions, ok = parseQueryMessage([]byte("Bob wants to talk privately: ?OTRv3x4 2 3? Get a client"))
+	c.Assert(ok, Equals, true)
+	c.Assert(versions, Equals, "34")
+
+	versions, ok = parseQueryMessage([]byte("?OTRv?"))
+	c.Assert(ok, Equals, true)
+	c.Assert(versions, Equals, "")
+
+	_, ok = parseQueryMessage([]byte("?OTRv4"))
+	c.Assert(ok, Equals, false)
+
+	_, ok = parseQueryMessage([]byte("?OTR? hello"))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *OTR4Suite) Test_WhitespaceTag(c *C) {
+	msg := append([]byte("hello"), whitespaceTag("43")...)
+	msg = append(msg, []byte(" there")...)
+
+	plain, versions, ok := extractWhitespaceTag(msg)
+	c.Assert(ok, Equals, true)
+	c.Assert(versions, Equals, "43")
+	c.Assert(plain, DeepEquals, []byte("hello there"))
+
+	plain, versions, ok = extractWhitespaceTag(append([]byte("hi"), whitespaceTagBase...))
+	c.Assert(ok, Equals, true)
+	c.Assert(versions, Equals, "")
+	c.Assert(plain, DeepEquals, []byte("hi"))
+
+	_, _, ok = extractWhitespaceTag([]byte("hello \t there"))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *OTR4Suite) Test_NegotiateVersion(c *C) {
+	v, err := negotiateVersion("34", DefaultPolicy)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, uint16(4))
+
+	v, err = negotiateVersion("34", AllowV3|AllowV4)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, uint16(4))
+
+	v, err = negotiateVersion("3", AllowV3|AllowV4)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, uint16(3))
+
+	_, err = negotiateVersion("3", DefaultPolicy)
+	c.Assert(err, Equals, errInvalidVersion)
+
+	_, err = negotiateVersion("4", AllowV3)
+	c.Assert(err, Equals, errInvalidVersion)
+}
+
+func (s *OTR4Suite) Test_QueryMessageStartsTheDAKE(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	plain, toSend, err := bob.Receive(alice.QueryMessage())
+	c.Assert(err, IsNil)
+	c.Assert(plain, IsNil)
+	c.Assert(toSend, HasLen, 1)
+
+	_, toSend, err = alice.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	_, toSend, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	_, _, err = alice.Receive(toSend[0])
+	c.Assert(err, IsNil)
+
+	c.Assert(alice.ssid, DeepEquals, bob.ssid)
+}
+
+func (s *OTR4Suite) Test_QueryMessageWithoutCommonVersion(c *C) {
+	conv := newTestConversation(c, 0x101)
+
+	_, toSend, err := conv.Receive([]byte("?OTRv3?"))
+	c.Assert(err, Equals, errInvalidVersion)
+	c.Assert(toSend, IsNil)
+
+	conv.Policy = AllowV3 | AllowV4
+	_, _, err = conv.Receive([]byte("?OTRv3?"))
+	c.Assert(err, Equals, errVersion3Unsupported)
+}
+
+func (s *OTR4Suite) Test_WhitespaceTagStartsTheDAKE(c *C) {
+	conv := newTestConversation(c, 0x101)
+
+	plain, toSend, err := conv.Receive(append([]byte("hello"), whitespaceTag("4")...))
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hello"))
+	c.Assert(toSend, HasLen, 1)
+
+	plain, toSend, err = conv.Receive(append([]byte("hello"), whitespaceTag("3")...))
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hello"))
+	c.Assert(toSend, IsNil)
+}
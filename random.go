@@ -4,18 +4,23 @@ import (
 	"crypto/rand"
 	"io"
 
-	"golang.org/x/crypto/sha3"
-
 	"github.com/otrv4/ed448"
 )
 
-func (c *conversation) rand() io.Reader {
+func (c *Conversation) rand() io.Reader {
 	if c.random != nil {
 		return c.random
 	}
 	return rand.Reader
 }
 
+func (s *PrekeyServer) rand() io.Reader {
+	if s.random != nil {
+		return s.random
+	}
+	return rand.Reader
+}
+
 func randSymKey(rand io.Reader) ([]byte, error) {
 	var b [symKeyBytes]byte
 
@@ -37,20 +42,3 @@ func randScalar(rand io.Reader) (ed448.Scalar, error) {
 
 	return ed448.NewScalar(b[:]), nil
 }
-
-func randLongTermScalar(rand io.Reader) (ed448.Scalar, error) {
-	var b [fieldBytes]byte
-	var out [fieldBytes]byte
-
-	_, err := io.ReadFull(rand, b[:])
-	if err != nil {
-		return nil, notEnoughEntropy
-	}
-
-	hash := sha3.NewShake256()
-	hash.Write(b[:])
-	hash.Write([]byte("cramershoup_secret")) //XXX: change me!
-	hash.Read(out[:])
-
-	return ed448.NewScalar(out[:]), nil
-}
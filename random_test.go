@@ -11,12 +11,12 @@ import (
 func (s *OTR4Suite) Test_Randomness(c *C) {
 	// randomness
 	r := fixedRand([]byte{0x00})
-	con := &conversation{random: r}
+	con := &Conversation{random: r}
 
 	c.Assert(con.rand(), DeepEquals, r)
 
 	// no randomness
-	con = &conversation{}
+	con = &Conversation{}
 
 	c.Assert(con.rand(), DeepEquals, rand.Reader)
 }
@@ -53,22 +53,3 @@ func (s *OTR4Suite) Test_RandomScalar(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(scalar, DeepEquals, exp)
 }
-
-func (s *OTR4Suite) Test_RandomLongTermScalar(c *C) {
-	scalar, err := randLongTermScalar(fixedRand(randData))
-
-	exp := ed448.NewScalar(
-		[]byte{
-			0xc6, 0xd0, 0x98, 0x2e, 0xe4, 0xe5, 0x81, 0xe4,
-			0x61, 0x3c, 0x46, 0x99, 0x0a, 0x37, 0x79, 0xc3,
-			0xfa, 0xe5, 0xd5, 0x29, 0x27, 0x31, 0xa3, 0x55,
-			0x9f, 0x34, 0x91, 0xd1, 0x0c, 0x7f, 0x88, 0x56,
-			0x8c, 0x62, 0xe1, 0x86, 0xb7, 0xef, 0xd6, 0xcb,
-			0x1b, 0x14, 0x88, 0x3b, 0xc0, 0xfb, 0xac, 0x46,
-			0x0c, 0xc7, 0x20, 0x82, 0x3e, 0xd0, 0xdc, 0x2c,
-		},
-	)
-
-	c.Assert(err, IsNil)
-	c.Assert(scalar, DeepEquals, exp)
-}
@@ -0,0 +1,286 @@
+package otr4
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/otrv4/ed448"
+)
+
+// The double ratchet performs an ECDH ratchet every time the direction of the
+// conversation changes, and mixes a new 3072-bit DH shared secret into the
+// brace key on every third ECDH ratchet.
+
+const (
+	rootKeyBytes  = 64
+	chainKeyBytes = 64
+	encKeyBytes   = 32
+	macKeyBytes   = 64
+
+	dhRatchetInterval = 3
+)
+
+type ratchet struct {
+	rootKey        []byte
+	sendingChain   []byte
+	receivingChain []byte
+	braceKey       []byte
+
+	i  uint32 // ratchet id
+	j  uint32 // sending message id
+	k  uint32 // receiving message id
+	pn uint32 // length of the previous sending chain
+
+	ourECDH   *keyPair
+	theirECDH ed448.Point
+	ourDH     *dhKeyPair
+	theirDH   *big.Int
+
+	shouldRatchet bool
+
+	// MAC keys of the messages received in the current receiving chain, and
+	// the ones of retired chains waiting to be revealed
+	receivedMACKeys [][]byte
+	oldMACKeys      [][]byte
+
+	// ratchet id the peer used for the current receiving chain
+	theirRatchetID uint32
+
+	maxSkip        int
+	skipped        *skippedKeys
+	pendingSkipped []skippedMessageKey
+	usedSkipped    *messageKeyID
+}
+
+// newRatchet initializes the double ratchet from the result of a DAKE. Both
+// parties derive the first ECDH and DH keys from the shared secret: the one who
+// ratchets first uses them as the peer's keys, the other one as its own.
+func newRatchet(sharedSecret, braceKey []byte, ratchetsFirst bool, maxSkip, maxStoredKeys int) (*ratchet, error) {
+	ecdh, err := generateKeyPair(bytes.NewReader(kdf(usageECDHFirstEphemeral, privateKeySize, sharedSecret)))
+	if err != nil {
+		return nil, err
+	}
+
+	dh, err := generateDHKeyPair(bytes.NewReader(kdf(usageDHFirstEphemeral, dhPrivBytes, sharedSecret)))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ratchet{
+		rootKey:       kdf(usageFirstRootKey, rootKeyBytes, sharedSecret),
+		braceKey:      braceKey,
+		shouldRatchet: ratchetsFirst,
+		maxSkip:       maxSkip,
+		skipped:       newSkippedKeys(maxStoredKeys),
+	}
+
+	if ratchetsFirst {
+		r.theirECDH = ecdh.pub.h
+		r.theirDH = dh.pub
+	} else {
+		r.ourECDH = ecdh
+		r.ourDH = dh
+	}
+
+	return r, nil
+}
+
+func isDHRatchet(i uint32) bool {
+	return i%dhRatchetInterval == 0
+}
+
+func (r *ratchet) deriveChainKey(dhSecret *big.Int) ([]byte, error) {
+	if dhSecret != nil {
+		r.braceKey = kdf(usageThirdBraceKey, braceKeyBytes, dhSecret.Bytes())
+	} else {
+		r.braceKey = kdf(usageBraceKey, braceKeyBytes, r.braceKey)
+	}
+
+	kEcdh := ed448.PointScalarMul(r.theirECDH, r.ourECDH.priv.r).Encode()
+	if isZero(kEcdh) {
+		return nil, errInvalidPublicKey
+	}
+
+	k := kdf(usageSharedSecret, sharedSecretBytes, kEcdh, r.braceKey)
+	chainKey := kdf(usageChainKey, chainKeyBytes, r.rootKey, k)
+	r.rootKey = kdf(usageRootKey, rootKeyBytes, r.rootKey, k)
+
+	return chainKey, nil
+}
+
+func (c *Conversation) rotateSendingKeys() error {
+	r := c.ratchet
+
+	ecdh, err := generateKeyPair(c.rand())
+	if err != nil {
+		return err
+	}
+	r.ourECDH = ecdh
+
+	oldRootKey, oldBraceKey := r.rootKey, r.braceKey
+
+	var dhSecret *big.Int
+	if isDHRatchet(r.i) {
+		dh, err := generateDHKeyPair(c.rand())
+		if err != nil {
+			return err
+		}
+		r.ourDH = dh
+		dhSecret = r.ourDH.sharedSecret(r.theirDH)
+	}
+
+	r.sendingChain, err = r.deriveChainKey(dhSecret)
+	if err != nil {
+		return err
+	}
+
+	wipeBytes(oldRootKey)
+	wipeBytes(oldBraceKey)
+
+	r.pn = r.j
+	r.j = 0
+	r.shouldRatchet = false
+
+	return nil
+}
+
+func (r *ratchet) rotateReceivingKeys(i uint32, theirECDH ed448.Point, theirDH *big.Int) error {
+	if r.ourECDH == nil || r.ourDH == nil {
+		return errUnexpectedMessage
+	}
+
+	if !isValidPublicKey(&publicKey{h: theirECDH}) {
+		return errInvalidPublicKey
+	}
+
+	if isDHRatchet(i) != (theirDH != nil) {
+		return errInvalidPublicKey
+	}
+
+	var dhSecret *big.Int
+	if theirDH != nil {
+		if !isValidDHPublicKey(theirDH) {
+			return errInvalidPublicKey
+		}
+		r.theirDH = theirDH
+		dhSecret = r.ourDH.sharedSecret(theirDH)
+	}
+
+	r.theirECDH = theirECDH
+	r.oldMACKeys = append(r.oldMACKeys, r.receivedMACKeys...)
+	r.receivedMACKeys = nil
+
+	var err error
+	r.receivingChain, err = r.deriveChainKey(dhSecret)
+	if err != nil {
+		return err
+	}
+
+	r.theirRatchetID = i
+	r.i = i + 1
+	r.k = 0
+	r.shouldRatchet = true
+
+	return nil
+}
+
+// deriveMessageKeys returns the keys for the current message of the chain and
+// the next chain key
+func deriveMessageKeys(chainKey []byte) (encKey, macKey, nextChainKey []byte) {
+	encKey = kdf(usageMessageKey, encKeyBytes, chainKey)
+	macKey = kdf(usageMACKey, macKeyBytes, encKey)
+	nextChainKey = kdf(usageNextChainKey, chainKeyBytes, chainKey)
+	return
+}
+
+// sendingKeys returns the keys to encrypt the next outgoing message, together
+// with the ratchet and message ids it should be sent with
+func (c *Conversation) sendingKeys() (i, j uint32, encKey, macKey []byte, err error) {
+	r := c.ratchet
+	if r == nil || (!r.shouldRatchet && r.sendingChain == nil) {
+		err = errSessionNotReady
+		return
+	}
+
+	if r.shouldRatchet {
+		err = c.rotateSendingKeys()
+		if err != nil {
+			return
+		}
+	}
+
+	i, j = r.i, r.j
+	oldChainKey := r.sendingChain
+	encKey, macKey, r.sendingChain = deriveMessageKeys(r.sendingChain)
+	wipeBytes(oldChainKey)
+	r.j++
+
+	return
+}
+
+// receivingKeys returns the keys to decrypt an incoming message, either from
+// the skipped keys or by rotating and advancing the receiving chain. Changes
+// to the skipped keys only take effect after commitReceivedKeys.
+func (r *ratchet) receivingKeys(i, j, pn uint32, theirECDH ed448.Point, theirDH *big.Int) (encKey, macKey []byte, err error) {
+	id := newMessageKeyID(i, theirECDH, j)
+	if keys, ok := r.skipped.get(id); ok {
+		r.usedSkipped = &id
+		return keys.enc, keys.mac, nil
+	}
+
+	if r.theirECDH == nil || !theirECDH.Equals(r.theirECDH) {
+		if r.receivingChain != nil && i <= r.theirRatchetID {
+			return nil, nil, errImpossibleToDecrypt
+		}
+
+		if r.receivingChain != nil {
+			err = r.skipMessageKeys(pn)
+			if err != nil {
+				return
+			}
+		}
+
+		err = r.rotateReceivingKeys(i, theirECDH, theirDH)
+		if err != nil {
+			return
+		}
+	}
+
+	if j < r.k {
+		return nil, nil, errImpossibleToDecrypt
+	}
+
+	err = r.skipMessageKeys(j)
+	if err != nil {
+		return
+	}
+
+	encKey, macKey, r.receivingChain = deriveMessageKeys(r.receivingChain)
+	r.k++
+
+	return
+}
+
+func (c *Conversation) initializeRatchet(ratchetsFirst bool) error {
+	r, err := newRatchet(c.sharedSecret, c.braceKey, ratchetsFirst, c.maxSkip(), c.maxStoredMessageKeys())
+	if err != nil {
+		return err
+	}
+
+	c.ratchet = r
+	return nil
+}
+
+func (c *Conversation) maxSkip() int {
+	if c.MaxSkip > 0 {
+		return c.MaxSkip
+	}
+	return defaultMaxSkip
+}
+
+func (c *Conversation) maxStoredMessageKeys() int {
+	if c.MaxStoredMessageKeys > 0 {
+		return c.MaxStoredMessageKeys
+	}
+	return defaultMaxStoredMessageKeys
+}
@@ -0,0 +1,128 @@
+package otr4
+
+import (
+	"math/big"
+
+	. "gopkg.in/check.v1"
+)
+
+func establishTestSession(c *C) (alice, bob *Conversation) {
+	alice = newTestConversation(c, 0x101)
+	bob = newTestConversation(c, 0x102)
+
+	identity, err := bob.startDAKE()
+	c.Assert(err, IsNil)
+	_, toSend, err := alice.Receive(encodeMessage(identity))
+	c.Assert(err, IsNil)
+	_, toSend, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	_, _, err = alice.Receive(toSend[0])
+	c.Assert(err, IsNil)
+
+	return alice, bob
+}
+
+func ratchetDH(sender *Conversation, i uint32) *big.Int {
+	if isDHRatchet(i) {
+		return sender.ratchet.ourDH.pub
+	}
+	return nil
+}
+
+func assertSameKeys(c *C, sender, receiver *Conversation) {
+	i, j, encKey, macKey, err := sender.sendingKeys()
+	c.Assert(err, IsNil)
+
+	recvEncKey, recvMacKey, err := receiver.ratchet.receivingKeys(i, j, sender.ratchet.pn, sender.ratchet.ourECDH.pub.h, ratchetDH(sender, i))
+	c.Assert(err, IsNil)
+
+	c.Assert(recvEncKey, DeepEquals, encKey)
+	c.Assert(recvMacKey, DeepEquals, macKey)
+}
+
+func (s *OTR4Suite) Test_RatchetIsInitializedAfterDAKE(c *C) {
+	alice, bob := establishTestSession(c)
+
+	c.Assert(alice.ratchet, NotNil)
+	c.Assert(bob.ratchet, NotNil)
+	c.Assert(alice.ratchet.rootKey, DeepEquals, bob.ratchet.rootKey)
+	c.Assert(alice.ratchet.theirECDH.Equals(bob.ratchet.ourECDH.pub.h), Equals, true)
+	c.Assert(alice.ratchet.theirDH, DeepEquals, bob.ratchet.ourDH.pub)
+	c.Assert(alice.ratchet.shouldRatchet, Equals, true)
+	c.Assert(bob.ratchet.shouldRatchet, Equals, false)
+}
+
+func (s *OTR4Suite) Test_RatchetCannotSendBeforeReceiving(c *C) {
+	_, bob := establishTestSession(c)
+
+	_, _, _, _, err := bob.sendingKeys()
+
+	c.Assert(err, Equals, errSessionNotReady)
+}
+
+func (s *OTR4Suite) Test_RatchetDerivesSameMessageKeys(c *C) {
+	alice, bob := establishTestSession(c)
+
+	assertSameKeys(c, alice, bob)
+	assertSameKeys(c, alice, bob)
+
+	c.Assert(alice.ratchet.j, Equals, uint32(2))
+	c.Assert(bob.ratchet.k, Equals, uint32(2))
+}
+
+func (s *OTR4Suite) Test_RatchetRotatesOnDirectionChange(c *C) {
+	alice, bob := establishTestSession(c)
+
+	for n := 0; n < 7; n++ {
+		assertSameKeys(c, alice, bob)
+		assertSameKeys(c, bob, alice)
+	}
+
+	c.Assert(alice.ratchet.i, Equals, uint32(14))
+	c.Assert(bob.ratchet.i, Equals, uint32(13))
+	c.Assert(alice.ratchet.rootKey, DeepEquals, bob.ratchet.rootKey)
+	c.Assert(alice.ratchet.braceKey, DeepEquals, bob.ratchet.braceKey)
+}
+
+func (s *OTR4Suite) Test_RatchetMixesDHEveryThirdRatchet(c *C) {
+	alice, bob := establishTestSession(c)
+
+	assertSameKeys(c, alice, bob)
+	firstDH := alice.ratchet.ourDH
+	assertSameKeys(c, bob, alice)
+	assertSameKeys(c, alice, bob)
+
+	c.Assert(alice.ratchet.ourDH, Equals, firstDH)
+
+	assertSameKeys(c, bob, alice)
+
+	c.Assert(bob.ratchet.i, Equals, uint32(3))
+	c.Assert(alice.ratchet.theirDH, DeepEquals, bob.ratchet.ourDH.pub)
+	c.Assert(alice.ratchet.theirDH, Not(DeepEquals), firstDH.pub)
+}
+
+func (s *OTR4Suite) Test_RatchetRejectsMissingDHKey(c *C) {
+	alice, bob := establishTestSession(c)
+
+	i, j, _, _, _ := alice.sendingKeys()
+
+	_, _, err := bob.ratchet.receivingKeys(i, j, alice.ratchet.pn, alice.ratchet.ourECDH.pub.h, nil)
+
+	c.Assert(err, Equals, errInvalidPublicKey)
+}
+
+func (s *OTR4Suite) Test_RatchetSkipsAheadInChain(c *C) {
+	alice, bob := establishTestSession(c)
+
+	alice.sendingKeys()
+	i, j, encKey, _, _ := alice.sendingKeys()
+
+	recvEncKey, _, err := bob.ratchet.receivingKeys(i, j, alice.ratchet.pn, alice.ratchet.ourECDH.pub.h, ratchetDH(alice, i))
+
+	c.Assert(err, IsNil)
+	c.Assert(recvEncKey, DeepEquals, encKey)
+
+	_, _, err = bob.ratchet.receivingKeys(i, 0, alice.ratchet.pn, alice.ratchet.ourECDH.pub.h, ratchetDH(alice, i))
+
+	c.Assert(err, Equals, errImpossibleToDecrypt)
+}
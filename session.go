@@ -0,0 +1,335 @@
+package otr4
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// limits on the conversations kept with the instances of a peer, since
+	// any message can claim to come from a new instance
+	maxInstancesPerPeer = 16
+	instanceIdleTimeout = 24 * time.Hour
+)
+
+// OutgoingPolicy chooses the instance of a peer that receives the messages
+// sent with SessionManager.Send, when the peer uses several clients.
+type OutgoingPolicy int
+
+const (
+	// SendToBest sends to the instance we last received a message from among
+	// the ones we have an encrypted session with, or among all of them if
+	// there is none.
+	SendToBest OutgoingPolicy = iota
+	// SendToMostRecent sends to the instance we last received a message
+	// from.
+	SendToMostRecent
+)
+
+// SessionManager keeps a conversation with every client instance of every
+// peer of an account. Received messages are routed by the account of the peer
+// and the sender instance tag.
+//
+// The conversations share our keys, profiles, instance tag and prekey secrets
+// with the conversation the manager was created from, and its settings. Saving
+// its keys with SaveKeys persists our instance tag.
+//
+// At most 16 instances of a peer are kept. When a new one appears, the
+// conversations with instances that sent nothing valid for a day are dropped,
+// and then the least recently active ones if there are still too many.
+type SessionManager struct {
+	// Outgoing chooses the instance Send sends to.
+	Outgoing OutgoingPolicy
+	// ConversationCreated, if set, is called with every conversation the
+	// manager creates, so the application can set callbacks for that peer.
+	ConversationCreated func(peer string, conv *Conversation)
+
+	identity *Conversation
+	peers    map[string]*peerSessions
+}
+
+// peerSessions are the conversations with the instances of a peer
+type peerSessions struct {
+	// pending is the conversation with an instance we do not know yet: it is
+	// bound to the first instance that sends us a message
+	pending   *Conversation
+	instances map[uint32]*session
+}
+
+type session struct {
+	conv         *Conversation
+	lastReceived time.Time
+}
+
+// NewSessionManager creates a session manager for the account of identity,
+// which holds our keys and the settings of every conversation.
+func NewSessionManager(identity *Conversation) (*SessionManager, error) {
+	if !isValidInstanceTag(identity.ourInstanceTag) {
+		tag, err := generateInstanceTag(identity.rand())
+		if err != nil {
+			return nil, err
+		}
+		identity.ourInstanceTag = tag
+	}
+
+	// the conversations must share the profile and the prekey secrets, so
+	// they cannot be created lazily by each of them
+	_, err := identity.clientProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	if identity.ourPrekeys == nil {
+		identity.ourPrekeys = make(map[uint32]*prekeySecret)
+	}
+
+	if identity.consumedPrekeys == nil {
+		identity.consumedPrekeys = make(map[uint32]bool)
+	}
+
+	return &SessionManager{
+		identity: identity,
+		peers:    make(map[string]*peerSessions),
+	}, nil
+}
+
+// sibling returns a new conversation of the same client as c, with peer
+func (c *Conversation) sibling(peer string) *Conversation {
+	return &Conversation{
+		Policy:                    c.Policy,
+		Policies:                  c.Policies,
+		MTU:                       c.MTU,
+		MaxSkip:                   c.MaxSkip,
+		MaxStoredMessageKeys:      c.MaxStoredMessageKeys,
+		PrekeyBatchSize:           c.PrekeyBatchSize,
+		MinPrekeys:                c.MinPrekeys,
+		PrekeyConsumed:            c.PrekeyConsumed,
+		SMPNormalization:          c.SMPNormalization,
+		SMPSecretNeeded:           c.SMPSecretNeeded,
+		SMPResult:                 c.SMPResult,
+		SMPAborted:                c.SMPAborted,
+		ExtraSymmetricKeyReceived: c.ExtraSymmetricKeyReceived,
+		TrustStore:                c.TrustStore,
+		Account:                   c.Account,
+		Peer:                      peer,
+		FingerprintSeen:           c.FingerprintSeen,
+		StateChanged:              c.StateChanged,
+		SecurityWarning:           c.SecurityWarning,
+
+		random:           c.random,
+		ourKeys:          c.ourKeys,
+		ourInstanceTag:   c.ourInstanceTag,
+		ourProfile:       c.ourProfile,
+		ourForgingKey:    c.ourForgingKey,
+		ourPrekeyProfile: c.ourPrekeyProfile,
+		sharedPrekey:     c.sharedPrekey,
+		ourPrekeys:       c.ourPrekeys,
+		consumedPrekeys:  c.consumedPrekeys,
+		prekeyServer:     c.prekeyServer,
+		prekeyAccount:    c.prekeyAccount,
+		tlvHandlers:      c.tlvHandlers,
+	}
+}
+
+func (m *SessionManager) peer(peer string) *peerSessions {
+	p, ok := m.peers[peer]
+	if !ok {
+		p = &peerSessions{instances: make(map[uint32]*session)}
+		m.peers[peer] = p
+	}
+	return p
+}
+
+func (m *SessionManager) newConversation(peer string) *Conversation {
+	conv := m.identity.sibling(peer)
+	if m.ConversationCreated != nil {
+		m.ConversationCreated(peer, conv)
+	}
+	return conv
+}
+
+// pending returns the conversation with an unknown instance of peer, creating
+// it if needed
+func (m *SessionManager) pending(peer string) *Conversation {
+	p := m.peer(peer)
+	if p.pending == nil {
+		p.pending = m.newConversation(peer)
+	}
+	return p.pending
+}
+
+// bind makes the pending conversation the one with a new instance of peer
+func (m *SessionManager) bind(peer string, tag uint32, now time.Time) *session {
+	conv := m.pending(peer)
+
+	p := m.peer(peer)
+	p.evict(now.Add(-instanceIdleTimeout))
+	p.pending = nil
+
+	s := &session{conv: conv, lastReceived: now}
+	p.instances[tag] = s
+	return s
+}
+
+// evict drops the conversations with the instances that sent nothing valid
+// since deadline, and then the least recently active ones until there is room
+// for a new instance
+func (p *peerSessions) evict(deadline time.Time) {
+	for tag, s := range p.instances {
+		if s.lastReceived.Before(deadline) {
+			delete(p.instances, tag)
+		}
+	}
+
+	for len(p.instances) >= maxInstancesPerPeer {
+		var oldest uint32
+		var last *session
+		for tag, s := range p.instances {
+			if last == nil || s.lastReceived.Before(last.lastReceived) {
+				oldest, last = tag, s
+			}
+		}
+		delete(p.instances, oldest)
+	}
+}
+
+// routingTags returns the instance tags of a received message, if it has any
+func routingTags(message []byte) (senderTag, receiverTag uint32, ok bool) {
+	switch {
+	case isFragment(message):
+		f, err := parseFragment(message)
+		if err != nil {
+			return 0, 0, false
+		}
+		return f.senderTag, f.receiverTag, true
+	case isEncoded(message):
+		decoded, err := decodeMessage(message)
+		if err != nil {
+			return 0, 0, false
+		}
+		_, h, ok := extractHeader(decoded)
+		return h.senderInstanceTag, h.receiverInstanceTag, ok
+	}
+
+	return 0, 0, false
+}
+
+// Receive handles a message received from peer, passing it to the
+// conversation with the instance that sent it. Query messages and whitespace
+// tags may come from an instance we do not know yet, so they go to the
+// pending conversation. Other messages without instance tags, like plaintext
+// and error messages, go to the instance Send would send to.
+func (m *SessionManager) Receive(peer string, message []byte) (plaintext []byte, toSend [][]byte, err error) {
+	senderTag, receiverTag, ok := routingTags(message)
+	if !ok && offersConversation(message) {
+		return m.pending(peer).Receive(message)
+	}
+
+	if !ok || !isValidInstanceTag(senderTag) {
+		return m.outgoing(peer).Receive(message)
+	}
+
+	if !m.identity.isForUs(receiverTag) {
+		return nil, nil, nil
+	}
+
+	now := time.Now()
+	if s, ok := m.peer(peer).instances[senderTag]; ok {
+		plaintext, toSend, err = s.conv.Receive(message)
+		if err == nil {
+			s.lastReceived = now
+		}
+		return plaintext, toSend, err
+	}
+
+	// a new instance gets the pending conversation, as it may be answering a
+	// message it sent. It is only bound to the instance once the conversation
+	// accepted it as its peer, so that forged messages cannot take it over.
+	conv := m.pending(peer)
+	plaintext, toSend, err = conv.Receive(message)
+	if err == nil && conv.theirInstanceTag == senderTag {
+		m.bind(peer, senderTag, now)
+	}
+
+	return plaintext, toSend, err
+}
+
+// Send takes a plaintext message for peer and returns the messages that
+// should be sent to it, encrypted for the instance chosen by the outgoing
+// policy.
+func (m *SessionManager) Send(peer string, plaintext []byte) ([][]byte, error) {
+	return m.outgoing(peer).Send(plaintext)
+}
+
+// SendTo takes a plaintext message for an instance of peer and returns the
+// messages that should be sent to it.
+func (m *SessionManager) SendTo(peer string, instanceTag uint32, plaintext []byte) ([][]byte, error) {
+	conv, ok := m.Conversation(peer, instanceTag)
+	if !ok {
+		return nil, errUnknownInstance
+	}
+	return conv.Send(plaintext)
+}
+
+// QueryMessage returns a query message offering to start an encrypted
+// conversation with any instance of peer.
+func (m *SessionManager) QueryMessage(peer string) []byte {
+	return m.pending(peer).QueryMessage()
+}
+
+// Conversation returns the conversation with an instance of peer
+func (m *SessionManager) Conversation(peer string, instanceTag uint32) (*Conversation, bool) {
+	p, ok := m.peers[peer]
+	if !ok {
+		return nil, false
+	}
+
+	s, ok := p.instances[instanceTag]
+	if !ok {
+		return nil, false
+	}
+	return s.conv, true
+}
+
+// Instances returns the instance tags of the clients of peer we have
+// conversations with
+func (m *SessionManager) Instances(peer string) []uint32 {
+	p, ok := m.peers[peer]
+	if !ok {
+		return nil
+	}
+
+	tags := make([]uint32, 0, len(p.instances))
+	for tag := range p.instances {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	return tags
+}
+
+// outgoing returns the conversation chosen by the outgoing policy, or the
+// pending conversation if no instance of peer is known
+func (m *SessionManager) outgoing(peer string) *Conversation {
+	p := m.peer(peer)
+
+	var best *session
+	for _, s := range p.instances {
+		if best == nil || m.prefers(s, best) {
+			best = s
+		}
+	}
+
+	if best == nil {
+		return m.pending(peer)
+	}
+	return best.conv
+}
+
+// prefers tells whether the outgoing policy prefers s to other
+func (m *SessionManager) prefers(s, other *session) bool {
+	if m.Outgoing == SendToBest && s.conv.isEncrypted() != other.conv.isEncrypted() {
+		return s.conv.isEncrypted()
+	}
+	return s.lastReceived.After(other.lastReceived)
+}
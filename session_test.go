@@ -0,0 +1,224 @@
+package otr4
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func newTestSessionManager(c *C) *SessionManager {
+	identity := newTestConversation(c, 0x101)
+	identity.Account = "alice@example.org"
+
+	m, err := NewSessionManager(identity)
+	c.Assert(err, IsNil)
+	return m
+}
+
+// connectDevice runs a DAKE between the session manager and a client of bob,
+// started by a query message of the manager
+func connectDevice(c *C, m *SessionManager, bob *Conversation) {
+	_, toSend, err := bob.Receive(m.QueryMessage("bob"))
+	c.Assert(err, IsNil)
+	_, toSend, err = m.Receive("bob", toSend[0])
+	c.Assert(err, IsNil)
+	_, toSend, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	_, _, err = m.Receive("bob", toSend[0])
+	c.Assert(err, IsNil)
+}
+
+func (s *OTR4Suite) Test_SessionManagerRoutesByInstance(c *C) {
+	m := newTestSessionManager(c)
+	bob1 := newTestConversation(c, 0x201)
+	bob2 := newTestConversation(c, 0x202)
+
+	var created []*Conversation
+	m.ConversationCreated = func(peer string, conv *Conversation) {
+		c.Assert(peer, Equals, "bob")
+		created = append(created, conv)
+	}
+
+	connectDevice(c, m, bob1)
+	connectDevice(c, m, bob2)
+
+	c.Assert(m.Instances("bob"), DeepEquals, []uint32{0x201, 0x202})
+	c.Assert(created, HasLen, 2)
+
+	for _, tag := range []uint32{0x201, 0x202} {
+		conv, ok := m.Conversation("bob", tag)
+		c.Assert(ok, Equals, true)
+		c.Assert(conv.TheirInstanceTag(), Equals, tag)
+		c.Assert(conv.InstanceTag(), Equals, uint32(0x101))
+		c.Assert(conv.Account, Equals, "alice@example.org")
+		c.Assert(conv.Peer, Equals, "bob")
+		c.Assert(conv.ourKeys, Equals, m.identity.ourKeys)
+	}
+
+	for _, bob := range []*Conversation{bob1, bob2} {
+		toSend, err := m.SendTo("bob", bob.InstanceTag(), []byte("hello"))
+		c.Assert(err, IsNil)
+		assertReceived(c, bob, toSend[0], "hello")
+	}
+
+	toSend, err := bob1.Send([]byte("from the phone"))
+	c.Assert(err, IsNil)
+	plain, _, err := m.Receive("bob", toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("from the phone"))
+
+	toSend, err = bob2.Send([]byte("from the laptop"))
+	c.Assert(err, IsNil)
+	plain, _, err = m.Receive("bob", toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("from the laptop"))
+}
+
+func (s *OTR4Suite) Test_SessionManagerSendsToTheChosenInstance(c *C) {
+	m := newTestSessionManager(c)
+	bob1 := newTestConversation(c, 0x201)
+	bob2 := newTestConversation(c, 0x202)
+
+	connectDevice(c, m, bob1)
+	connectDevice(c, m, bob2)
+
+	toSend, err := m.SendTo("bob", 0x201, []byte("hello phone"))
+	c.Assert(err, IsNil)
+	assertReceived(c, bob1, toSend[0], "hello phone")
+
+	plain, _, err := bob2.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, IsNil)
+
+	toSend, err = m.Send("bob", []byte("hello laptop"))
+	c.Assert(err, IsNil)
+	assertReceived(c, bob2, toSend[0], "hello laptop")
+
+	reply, err := bob1.Send([]byte("I am here"))
+	c.Assert(err, IsNil)
+	_, _, err = m.Receive("bob", reply[0])
+	c.Assert(err, IsNil)
+
+	toSend, err = m.Send("bob", []byte("hello again"))
+	c.Assert(err, IsNil)
+	assertReceived(c, bob1, toSend[0], "hello again")
+
+	_, err = m.SendTo("bob", 0x203, []byte("hello"))
+	c.Assert(err, Equals, errUnknownInstance)
+}
+
+func (s *OTR4Suite) Test_SessionManagerOutgoingPolicy(c *C) {
+	now := time.Now()
+	encrypted := &session{conv: &Conversation{msgState: StateEncryptedMessages}, lastReceived: now}
+	recent := &session{conv: &Conversation{}, lastReceived: now.Add(time.Second)}
+
+	m := &SessionManager{Outgoing: SendToBest}
+	c.Assert(m.prefers(encrypted, recent), Equals, true)
+	c.Assert(m.prefers(recent, encrypted), Equals, false)
+
+	m.Outgoing = SendToMostRecent
+	c.Assert(m.prefers(encrypted, recent), Equals, false)
+	c.Assert(m.prefers(recent, encrypted), Equals, true)
+}
+
+func (s *OTR4Suite) Test_SessionManagerWithoutInstancesSendsPlaintext(c *C) {
+	m := newTestSessionManager(c)
+
+	toSend, err := m.Send("bob", []byte("hello"))
+
+	c.Assert(err, IsNil)
+	c.Assert(toSend, DeepEquals, [][]byte{[]byte("hello")})
+	c.Assert(m.Instances("bob"), HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_SessionManagerIgnoresMessagesForAnotherInstance(c *C) {
+	m := newTestSessionManager(c)
+	msg := messageHeader{version: otrVersion, messageType: dataMsgType, senderInstanceTag: 0x201, receiverInstanceTag: 0x102}.serialize()
+
+	plain, toSend, err := m.Receive("bob", encodeMessage(msg))
+
+	c.Assert(err, IsNil)
+	c.Assert(plain, IsNil)
+	c.Assert(toSend, IsNil)
+	c.Assert(m.Instances("bob"), HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_NewSessionManagerSharesOurProfile(c *C) {
+	m := newTestSessionManager(c)
+
+	c.Assert(m.identity.ourProfile, NotNil)
+	c.Assert(m.identity.sibling("bob").ourProfile, Equals, m.identity.ourProfile)
+	c.Assert(m.identity.sibling("bob").ourForgingKey, Equals, m.identity.ourForgingKey)
+}
+
+func (s *OTR4Suite) Test_SessionManagerKeepsTheCallbacks(c *C) {
+	m := newTestSessionManager(c)
+	events := watchState(m.identity)
+	bob := newTestConversation(c, 0x201)
+
+	connectDevice(c, m, bob)
+	c.Assert(events.states, DeepEquals, []MessageState{StateEncryptedMessages})
+
+	_, _, err := m.Receive("bob", []byte("not encrypted"))
+	c.Assert(err, IsNil)
+	c.Assert(events.warnings, DeepEquals, []Warning{WarnUnencryptedMessage})
+}
+
+func (s *OTR4Suite) Test_SessionManagerBindsOnlyAcceptedInstances(c *C) {
+	m := newTestSessionManager(c)
+	bob := newTestConversation(c, 0x201)
+	mallory := newTestConversation(c, 0x666)
+
+	query := m.QueryMessage("bob")
+	pending := m.peers["bob"].pending
+
+	_, toSend, err := bob.Receive(query)
+	c.Assert(err, IsNil)
+	identity := toSend[0]
+
+	forged, err := mallory.startDAKE()
+	c.Assert(err, IsNil)
+	im := &identityMessage{}
+	c.Assert(im.deserialize(forged), IsNil)
+	im.profile.versions = "34"
+
+	_, _, err = m.Receive("bob", encodeMessage(im.serialize()))
+	c.Assert(err, Equals, errInvalidSignature)
+	c.Assert(m.Instances("bob"), HasLen, 0)
+	c.Assert(m.peers["bob"].pending, Equals, pending)
+
+	_, toSend, err = m.Receive("bob", identity)
+	c.Assert(err, IsNil)
+	c.Assert(m.Instances("bob"), DeepEquals, []uint32{0x201})
+	c.Assert(m.peers["bob"].pending, IsNil)
+
+	_, toSend, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	_, _, err = m.Receive("bob", toSend[0])
+	c.Assert(err, IsNil)
+
+	conv, _ := m.Conversation("bob", 0x201)
+	c.Assert(conv, Equals, pending)
+	c.Assert(conv.isEncrypted(), Equals, true)
+}
+
+func (s *OTR4Suite) Test_SessionManagerLimitsTheInstancesOfAPeer(c *C) {
+	m := newTestSessionManager(c)
+	now := time.Now()
+
+	for i := 0; i < maxInstancesPerPeer; i++ {
+		m.bind("bob", uint32(0x201+i), now).lastReceived = now.Add(time.Duration(i) * time.Second)
+	}
+
+	m.bind("bob", 0x300, now).lastReceived = now.Add(time.Hour)
+	c.Assert(m.Instances("bob"), HasLen, maxInstancesPerPeer)
+
+	_, ok := m.Conversation("bob", 0x201)
+	c.Assert(ok, Equals, false)
+	_, ok = m.Conversation("bob", 0x202)
+	c.Assert(ok, Equals, true)
+
+	// the instances idle for too long are dropped when a new one appears
+	m.bind("bob", 0x301, now.Add(instanceIdleTimeout+time.Minute))
+	c.Assert(m.Instances("bob"), DeepEquals, []uint32{0x300, 0x301})
+}
@@ -0,0 +1,192 @@
+package otr4
+
+import (
+	"github.com/otrv4/ed448"
+)
+
+const (
+	defaultMaxSkip              = 1000
+	defaultMaxStoredMessageKeys = 2000
+)
+
+type messageKeyID struct {
+	ratchetID uint32
+	ecdh      string
+	messageID uint32
+}
+
+type messageKeys struct {
+	enc []byte
+	mac []byte
+}
+
+type skippedMessageKey struct {
+	id   messageKeyID
+	keys *messageKeys
+}
+
+// skippedKeys stores the keys of messages that have not arrived yet, so they
+// can still be decrypted if they are delivered late. When full, the oldest
+// keys are erased first.
+type skippedKeys struct {
+	keys  map[messageKeyID]*messageKeys
+	order []messageKeyID
+	max   int
+}
+
+func newMessageKeyID(ratchetID uint32, ecdh ed448.Point, messageID uint32) messageKeyID {
+	return messageKeyID{
+		ratchetID: ratchetID,
+		ecdh:      string(ecdh.Encode()),
+		messageID: messageID,
+	}
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func sameBytes(a, b []byte) bool {
+	return len(a) > 0 && len(b) > 0 && &a[0] == &b[0]
+}
+
+func newSkippedKeys(max int) *skippedKeys {
+	return &skippedKeys{
+		keys: make(map[messageKeyID]*messageKeys),
+		max:  max,
+	}
+}
+
+func (s *skippedKeys) get(id messageKeyID) (*messageKeys, bool) {
+	keys, ok := s.keys[id]
+	return keys, ok
+}
+
+func (s *skippedKeys) put(id messageKeyID, keys *messageKeys) {
+	if _, ok := s.keys[id]; ok {
+		return
+	}
+
+	for len(s.order) >= s.max && len(s.order) > 0 {
+		s.wipe(s.order[0])
+		s.order = s.order[1:]
+	}
+
+	if s.max <= 0 {
+		return
+	}
+
+	s.keys[id] = keys
+	s.order = append(s.order, id)
+}
+
+func (s *skippedKeys) wipe(id messageKeyID) {
+	keys, ok := s.keys[id]
+	if !ok {
+		return
+	}
+
+	wipeBytes(keys.enc)
+	wipeBytes(keys.mac)
+	delete(s.keys, id)
+}
+
+// remove deletes the keys of a message that has been received. Only the
+// encryption key is erased, as the MAC key still has to be revealed.
+func (s *skippedKeys) remove(id messageKeyID) {
+	keys, ok := s.keys[id]
+	if !ok {
+		return
+	}
+
+	wipeBytes(keys.enc)
+	delete(s.keys, id)
+
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *skippedKeys) size() int {
+	return len(s.keys)
+}
+
+// skipMessageKeys derives the keys of the receiving chain until the given
+// message id. They are kept pending until the message that caused the skip is
+// authenticated.
+func (r *ratchet) skipMessageKeys(until uint32) error {
+	if until <= r.k {
+		return nil
+	}
+
+	if until-r.k > uint32(r.maxSkip) {
+		return errTooManySkippedMessages
+	}
+
+	for ; r.k < until; r.k++ {
+		keys := &messageKeys{}
+		keys.enc, keys.mac, r.receivingChain = deriveMessageKeys(r.receivingChain)
+
+		r.pendingSkipped = append(r.pendingSkipped, skippedMessageKey{
+			id:   newMessageKeyID(r.theirRatchetID, r.theirECDH, r.k),
+			keys: keys,
+		})
+	}
+
+	return nil
+}
+
+// commitReceivedKeys is called once a received message has been
+// authenticated: it stores the keys skipped while receiving it and records
+// its MAC key to be revealed.
+func (r *ratchet) commitReceivedKeys(macKey []byte) {
+	for _, s := range r.pendingSkipped {
+		r.skipped.put(s.id, s.keys)
+	}
+	r.pendingSkipped = nil
+
+	if r.usedSkipped == nil {
+		r.receivedMACKeys = append(r.receivedMACKeys, macKey)
+		return
+	}
+
+	if r.usedSkipped.ecdh == string(r.theirECDH.Encode()) {
+		r.receivedMACKeys = append(r.receivedMACKeys, macKey)
+	} else {
+		r.oldMACKeys = append(r.oldMACKeys, macKey)
+	}
+
+	r.skipped.remove(*r.usedSkipped)
+	r.usedSkipped = nil
+}
+
+// wipeReplacedKeys erases the key material of old that r no longer uses
+func (r *ratchet) wipeReplacedKeys(old *ratchet) {
+	for _, k := range [][2][]byte{
+		{old.rootKey, r.rootKey},
+		{old.receivingChain, r.receivingChain},
+		{old.braceKey, r.braceKey},
+	} {
+		if !sameBytes(k[0], k[1]) {
+			wipeBytes(k[0])
+		}
+	}
+}
+
+// wipe erases all the key material of the ratchet, once the session it
+// encrypts has ended
+func (r *ratchet) wipe() {
+	for _, k := range [][]byte{r.rootKey, r.sendingChain, r.receivingChain, r.braceKey} {
+		wipeBytes(k)
+	}
+
+	for id := range r.skipped.keys {
+		r.skipped.wipe(id)
+	}
+	r.skipped.order = nil
+}
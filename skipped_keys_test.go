@@ -0,0 +1,167 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func sendMessages(c *C, sender *Conversation, msgs ...string) [][]byte {
+	var out [][]byte
+	for _, m := range msgs {
+		toSend, err := sender.Send([]byte(m))
+		c.Assert(err, IsNil)
+		out = append(out, toSend[0])
+	}
+	return out
+}
+
+func assertReceived(c *C, receiver *Conversation, msg []byte, exp string) {
+	plain, _, err := receiver.Receive(msg)
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte(exp))
+}
+
+func (s *OTR4Suite) Test_SkippedKeysStore(c *C) {
+	store := newSkippedKeys(2)
+	ids := []messageKeyID{
+		newMessageKeyID(0, testPubA.h, 0),
+		newMessageKeyID(0, testPubA.h, 1),
+		newMessageKeyID(0, testPubA.h, 2),
+	}
+	keys := []*messageKeys{
+		{enc: []byte{0x01}, mac: []byte{0x02}},
+		{enc: []byte{0x03}, mac: []byte{0x04}},
+		{enc: []byte{0x05}, mac: []byte{0x06}},
+	}
+
+	store.put(ids[0], keys[0])
+	store.put(ids[1], keys[1])
+
+	k, ok := store.get(ids[1])
+
+	c.Assert(ok, Equals, true)
+	c.Assert(k, Equals, keys[1])
+
+	store.put(ids[2], keys[2])
+	_, ok = store.get(ids[0])
+
+	c.Assert(ok, Equals, false)
+	c.Assert(store.size(), Equals, 2)
+	c.Assert(keys[0].enc, DeepEquals, []byte{0x00})
+	c.Assert(keys[0].mac, DeepEquals, []byte{0x00})
+
+	store.remove(ids[1])
+	_, ok = store.get(ids[1])
+
+	c.Assert(ok, Equals, false)
+	c.Assert(store.size(), Equals, 1)
+	c.Assert(keys[1].enc, DeepEquals, []byte{0x00})
+	c.Assert(keys[1].mac, DeepEquals, []byte{0x04})
+}
+
+func (s *OTR4Suite) Test_ReceiveOutOfOrderInSameChain(c *C) {
+	alice, bob := establishTestSession(c)
+
+	msgs := sendMessages(c, alice, "one", "two", "three")
+
+	assertReceived(c, bob, msgs[2], "three")
+	c.Assert(bob.ratchet.skipped.size(), Equals, 2)
+
+	assertReceived(c, bob, msgs[0], "one")
+	assertReceived(c, bob, msgs[1], "two")
+	c.Assert(bob.ratchet.skipped.size(), Equals, 0)
+	c.Assert(bob.ratchet.receivedMACKeys, HasLen, 3)
+}
+
+func (s *OTR4Suite) Test_ReceiveLateMessageFromPreviousRatchet(c *C) {
+	alice, bob := establishTestSession(c)
+
+	msgs := sendMessages(c, alice, "one", "two")
+	assertReceived(c, bob, msgs[0], "one")
+
+	exchangeMessage(c, bob, alice, "three")
+	late := sendMessages(c, alice, "four")
+
+	assertReceived(c, bob, late[0], "four")
+	c.Assert(bob.ratchet.skipped.size(), Equals, 1)
+
+	assertReceived(c, bob, msgs[1], "two")
+	c.Assert(bob.ratchet.skipped.size(), Equals, 0)
+	c.Assert(bob.ratchet.oldMACKeys, HasLen, 2)
+}
+
+func (s *OTR4Suite) Test_ReceivedMessageCannotBeReplayed(c *C) {
+	alice, bob := establishTestSession(c)
+
+	msgs := sendMessages(c, alice, "one", "two")
+	assertReceived(c, bob, msgs[1], "two")
+	assertReceived(c, bob, msgs[0], "one")
+
+	_, _, err := bob.Receive(msgs[0])
+
+	c.Assert(err, Equals, errImpossibleToDecrypt)
+}
+
+func (s *OTR4Suite) Test_ReceiveRejectsSkippingTooManyMessages(c *C) {
+	alice, bob := establishTestSession(c)
+	bob.ratchet.maxSkip = 2
+
+	msgs := sendMessages(c, alice, "one", "two", "three", "four")
+
+	_, _, err := bob.Receive(msgs[3])
+
+	c.Assert(err, Equals, errTooManySkippedMessages)
+	c.Assert(bob.ratchet.skipped.size(), Equals, 0)
+
+	assertReceived(c, bob, msgs[2], "three")
+	assertReceived(c, bob, msgs[3], "four")
+	assertReceived(c, bob, msgs[0], "one")
+}
+
+func (s *OTR4Suite) Test_SkippedKeysAreBounded(c *C) {
+	alice, bob := establishTestSession(c)
+	bob.ratchet.skipped.max = 2
+
+	msgs := sendMessages(c, alice, "one", "two", "three", "four")
+	assertReceived(c, bob, msgs[3], "four")
+
+	c.Assert(bob.ratchet.skipped.size(), Equals, 2)
+
+	_, _, err := bob.Receive(msgs[0])
+
+	c.Assert(err, Equals, errImpossibleToDecrypt)
+
+	assertReceived(c, bob, msgs[1], "two")
+	assertReceived(c, bob, msgs[2], "three")
+}
+
+func (s *OTR4Suite) Test_ForgedMessageDoesNotStoreSkippedKeys(c *C) {
+	alice, bob := establishTestSession(c)
+
+	msgs := sendMessages(c, alice, "one", "two", "three")
+	forged := decodeTestMessage(c, msgs[2])
+	forged[len(forged)-macBytes-5] ^= 0x01
+
+	_, _, err := bob.Receive(encodeMessage(forged))
+
+	c.Assert(err, Equals, errInvalidMAC)
+	c.Assert(bob.ratchet.skipped.size(), Equals, 0)
+
+	assertReceived(c, bob, msgs[0], "one")
+}
+
+func (s *OTR4Suite) Test_ConversationLimitsAreUsedByRatchet(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+	bob.MaxSkip = 5
+	bob.MaxStoredMessageKeys = 7
+
+	identity, _ := bob.startDAKE()
+	_, toSend, _ := alice.Receive(encodeMessage(identity))
+	_, toSend, _ = bob.Receive(toSend[0])
+	alice.Receive(toSend[0])
+
+	c.Assert(bob.ratchet.maxSkip, Equals, 5)
+	c.Assert(bob.ratchet.skipped.max, Equals, 7)
+	c.Assert(alice.ratchet.maxSkip, Equals, defaultMaxSkip)
+	c.Assert(alice.ratchet.skipped.max, Equals, defaultMaxStoredMessageKeys)
+}
@@ -1,20 +1,18 @@
 package otr4
 
 import (
+	"bytes"
+	"io"
+
 	"github.com/otrv4/ed448"
-	"golang.org/x/crypto/sha3"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
 const smpVersion = 1
 
 func generateSMPsecret(initiatorFingerprint, receiverFingerprint, ssid, secret []byte) []byte {
-	h := sha3.New512()
-	h.Write([]byte{smpVersion})
-	h.Write(initiatorFingerprint)
-	h.Write(receiverFingerprint)
-	h.Write(ssid)
-	h.Write(secret)
-	return h.Sum(nil)
+	return hwc(usageSMPSecret, []byte{smpVersion}, initiatorFingerprint, receiverFingerprint, ssid, secret)
 }
 
 func generateDZKP(r, a, c ed448.Scalar) ed448.Scalar {
@@ -25,7 +23,7 @@ func generateDZKP(r, a, c ed448.Scalar) ed448.Scalar {
 
 func generateZKP(r, a ed448.Scalar, ix byte) (ed448.Scalar, ed448.Scalar) {
 	gr := ed448.PrecomputedScalarMul(r)
-	c := hashToScalar(ix, gr)
+	c := hashToScalar(ix, gr.Encode())
 	d := generateDZKP(r, a, c)
 
 	return c, d
@@ -36,7 +34,7 @@ func verifyZKP(d, c ed448.Scalar, g ed448.Point, ix byte) bool {
 	s := ed448.PointScalarMul(g, c)
 	p := ed448.NewPointFromBytes()
 	p.Add(r, s)
-	t := hashToScalar(ix, p)
+	t := hashToScalar(ix, p.Encode())
 	return c.Equals(t)
 }
 
@@ -45,7 +43,7 @@ func verifyZKP2(g2, g3, pb, qb ed448.Point, d5, d6, cp ed448.Scalar, ix byte) bo
 	r := ed448.PointDoubleScalarMul(ed448.BasePoint, g2, d5, d6)
 	s := ed448.PointScalarMul(qb, cp)
 	r.Add(r, s)
-	t := hashToScalar(ix, l, r)
+	t := hashToScalar(ix, appendBytes(l, r))
 	return cp.Equals(t)
 }
 
@@ -54,7 +52,7 @@ func verifyZKP3(g2, g3, pa, qa ed448.Point, d5, d6, cp ed448.Scalar, ix byte) bo
 	r := ed448.PointDoubleScalarMul(ed448.BasePoint, g2, d5, d6)
 	s := ed448.PointScalarMul(qa, cp)
 	r.Add(r, s)
-	t := hashToScalar(ix, l, r)
+	t := hashToScalar(ix, appendBytes(l, r))
 	return cp.Equals(t)
 }
 
@@ -63,6 +61,604 @@ func verifyZKP4(g3a, qa, qb, ra ed448.Point, d7, cr ed448.Scalar, ix byte) bool
 	s.Sub(qa, qb)
 	l := ed448.PointDoubleScalarMul(ed448.BasePoint, g3a, d7, cr)
 	r := ed448.PointDoubleScalarMul(s, ra, d7, cr)
-	t := hashToScalar(ix, l, r)
+	t := hashToScalar(ix, appendBytes(l, r))
 	return cr.Equals(t)
 }
+
+// The Socialist Millionaires Protocol lets both participants check that they
+// share the same secret without revealing it. Following the spec, Alice is the
+// one who starts it, sending SMP1, and Bob answers with SMP2 once the user has
+// provided the secret. Alice replies with SMP3 and Bob finishes it with SMP4.
+
+type smpState int
+
+const (
+	smpStateExpect1 smpState = iota
+	smpStateExpect2
+	smpStateExpect3
+	smpStateExpect4
+)
+
+type smpContext struct {
+	state smpState
+
+	secret ed448.Scalar
+	s2, s3 ed448.Scalar // our a2 and a3, or b2 and b3
+
+	g2, g3  ed448.Point
+	theirG3 ed448.Point
+
+	pa, qa ed448.Point
+	pb, qb ed448.Point
+
+	// SMP1 waiting for the user to provide the secret
+	received1 *smp1Message
+}
+
+type smp1Message struct {
+	question []byte
+	g2a      ed448.Point
+	c2, d2   ed448.Scalar
+	g3a      ed448.Point
+	c3, d3   ed448.Scalar
+}
+
+type smp2Message struct {
+	g2b        ed448.Point
+	c2, d2     ed448.Scalar
+	g3b        ed448.Point
+	c3, d3     ed448.Scalar
+	pb, qb     ed448.Point
+	cp, d5, d6 ed448.Scalar
+}
+
+type smp3Message struct {
+	pa, qa     ed448.Point
+	cp, d5, d6 ed448.Scalar
+	ra         ed448.Point
+	cr, d7     ed448.Scalar
+}
+
+type smp4Message struct {
+	rb     ed448.Point
+	cr, d7 ed448.Scalar
+}
+
+var smpAbortTLV = tlv{tlvType: tlvTypeSMPAbort}
+
+// extractSMPValues reads the points and scalars of an SMP message in order,
+// and fails if anything is left
+func extractSMPValues(bs []byte, values ...interface{}) bool {
+	var ok bool
+
+	for _, v := range values {
+		switch i := v.(type) {
+		case *ed448.Point:
+			bs, *i, ok = extractEncodedPoint(bs)
+		case *ed448.Scalar:
+			bs, *i, ok = extractScalar(bs)
+		default:
+			panic("programmer error: invalid input")
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return len(bs) == 0
+}
+
+// isValidSMPPoint checks that the points received are elements of the
+// prime-order group other than the identity. With the identity as g2a or g3a,
+// a man in the middle could make the secrets match without knowing them.
+func isValidSMPPoint(ps ...ed448.Point) bool {
+	identity := ed448.NewPointFromBytes()
+
+	// q*p is computed as (q-1)*p + p, since q itself reduces to zero
+	qMinusOne := ed448.NewScalar()
+	qMinusOne.Sub(qMinusOne, ed448.NewScalar([]byte{0x01}))
+
+	for _, p := range ps {
+		if !p.IsOnCurve() || p.Equals(identity) {
+			return false
+		}
+
+		qp := ed448.PointScalarMul(p, qMinusOne)
+		qp.Add(qp, p)
+		if !qp.Equals(identity) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *smp1Message) tlv() tlv {
+	out := appendData(nil, m.question)
+	out = append(out, appendBytes(m.g2a, m.c2, m.d2, m.g3a, m.c3, m.d3)...)
+	return tlv{tlvType: tlvTypeSMP1, tlvValue: out}
+}
+
+func (m *smp1Message) deserialize(bs []byte) error {
+	cursor, question, ok := extractData(bs)
+	if !ok || !extractSMPValues(cursor, &m.g2a, &m.c2, &m.d2, &m.g3a, &m.c3, &m.d3) {
+		return errMalformedMessage
+	}
+
+	m.question = question
+	return nil
+}
+
+func (m *smp2Message) tlv() tlv {
+	out := appendBytes(m.g2b, m.c2, m.d2, m.g3b, m.c3, m.d3, m.pb, m.qb, m.cp, m.d5, m.d6)
+	return tlv{tlvType: tlvTypeSMP2, tlvValue: out}
+}
+
+func (m *smp2Message) deserialize(bs []byte) error {
+	if !extractSMPValues(bs, &m.g2b, &m.c2, &m.d2, &m.g3b, &m.c3, &m.d3, &m.pb, &m.qb, &m.cp, &m.d5, &m.d6) {
+		return errMalformedMessage
+	}
+	return nil
+}
+
+func (m *smp3Message) tlv() tlv {
+	out := appendBytes(m.pa, m.qa, m.cp, m.d5, m.d6, m.ra, m.cr, m.d7)
+	return tlv{tlvType: tlvTypeSMP3, tlvValue: out}
+}
+
+func (m *smp3Message) deserialize(bs []byte) error {
+	if !extractSMPValues(bs, &m.pa, &m.qa, &m.cp, &m.d5, &m.d6, &m.ra, &m.cr, &m.d7) {
+		return errMalformedMessage
+	}
+	return nil
+}
+
+func (m *smp4Message) tlv() tlv {
+	out := appendBytes(m.rb, m.cr, m.d7)
+	return tlv{tlvType: tlvTypeSMP4, tlvValue: out}
+}
+
+func (m *smp4Message) deserialize(bs []byte) error {
+	if !extractSMPValues(bs, &m.rb, &m.cr, &m.d7) {
+		return errMalformedMessage
+	}
+	return nil
+}
+
+func randScalars(rand io.Reader, out ...*ed448.Scalar) error {
+	for _, s := range out {
+		var err error
+		*s, err = randScalar(rand)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SMPNormalization configures how SMP secrets are normalized before being
+// compared. Secrets are always converted to Unicode NFC, so the same text typed
+// on different platforms gives the same secret. Both participants must use the
+// same options for their secrets to match.
+type SMPNormalization struct {
+	// TrimSpace removes leading and trailing white space from the secret.
+	TrimSpace bool
+	// FoldCase makes the comparison of secrets case-insensitive.
+	FoldCase bool
+}
+
+func (n SMPNormalization) normalize(secret []byte) []byte {
+	out := norm.NFC.Bytes(secret)
+
+	if n.TrimSpace {
+		out = bytes.TrimSpace(out)
+	}
+
+	if n.FoldCase {
+		out = norm.NFC.Bytes(cases.Fold().Bytes(out))
+	}
+
+	return out
+}
+
+// smpSecret computes the secret compared by SMP, binding it to the
+// fingerprints of both clients and to the current session
+func (c *Conversation) smpSecret(secret []byte, weStarted bool) ed448.Scalar {
+	initiator := c.OurFingerprint()
+	receiver := c.theirProfile.fingerprint()
+	if !weStarted {
+		initiator, receiver = receiver, initiator
+	}
+
+	s := generateSMPsecret(initiator[:], receiver[:], c.ssid[:], c.SMPNormalization.normalize(secret))
+	return reduceToScalar(s)
+}
+
+// proveEqualLogs proves that p = g3*r and q = G*r + g2*x are built with the
+// same r, as sent in SMP2 and SMP3
+func proveEqualLogs(rand io.Reader, g2, g3 ed448.Point, r, x ed448.Scalar, ix byte) (cp, d5, d6 ed448.Scalar, err error) {
+	var r5, r6 ed448.Scalar
+	err = randScalars(rand, &r5, &r6)
+	if err != nil {
+		return
+	}
+
+	cp = hashToScalar(ix, appendBytes(ed448.PointScalarMul(g3, r5), ed448.PointDoubleScalarMul(ed448.BasePoint, g2, r5, r6)))
+	d5 = generateDZKP(r5, r.Copy(), cp)
+	d6 = generateDZKP(r6, x.Copy(), cp)
+
+	return
+}
+
+// proveRatio proves that r = (qa - qb)*s3 using the same s3 as g3 = G*s3, as
+// sent in SMP3 and SMP4
+func proveRatio(rand io.Reader, qa, qb ed448.Point, s3 ed448.Scalar, ix byte) (r ed448.Point, cr, d7 ed448.Scalar, err error) {
+	var r7 ed448.Scalar
+	err = randScalars(rand, &r7)
+	if err != nil {
+		return
+	}
+
+	qab := ed448.NewPointFromBytes()
+	qab.Sub(qa, qb)
+
+	r = ed448.PointScalarMul(qab, s3)
+	cr = hashToScalar(ix, appendBytes(ed448.PrecomputedScalarMul(r7), ed448.PointScalarMul(qab, r7)))
+	d7 = generateDZKP(r7, s3.Copy(), cr)
+
+	return
+}
+
+// secretsMatch checks that rab = pa - pb, which only holds if both secrets
+// were the same
+func (s *smpContext) secretsMatch(rab ed448.Point) bool {
+	pab := ed448.NewPointFromBytes()
+	pab.Sub(s.pa, s.pb)
+	return pab.Equals(rab)
+}
+
+func (c *Conversation) generateSMP1(secret []byte) (*smp1Message, error) {
+	s := &smpContext{secret: c.smpSecret(secret, true)}
+
+	var r2, r3 ed448.Scalar
+	err := randScalars(c.rand(), &s.s2, &s.s3, &r2, &r3)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &smp1Message{
+		g2a: ed448.PrecomputedScalarMul(s.s2),
+		g3a: ed448.PrecomputedScalarMul(s.s3),
+	}
+	m.c2, m.d2 = generateZKP(r2, s.s2.Copy(), 1)
+	m.c3, m.d3 = generateZKP(r3, s.s3.Copy(), 2)
+
+	s.state = smpStateExpect2
+	c.smp = s
+
+	return m, nil
+}
+
+func (c *Conversation) receiveSMP1(bs []byte) error {
+	m := &smp1Message{}
+	err := m.deserialize(bs)
+	if err != nil {
+		return err
+	}
+
+	if !isValidSMPPoint(m.g2a, m.g3a) {
+		return errInvalidPublicKey
+	}
+
+	if !verifyZKP(m.d2, m.c2, m.g2a, 1) || !verifyZKP(m.d3, m.c3, m.g3a, 2) {
+		return errInvalidSMPProof
+	}
+
+	c.smp = &smpContext{received1: m}
+
+	return nil
+}
+
+func (c *Conversation) generateSMP2(secret []byte) (*smp2Message, error) {
+	m1 := c.smp.received1
+	s := &smpContext{
+		secret:  c.smpSecret(secret, false),
+		theirG3: m1.g3a,
+	}
+
+	var r2, r3, r4 ed448.Scalar
+	err := randScalars(c.rand(), &s.s2, &s.s3, &r2, &r3, &r4)
+	if err != nil {
+		return nil, err
+	}
+
+	s.g2 = ed448.PointScalarMul(m1.g2a, s.s2)
+	s.g3 = ed448.PointScalarMul(m1.g3a, s.s3)
+	s.pb = ed448.PointScalarMul(s.g3, r4)
+	s.qb = ed448.PointDoubleScalarMul(ed448.BasePoint, s.g2, r4, s.secret)
+
+	m := &smp2Message{
+		g2b: ed448.PrecomputedScalarMul(s.s2),
+		g3b: ed448.PrecomputedScalarMul(s.s3),
+		pb:  s.pb,
+		qb:  s.qb,
+	}
+	m.c2, m.d2 = generateZKP(r2, s.s2.Copy(), 3)
+	m.c3, m.d3 = generateZKP(r3, s.s3.Copy(), 4)
+
+	m.cp, m.d5, m.d6, err = proveEqualLogs(c.rand(), s.g2, s.g3, r4, s.secret, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	s.state = smpStateExpect3
+	c.smp = s
+
+	return m, nil
+}
+
+func (c *Conversation) receiveSMP2(bs []byte) (*smp3Message, error) {
+	m := &smp2Message{}
+	err := m.deserialize(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isValidSMPPoint(m.g2b, m.g3b, m.pb, m.qb) {
+		return nil, errInvalidPublicKey
+	}
+
+	if !verifyZKP(m.d2, m.c2, m.g2b, 3) || !verifyZKP(m.d3, m.c3, m.g3b, 4) {
+		return nil, errInvalidSMPProof
+	}
+
+	s := c.smp
+	s.g2 = ed448.PointScalarMul(m.g2b, s.s2)
+	s.g3 = ed448.PointScalarMul(m.g3b, s.s3)
+	s.theirG3 = m.g3b
+
+	if !verifyZKP2(s.g2, s.g3, m.pb, m.qb, m.d5, m.d6, m.cp, 5) {
+		return nil, errInvalidSMPProof
+	}
+
+	s.pb, s.qb = m.pb, m.qb
+
+	var r4 ed448.Scalar
+	err = randScalars(c.rand(), &r4)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pa = ed448.PointScalarMul(s.g3, r4)
+	s.qa = ed448.PointDoubleScalarMul(ed448.BasePoint, s.g2, r4, s.secret)
+
+	reply := &smp3Message{pa: s.pa, qa: s.qa}
+
+	reply.cp, reply.d5, reply.d6, err = proveEqualLogs(c.rand(), s.g2, s.g3, r4, s.secret, 6)
+	if err != nil {
+		return nil, err
+	}
+
+	reply.ra, reply.cr, reply.d7, err = proveRatio(c.rand(), s.qa, s.qb, s.s3, 7)
+	if err != nil {
+		return nil, err
+	}
+
+	s.state = smpStateExpect4
+
+	return reply, nil
+}
+
+func (c *Conversation) receiveSMP3(bs []byte) (*smp4Message, bool, error) {
+	m := &smp3Message{}
+	err := m.deserialize(bs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !isValidSMPPoint(m.pa, m.qa, m.ra) {
+		return nil, false, errInvalidPublicKey
+	}
+
+	s := c.smp
+	if !verifyZKP3(s.g2, s.g3, m.pa, m.qa, m.d5, m.d6, m.cp, 6) ||
+		!verifyZKP4(s.theirG3, m.qa, s.qb, m.ra, m.d7, m.cr, 7) {
+		return nil, false, errInvalidSMPProof
+	}
+
+	s.pa, s.qa = m.pa, m.qa
+
+	reply := &smp4Message{}
+	reply.rb, reply.cr, reply.d7, err = proveRatio(c.rand(), s.qa, s.qb, s.s3, 8)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return reply, s.secretsMatch(ed448.PointScalarMul(m.ra, s.s3)), nil
+}
+
+func (c *Conversation) receiveSMP4(bs []byte) (bool, error) {
+	m := &smp4Message{}
+	err := m.deserialize(bs)
+	if err != nil {
+		return false, err
+	}
+
+	if !isValidSMPPoint(m.rb) {
+		return false, errInvalidPublicKey
+	}
+
+	s := c.smp
+	if !verifyZKP4(s.theirG3, s.qa, s.qb, m.rb, m.d7, m.cr, 8) {
+		return false, errInvalidSMPProof
+	}
+
+	return s.secretsMatch(ed448.PointScalarMul(m.rb, s.s3)), nil
+}
+
+func (c *Conversation) smpState() smpState {
+	if c.smp == nil {
+		return smpStateExpect1
+	}
+	return c.smp.state
+}
+
+// receiveSMP advances the SMP state machine with a received TLV and returns
+// the TLVs to send back. Any unexpected or invalid message aborts the
+// exchange.
+func (c *Conversation) receiveSMP(t tlv) []tlv {
+	if t.tlvType == tlvTypeSMPAbort {
+		c.resetSMP()
+		return nil
+	}
+
+	reply, err := c.advanceSMP(t)
+	if err != nil {
+		c.resetSMP()
+		return []tlv{smpAbortTLV}
+	}
+
+	return reply
+}
+
+func (c *Conversation) advanceSMP(t tlv) ([]tlv, error) {
+	var expected smpState
+
+	switch t.tlvType {
+	case tlvTypeSMP1:
+		expected = smpStateExpect1
+	case tlvTypeSMP2:
+		expected = smpStateExpect2
+	case tlvTypeSMP3:
+		expected = smpStateExpect3
+	case tlvTypeSMP4:
+		expected = smpStateExpect4
+	}
+
+	if c.smpState() != expected {
+		return nil, errUnexpectedMessage
+	}
+
+	switch t.tlvType {
+	case tlvTypeSMP1:
+		err := c.receiveSMP1(t.tlvValue)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.SMPSecretNeeded != nil {
+			c.SMPSecretNeeded(string(c.smp.received1.question))
+		}
+		return nil, nil
+
+	case tlvTypeSMP2:
+		reply, err := c.receiveSMP2(t.tlvValue)
+		if err != nil {
+			return nil, err
+		}
+		return []tlv{reply.tlv()}, nil
+
+	case tlvTypeSMP3:
+		reply, matched, err := c.receiveSMP3(t.tlvValue)
+		if err != nil {
+			return nil, err
+		}
+		c.finishSMP(matched)
+		return []tlv{reply.tlv()}, nil
+
+	default:
+		matched, err := c.receiveSMP4(t.tlvValue)
+		if err != nil {
+			return nil, err
+		}
+		c.finishSMP(matched)
+		return nil, nil
+	}
+}
+
+func (c *Conversation) finishSMP(matched bool) {
+	c.smp = nil
+
+	if matched && c.TrustStore != nil {
+		err := c.TrustStore.verifiedBySMP(c.Account, c.Peer, c.theirProfile.fingerprint())
+		if err != nil {
+			c.warn(WarnSMPVerificationNotStored)
+		}
+	}
+
+	if c.SMPResult != nil {
+		c.SMPResult(matched)
+	}
+}
+
+func (c *Conversation) resetSMP() {
+	inProgress := c.smp != nil
+	c.smp = nil
+
+	if inProgress && c.SMPAborted != nil {
+		c.SMPAborted()
+	}
+}
+
+func (c *Conversation) sendTLVs(tlvs ...tlv) ([][]byte, error) {
+	msg, err := c.createDataMessage(appendTLVs(nil, tlvs), flagIgnoreUnreadable)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.wireMessages(msg)
+}
+
+// StartSMP starts the Socialist Millionaires Protocol with the given secret,
+// returning the messages that should be sent to the peer. If an exchange was
+// already in progress, it is aborted and a new one is started.
+func (c *Conversation) StartSMP(secret []byte) ([][]byte, error) {
+	return c.StartSMPWithQuestion("", secret)
+}
+
+// StartSMPWithQuestion works like StartSMP, but also sends a question to the
+// peer whose answer is the secret.
+func (c *Conversation) StartSMPWithQuestion(question string, secret []byte) ([][]byte, error) {
+	if !c.isEncrypted() {
+		return nil, errSessionNotReady
+	}
+
+	var tlvs []tlv
+	if c.smp != nil {
+		tlvs = append(tlvs, smpAbortTLV)
+	}
+
+	m, err := c.generateSMP1(secret)
+	if err != nil {
+		return nil, err
+	}
+	m.question = []byte(question)
+
+	return c.sendTLVs(append(tlvs, m.tlv())...)
+}
+
+// ProvideSMPSecret answers an SMP exchange started by the peer, after
+// SMPSecretNeeded has been called, with the secret given by the user.
+func (c *Conversation) ProvideSMPSecret(secret []byte) ([][]byte, error) {
+	if c.smp == nil || c.smp.received1 == nil {
+		return nil, errNoSMPRequest
+	}
+
+	m, err := c.generateSMP2(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.sendTLVs(m.tlv())
+}
+
+// AbortSMP aborts the SMP exchange in progress, returning the messages that
+// should be sent to the peer.
+func (c *Conversation) AbortSMP() ([][]byte, error) {
+	if c.smp == nil {
+		return nil, nil
+	}
+
+	c.smp = nil
+	return c.sendTLVs(smpAbortTLV)
+}
@@ -17,9 +17,9 @@ func (s *OTR4Suite) Test_SMPSecretGeneration(c *C) {
 	secret := []byte("user's secret")
 	rslt := generateSMPsecret(aliceFingerprint, bobFingerprint, ssid, secret)
 
-	expectedSMPSecret := hexToBytes("c57f90a829917526a94b8ed36f0eea8e676" +
-		"190a07f6358682d358bc0471bcba401da479d59926ebd1fdfb371233e319dda35365" +
-		"cc141ea5c61dd52dcc0cdcd21")
+	expectedSMPSecret := hexToBytes("f1f3a7b5e6c8a6ca48a7313ccc69593cafc" +
+		"d83f70f5f8667d64db751ef2a4f788e258cc63f7e00cc5abf4e87e56895b8863ce75" +
+		"f83c7ad8d23d94313547dae99")
 
 	c.Assert(rslt, DeepEquals, expectedSMPSecret)
 }
@@ -43,37 +43,17 @@ func (s *OTR4Suite) Test_GenerateDZKP(c *C) {
 
 func (s *OTR4Suite) Test_GenerateZKP(c *C) {
 	b1 := [56]byte{0x04}
-	b2 := [56]byte{0x01}
+	b2 := [56]byte{0x02}
 
 	r := ed448.NewScalar(b1[:])
 	a := ed448.NewScalar(b2[:])
+	g := ed448.PrecomputedScalarMul(a)
 
 	cc, d := generateZKP(r, a, byte(01))
 
-	expC := ed448.NewScalar([]byte{
-		0xc4, 0x6b, 0x41, 0x3c, 0xd2, 0x70, 0xc9, 0xcb,
-		0x86, 0x68, 0x18, 0x57, 0x67, 0x63, 0x36, 0xf0,
-		0xb1, 0x38, 0x07, 0x35, 0x0b, 0x51, 0x90, 0xf5,
-		0x0a, 0x1c, 0x21, 0x27, 0xbd, 0xd0, 0x28, 0x0e,
-		0xd3, 0x0d, 0x30, 0x4d, 0x5e, 0x72, 0x32, 0x00,
-		0xd2, 0x25, 0x94, 0xc0, 0xa7, 0x08, 0x0d, 0xa0,
-		0xd2, 0xb5, 0xa4, 0x6e, 0x32, 0xc9, 0x02, 0x24,
-	},
-	)
-
-	expD := ed448.NewScalar([]byte{
-		0x33, 0xd9, 0x16, 0x6f, 0xc0, 0x51, 0xaf, 0x57,
-		0xce, 0x26, 0xad, 0x36, 0x0b, 0x5f, 0x36, 0x31,
-		0xde, 0xfd, 0xce, 0x79, 0x3e, 0x8a, 0xbe, 0xce,
-		0xde, 0x07, 0xa9, 0x55, 0x42, 0x2f, 0xd7, 0xf1,
-		0x2c, 0xf2, 0xcf, 0xb2, 0xa1, 0x8d, 0xcd, 0xff,
-		0x2d, 0xda, 0x6b, 0x3f, 0x58, 0xf7, 0xf2, 0x5f,
-		0x2d, 0x4a, 0x5b, 0x91, 0xcd, 0x36, 0xfd, 0x1b,
-	},
-	)
-
-	c.Assert(cc, DeepEquals, expC)
-	c.Assert(d, DeepEquals, expD)
+	c.Assert(verifyZKP(d, cc, g, byte(01)), Equals, true)
+	c.Assert(verifyZKP(d, cc, g, byte(02)), Equals, false)
+	c.Assert(verifyZKP(d, cc, ed448.BasePoint, byte(01)), Equals, false)
 }
 
 func (s *OTR4Suite) Test_VerifyZKP(c *C) {
@@ -343,3 +323,293 @@ func (s *OTR4Suite) Test_VerifyZKP4(c *C) {
 
 	c.Assert(ok, Equals, false)
 }
+
+type smpTestResults struct {
+	secretNeeded int
+	question     string
+	results      []bool
+	aborted      int
+}
+
+func watchSMP(conv *Conversation) *smpTestResults {
+	r := &smpTestResults{}
+	conv.SMPSecretNeeded = func(question string) {
+		r.secretNeeded++
+		r.question = question
+	}
+	conv.SMPResult = func(matched bool) { r.results = append(r.results, matched) }
+	conv.SMPAborted = func() { r.aborted++ }
+	return r
+}
+
+func deliver(c *C, receiver *Conversation, toSend [][]byte) [][]byte {
+	c.Assert(toSend, HasLen, 1)
+
+	plain, reply, err := receiver.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, HasLen, 0)
+
+	return reply
+}
+
+func runSMP(c *C, aliceSecret, bobSecret string) (alice, bob *smpTestResults) {
+	aliceConv, bobConv := establishTestSession(c)
+	alice, bob = watchSMP(aliceConv), watchSMP(bobConv)
+
+	smp1, err := aliceConv.StartSMP([]byte(aliceSecret))
+	c.Assert(err, IsNil)
+
+	c.Assert(deliver(c, bobConv, smp1), IsNil)
+	c.Assert(bob.secretNeeded, Equals, 1)
+
+	smp2, err := bobConv.ProvideSMPSecret([]byte(bobSecret))
+	c.Assert(err, IsNil)
+
+	smp3 := deliver(c, aliceConv, smp2)
+	smp4 := deliver(c, bobConv, smp3)
+	c.Assert(deliver(c, aliceConv, smp4), IsNil)
+
+	c.Assert(aliceConv.smp, IsNil)
+	c.Assert(bobConv.smp, IsNil)
+
+	return alice, bob
+}
+
+func (s *OTR4Suite) Test_SMPWithSameSecrets(c *C) {
+	alice, bob := runSMP(c, "our secret", "our secret")
+
+	c.Assert(alice.results, DeepEquals, []bool{true})
+	c.Assert(bob.results, DeepEquals, []bool{true})
+	c.Assert(alice.aborted+bob.aborted, Equals, 0)
+}
+
+func (s *OTR4Suite) Test_SMPWithDifferentSecrets(c *C) {
+	alice, bob := runSMP(c, "our secret", "not our secret")
+
+	c.Assert(alice.results, DeepEquals, []bool{false})
+	c.Assert(bob.results, DeepEquals, []bool{false})
+	c.Assert(alice.aborted+bob.aborted, Equals, 0)
+}
+
+func (s *OTR4Suite) Test_SMPMessagesSerialization(c *C) {
+	alice, bob := establishTestSession(c)
+
+	m1, err := alice.generateSMP1([]byte("secret"))
+	c.Assert(err, IsNil)
+	m1.question = []byte("question?")
+
+	c.Assert(bob.receiveSMP1(m1.tlv().tlvValue), IsNil)
+	c.Assert(bob.smp.received1.question, DeepEquals, []byte("question?"))
+	c.Assert(bob.smp.received1.g2a.Equals(m1.g2a), Equals, true)
+	c.Assert(bob.smp.received1.d3.Equals(m1.d3), Equals, true)
+
+	m2, err := bob.generateSMP2([]byte("secret"))
+	c.Assert(err, IsNil)
+
+	m2b := &smp2Message{}
+	c.Assert(m2b.deserialize(m2.tlv().tlvValue), IsNil)
+	c.Assert(m2b.tlv(), DeepEquals, m2.tlv())
+
+	c.Assert(m2b.deserialize(m2.tlv().tlvValue[1:]), Equals, errMalformedMessage)
+	c.Assert(m2b.deserialize(append(m2.tlv().tlvValue, 0x00)), Equals, errMalformedMessage)
+}
+
+func (s *OTR4Suite) Test_SMPAbortsOnInvalidProof(c *C) {
+	aliceConv, bobConv := establishTestSession(c)
+	alice, bob := watchSMP(aliceConv), watchSMP(bobConv)
+
+	m1, err := aliceConv.generateSMP1([]byte("secret"))
+	c.Assert(err, IsNil)
+	m1.d2 = m1.d3
+
+	toSend, err := aliceConv.sendTLVs(m1.tlv())
+	c.Assert(err, IsNil)
+
+	reply := deliver(c, bobConv, toSend)
+	c.Assert(bob.secretNeeded, Equals, 0)
+	c.Assert(bobConv.smp, IsNil)
+
+	c.Assert(deliver(c, aliceConv, reply), IsNil)
+	c.Assert(aliceConv.smp, IsNil)
+	c.Assert(alice.aborted, Equals, 1)
+	c.Assert(alice.results, HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_IsValidSMPPoint(c *C) {
+	c.Assert(isValidSMPPoint(ed448.BasePoint, g2), Equals, true)
+	c.Assert(isValidSMPPoint(ed448.BasePoint, ed448.NewPointFromBytes()), Equals, false)
+}
+
+func (s *OTR4Suite) Test_SMPRejectsTheIdentityPoint(c *C) {
+	alice, bob := establishTestSession(c)
+	identity := ed448.NewPointFromBytes()
+
+	m1, err := alice.generateSMP1([]byte("secret"))
+	c.Assert(err, IsNil)
+	for _, p := range []*ed448.Point{&m1.g2a, &m1.g3a} {
+		valid := *p
+		*p = identity
+		c.Assert(bob.receiveSMP1(m1.tlv().tlvValue), Equals, errInvalidPublicKey)
+		*p = valid
+	}
+	c.Assert(bob.receiveSMP1(m1.tlv().tlvValue), IsNil)
+
+	m2, err := bob.generateSMP2([]byte("secret"))
+	c.Assert(err, IsNil)
+	for _, p := range []*ed448.Point{&m2.g2b, &m2.g3b, &m2.pb, &m2.qb} {
+		valid := *p
+		*p = identity
+		_, err = alice.receiveSMP2(m2.tlv().tlvValue)
+		c.Assert(err, Equals, errInvalidPublicKey)
+		*p = valid
+	}
+	m3, err := alice.receiveSMP2(m2.tlv().tlvValue)
+	c.Assert(err, IsNil)
+
+	for _, p := range []*ed448.Point{&m3.pa, &m3.qa, &m3.ra} {
+		valid := *p
+		*p = identity
+		_, _, err = bob.receiveSMP3(m3.tlv().tlvValue)
+		c.Assert(err, Equals, errInvalidPublicKey)
+		*p = valid
+	}
+	m4, _, err := bob.receiveSMP3(m3.tlv().tlvValue)
+	c.Assert(err, IsNil)
+
+	m4.rb = identity
+	_, err = alice.receiveSMP4(m4.tlv().tlvValue)
+	c.Assert(err, Equals, errInvalidPublicKey)
+}
+
+func (s *OTR4Suite) Test_SMPAbortsOnUnexpectedMessage(c *C) {
+	aliceConv, bobConv := establishTestSession(c)
+	alice := watchSMP(aliceConv)
+
+	smp1, err := aliceConv.StartSMP([]byte("secret"))
+	c.Assert(err, IsNil)
+
+	toSend, err := aliceConv.sendTLVs(tlv{tlvType: tlvTypeSMP3, tlvValue: []byte{0x01}})
+	c.Assert(err, IsNil)
+
+	c.Assert(deliver(c, bobConv, smp1), IsNil)
+	reply := deliver(c, bobConv, toSend)
+	c.Assert(bobConv.smp, IsNil)
+
+	plain, tlvs := parsePayload(decryptTestMessage(c, aliceConv, reply))
+	c.Assert(plain, HasLen, 0)
+	c.Assert(tlvs, DeepEquals, []tlv{{tlvType: tlvTypeSMPAbort, tlvValue: []byte{}}})
+
+	c.Assert(aliceConv.processTLVs(tlvs, nil), IsNil)
+	c.Assert(aliceConv.smp, IsNil)
+	c.Assert(alice.aborted, Equals, 1)
+}
+
+func decryptTestMessage(c *C, receiver *Conversation, toSend [][]byte) []byte {
+	c.Assert(toSend, HasLen, 1)
+
+	payload, _, err := receiver.receiveDataMessage(decodeTestMessage(c, toSend[0]))
+	c.Assert(err, IsNil)
+
+	return payload
+}
+
+func (s *OTR4Suite) Test_AbortSMP(c *C) {
+	aliceConv, bobConv := establishTestSession(c)
+	bob := watchSMP(bobConv)
+
+	smp1, err := aliceConv.StartSMP([]byte("secret"))
+	c.Assert(err, IsNil)
+	c.Assert(deliver(c, bobConv, smp1), IsNil)
+
+	abort, err := aliceConv.AbortSMP()
+	c.Assert(err, IsNil)
+	c.Assert(aliceConv.smp, IsNil)
+
+	c.Assert(deliver(c, bobConv, abort), IsNil)
+	c.Assert(bobConv.smp, IsNil)
+	c.Assert(bob.aborted, Equals, 1)
+
+	_, err = bobConv.ProvideSMPSecret([]byte("secret"))
+	c.Assert(err, Equals, errNoSMPRequest)
+}
+
+func (s *OTR4Suite) Test_RestartingSMPAbortsThePreviousOne(c *C) {
+	aliceConv, bobConv := establishTestSession(c)
+	bob := watchSMP(bobConv)
+
+	_, err := aliceConv.StartSMP([]byte("secret"))
+	c.Assert(err, IsNil)
+
+	smp1, err := aliceConv.StartSMP([]byte("secret"))
+	c.Assert(err, IsNil)
+
+	plain, tlvs := parsePayload(decryptTestMessage(c, bobConv, smp1))
+	c.Assert(plain, HasLen, 0)
+	c.Assert(tlvs, HasLen, 2)
+	c.Assert(tlvs[0].tlvType, Equals, uint16(tlvTypeSMPAbort))
+	c.Assert(tlvs[1].tlvType, Equals, uint16(tlvTypeSMP1))
+
+	c.Assert(bobConv.processTLVs(tlvs, nil), IsNil)
+	c.Assert(bob.secretNeeded, Equals, 1)
+}
+
+func (s *OTR4Suite) Test_SMPRequiresAnEstablishedSession(c *C) {
+	alice := newTestConversation(c, 0x101)
+
+	_, err := alice.StartSMP([]byte("secret"))
+	c.Assert(err, Equals, errSessionNotReady)
+
+	_, err = alice.ProvideSMPSecret([]byte("secret"))
+	c.Assert(err, Equals, errNoSMPRequest)
+}
+
+func (s *OTR4Suite) Test_SMPWithQuestion(c *C) {
+	aliceConv, bobConv := establishTestSession(c)
+	bob := watchSMP(bobConv)
+
+	smp1, err := aliceConv.StartSMPWithQuestion("Where did we meet?", []byte("Caf\u00e9"))
+	c.Assert(err, IsNil)
+
+	c.Assert(deliver(c, bobConv, smp1), IsNil)
+	c.Assert(bob.secretNeeded, Equals, 1)
+	c.Assert(bob.question, Equals, "Where did we meet?")
+}
+
+func (s *OTR4Suite) Test_SMPWithoutQuestion(c *C) {
+	_, bob := runSMP(c, "secret", "secret")
+
+	c.Assert(bob.question, Equals, "")
+}
+
+func (s *OTR4Suite) Test_SMPSecretsAreNormalizedToNFC(c *C) {
+	alice, bob := runSMP(c, "Caf\u00e9", "Cafe\u0301")
+
+	c.Assert(alice.results, DeepEquals, []bool{true})
+	c.Assert(bob.results, DeepEquals, []bool{true})
+}
+
+func (s *OTR4Suite) Test_SMPNormalization(c *C) {
+	n := SMPNormalization{}
+	c.Assert(n.normalize([]byte("Caf\u00e9")), DeepEquals, []byte("Caf\u00e9"))
+	c.Assert(n.normalize([]byte("Cafe\u0301")), DeepEquals, []byte("Caf\u00e9"))
+	c.Assert(n.normalize([]byte(" Caf\u00e9 ")), DeepEquals, []byte(" Caf\u00e9 "))
+
+	n = SMPNormalization{TrimSpace: true}
+	c.Assert(n.normalize([]byte(" \tCafe\u0301\n")), DeepEquals, []byte("Caf\u00e9"))
+
+	n = SMPNormalization{FoldCase: true}
+	c.Assert(n.normalize([]byte("CAFE\u0301")), DeepEquals, []byte("caf\u00e9"))
+	c.Assert(n.normalize([]byte("Stra\u00dfe")), DeepEquals, n.normalize([]byte("STRASSE")))
+	c.Assert(n.normalize([]byte(" caf\u00e9")), Not(DeepEquals), n.normalize([]byte("caf\u00e9")))
+}
+
+func (s *OTR4Suite) Test_SMPNormalizationOptions(c *C) {
+	aliceConv, bobConv := establishTestSession(c)
+	aliceConv.SMPNormalization = SMPNormalization{TrimSpace: true, FoldCase: true}
+	bobConv.SMPNormalization = SMPNormalization{TrimSpace: true, FoldCase: true}
+
+	c.Assert(aliceConv.smpSecret([]byte(" My Secret "), true).Equals(bobConv.smpSecret([]byte("my secret"), false)), Equals, true)
+
+	bobConv.SMPNormalization = SMPNormalization{}
+	c.Assert(aliceConv.smpSecret([]byte(" My Secret "), true).Equals(bobConv.smpSecret([]byte(" My Secret "), false)), Equals, false)
+}
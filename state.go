@@ -0,0 +1,159 @@
+package otr4
+
+// A conversation starts in StateStart, where messages are sent in plaintext.
+// A DAKE takes it to StateEncryptedMessages:
+//
+//	identity sender:   WAITING_AUTH_R -> WAITING_DAKE_DATA_MESSAGE -> encrypted
+//	identity receiver: WAITING_AUTH_I -> encrypted
+//
+// The sender of the Identity message cannot send data messages until it
+// receives the first one from the peer. When the peer sends a Disconnected
+// TLV, the conversation goes to StateFinished, where nothing is sent until
+// the user ends the conversation or a new DAKE starts.
+
+// MessageState tells how messages are exchanged with the peer.
+type MessageState int
+
+const (
+	// StateStart is the state of a conversation without encrypted session:
+	// messages are sent in plaintext.
+	StateStart MessageState = iota
+	// StateEncryptedMessages is the state of a conversation with an
+	// encrypted session.
+	StateEncryptedMessages
+	// StateFinished is the state of a conversation whose encrypted session
+	// was ended by the peer. Messages cannot be sent.
+	StateFinished
+)
+
+func (s MessageState) String() string {
+	switch s {
+	case StateStart:
+		return "START"
+	case StateEncryptedMessages:
+		return "ENCRYPTED_MESSAGES"
+	case StateFinished:
+		return "FINISHED"
+	}
+	return "UNKNOWN"
+}
+
+// dakeState is the progress of the DAKE in progress, if any
+type dakeState int
+
+const (
+	dakeIdle dakeState = iota
+	dakeWaitingAuthR
+	dakeWaitingAuthI
+	dakeWaitingDataMessage
+)
+
+// Warning is an event that should be shown to the user as a security
+// warning.
+type Warning int
+
+const (
+	// WarnUnencryptedMessage is given when a plaintext message is received
+	// while the conversation is encrypted or finished.
+	WarnUnencryptedMessage Warning = iota
+	// WarnUnreadableMessage is given when a data message cannot be
+	// decrypted, or arrives without an encrypted session.
+	WarnUnreadableMessage
+	// WarnSMPVerificationNotStored is given when an SMP exchange succeeds but
+	// the trust store cannot record the fingerprint of the peer as verified.
+	WarnSMPVerificationNotStored
+)
+
+// State returns the message state of the conversation
+func (c *Conversation) State() MessageState {
+	return c.msgState
+}
+
+func (c *Conversation) isEncrypted() bool {
+	return c.msgState == StateEncryptedMessages
+}
+
+func (c *Conversation) setState(s MessageState) {
+	if c.msgState == s {
+		return
+	}
+
+	c.msgState = s
+	if c.StateChanged != nil {
+		c.StateChanged(s)
+	}
+}
+
+func (c *Conversation) warn(w Warning) {
+	if c.SecurityWarning != nil {
+		c.SecurityWarning(w)
+	}
+}
+
+// sessionEstablished is called when a DAKE finishes and we can send data
+// messages
+func (c *Conversation) sessionEstablished() {
+	c.dake = dakeIdle
+	c.setState(StateEncryptedMessages)
+}
+
+// endSession forgets the keys of the encrypted session and of any DAKE in
+// progress
+func (c *Conversation) endSession() {
+	if c.ratchet != nil {
+		c.ratchet.wipe()
+		c.ratchet = nil
+	}
+
+	wipeBytes(c.braceKey)
+	wipeBytes(c.sharedSecret)
+	c.braceKey, c.sharedSecret = nil, nil
+	c.ourECDH, c.ourDH = nil, nil
+	c.dake = dakeIdle
+
+	c.resetSMP()
+}
+
+// receiveDisconnected handles a Disconnected TLV: the peer ended the
+// encrypted session
+func (c *Conversation) receiveDisconnected() {
+	c.endSession()
+	c.setState(StateFinished)
+}
+
+// unreadableMessage returns the error message to send when a data message
+// cannot be read, warning the user. Nothing is sent for messages the peer
+// flagged as ignorable.
+func (c *Conversation) unreadableMessage(msg []byte, code string) [][]byte {
+	m := &dataMessage{}
+	if m.deserialize(msg) == nil && m.flags&flagIgnoreUnreadable != 0 {
+		return nil
+	}
+
+	c.warn(WarnUnreadableMessage)
+	return [][]byte{errorMessage(code)}
+}
+
+// End ends the encrypted session, returning the messages that tell the peer.
+// The conversation goes back to StateStart.
+func (c *Conversation) End() ([][]byte, error) {
+	var toSend [][]byte
+
+	if c.isEncrypted() && c.ratchet != nil {
+		// reveal the MAC keys of everything received
+		r := c.ratchet
+		r.oldMACKeys = append(r.oldMACKeys, r.receivedMACKeys...)
+		r.receivedMACKeys = nil
+
+		var err error
+		toSend, err = c.sendTLVs(disconnectedTLV)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.endSession()
+	c.setState(StateStart)
+
+	return toSend, nil
+}
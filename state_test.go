@@ -0,0 +1,262 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type stateTestEvents struct {
+	states   []MessageState
+	warnings []Warning
+}
+
+func watchState(conv *Conversation) *stateTestEvents {
+	e := &stateTestEvents{}
+	conv.StateChanged = func(s MessageState) { e.states = append(e.states, s) }
+	conv.SecurityWarning = func(w Warning) { e.warnings = append(e.warnings, w) }
+	return e
+}
+
+// tamperDataMessage returns a data message whose authenticator no longer
+// matches
+func tamperDataMessage(c *C, msg []byte) []byte {
+	m := &dataMessage{}
+	c.Assert(m.deserialize(decodeTestMessage(c, msg)), IsNil)
+	m.authenticator[0] ^= 0x01
+	return encodeMessage(m.serialize())
+}
+
+func (s *OTR4Suite) Test_MessageStateString(c *C) {
+	c.Assert(StateStart.String(), Equals, "START")
+	c.Assert(StateEncryptedMessages.String(), Equals, "ENCRYPTED_MESSAGES")
+	c.Assert(StateFinished.String(), Equals, "FINISHED")
+	c.Assert(MessageState(7).String(), Equals, "UNKNOWN")
+}
+
+func (s *OTR4Suite) Test_DAKEStateTransitions(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+	aliceEvents := watchState(alice)
+	bobEvents := watchState(bob)
+
+	identity, err := bob.startDAKE()
+	c.Assert(err, IsNil)
+	c.Assert(bob.dake, Equals, dakeWaitingAuthR)
+
+	_, toSend, err := alice.Receive(encodeMessage(identity))
+	c.Assert(err, IsNil)
+	c.Assert(alice.dake, Equals, dakeWaitingAuthI)
+	c.Assert(alice.State(), Equals, StateStart)
+
+	_, toSend, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(bob.dake, Equals, dakeWaitingDataMessage)
+	c.Assert(bob.State(), Equals, StateStart)
+
+	_, err = bob.Send([]byte("too early"))
+	c.Assert(err, Equals, errSessionNotReady)
+
+	_, _, err = alice.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(alice.dake, Equals, dakeIdle)
+	c.Assert(alice.State(), Equals, StateEncryptedMessages)
+	c.Assert(aliceEvents.states, DeepEquals, []MessageState{StateEncryptedMessages})
+
+	exchangeMessage(c, alice, bob, "hello")
+	c.Assert(bob.dake, Equals, dakeIdle)
+	c.Assert(bob.State(), Equals, StateEncryptedMessages)
+	c.Assert(bobEvents.states, DeepEquals, []MessageState{StateEncryptedMessages})
+
+	exchangeMessage(c, bob, alice, "hello to you")
+}
+
+func (s *OTR4Suite) Test_DAKEMessagesOutOfOrderAreUnexpected(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	identity, err := bob.startDAKE()
+	c.Assert(err, IsNil)
+	_, authR, err := alice.Receive(encodeMessage(identity))
+	c.Assert(err, IsNil)
+	_, authI, err := bob.Receive(authR[0])
+	c.Assert(err, IsNil)
+	_, _, err = alice.Receive(authI[0])
+	c.Assert(err, IsNil)
+
+	_, _, err = bob.Receive(authR[0])
+	c.Assert(err, Equals, errUnexpectedMessage)
+
+	_, _, err = alice.Receive(authI[0])
+	c.Assert(err, Equals, errUnexpectedMessage)
+	c.Assert(alice.State(), Equals, StateEncryptedMessages)
+}
+
+func (s *OTR4Suite) Test_SimultaneousDAKEs(c *C) {
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	aliceIdentity, err := alice.startDAKE()
+	c.Assert(err, IsNil)
+	bobIdentity, err := bob.startDAKE()
+	c.Assert(err, IsNil)
+
+	winner, loser := alice, bob
+	winnerIdentity := aliceIdentity
+	loserIdentity := bobIdentity
+	if alice.ourDH.pub.Cmp(bob.ourDH.pub) < 0 {
+		winner, loser = bob, alice
+		winnerIdentity, loserIdentity = bobIdentity, aliceIdentity
+	}
+
+	// the winner sends its Identity message again, in case the first one
+	// was lost
+	_, toSend, err := winner.Receive(encodeMessage(loserIdentity))
+	c.Assert(err, IsNil)
+	c.Assert(toSend, DeepEquals, [][]byte{encodeMessage(winnerIdentity)})
+	c.Assert(winner.dake, Equals, dakeWaitingAuthR)
+
+	_, toSend, err = loser.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(loser.dake, Equals, dakeWaitingAuthI)
+
+	_, toSend, err = winner.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	_, _, err = loser.Receive(toSend[0])
+	c.Assert(err, IsNil)
+
+	c.Assert(loser.State(), Equals, StateEncryptedMessages)
+	exchangeMessage(c, loser, winner, "hello")
+	c.Assert(winner.State(), Equals, StateEncryptedMessages)
+}
+
+func (s *OTR4Suite) Test_NonInteractiveDAKEStates(c *C) {
+	alice := newTestConversation(c, 0x101)
+	ensemble, bob := newTestPrekeyEnsemble(c)
+
+	msg, err := alice.sendNonInteractiveAuth(ensemble.serialize(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(alice.State(), Equals, StateEncryptedMessages)
+
+	_, _, err = bob.Receive(encodeMessage(msg))
+	c.Assert(err, IsNil)
+	c.Assert(bob.dake, Equals, dakeIdle)
+	c.Assert(bob.State(), Equals, StateEncryptedMessages)
+
+	exchangeMessage(c, bob, alice, "hello")
+}
+
+func (s *OTR4Suite) Test_PlaintextWhileEncryptedIsWarned(c *C) {
+	alice, _ := establishTestSession(c)
+	events := watchState(alice)
+
+	plain, _, err := alice.Receive([]byte("not encrypted"))
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("not encrypted"))
+	c.Assert(events.warnings, DeepEquals, []Warning{WarnUnencryptedMessage})
+
+	conv := newTestConversation(c, 0x103)
+	startEvents := watchState(conv)
+	_, _, err = conv.Receive([]byte("not encrypted"))
+	c.Assert(err, IsNil)
+	c.Assert(startEvents.warnings, HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_UnreadableDataMessage(c *C) {
+	alice, bob := establishTestSession(c)
+	events := watchState(bob)
+
+	toSend, err := alice.Send([]byte("hello"))
+	c.Assert(err, IsNil)
+
+	_, replies, err := bob.Receive(tamperDataMessage(c, toSend[0]))
+	c.Assert(err, Equals, errInvalidMAC)
+	c.Assert(replies, DeepEquals, [][]byte{errorMessage(errorCodeUnreadableMessage)})
+	c.Assert(events.warnings, DeepEquals, []Warning{WarnUnreadableMessage})
+
+	assertReceived(c, bob, toSend[0], "hello")
+}
+
+func (s *OTR4Suite) Test_UnreadableIgnorableDataMessage(c *C) {
+	alice, bob := establishTestSession(c)
+	events := watchState(bob)
+
+	heartbeat, err := alice.createHeartbeat()
+	c.Assert(err, IsNil)
+
+	_, replies, err := bob.Receive(tamperDataMessage(c, encodeMessage(heartbeat)))
+	c.Assert(err, Equals, errInvalidMAC)
+	c.Assert(replies, HasLen, 0)
+	c.Assert(events.warnings, HasLen, 0)
+}
+
+func (s *OTR4Suite) Test_DataMessageWithoutSession(c *C) {
+	alice, _ := establishTestSession(c)
+	toSend, err := alice.Send([]byte("hello"))
+	c.Assert(err, IsNil)
+
+	carol := newTestConversation(c, 0x102)
+	events := watchState(carol)
+
+	_, replies, err := carol.Receive(toSend[0])
+	c.Assert(err, Equals, errUnexpectedMessage)
+	c.Assert(replies, DeepEquals, [][]byte{errorMessage(errorCodeNotInPrivateState)})
+	c.Assert(events.warnings, DeepEquals, []Warning{WarnUnreadableMessage})
+}
+
+func (s *OTR4Suite) Test_EndConversation(c *C) {
+	alice, bob := establishTestSession(c)
+	exchangeMessage(c, alice, bob, "hello")
+	bobEvents := watchState(bob)
+
+	toSend, err := alice.End()
+	c.Assert(err, IsNil)
+	c.Assert(toSend, HasLen, 1)
+	c.Assert(alice.State(), Equals, StateStart)
+	c.Assert(alice.ratchet, IsNil)
+
+	plain, replies, err := bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, HasLen, 0)
+	c.Assert(replies, HasLen, 0)
+	c.Assert(bob.State(), Equals, StateFinished)
+	c.Assert(bob.ratchet, IsNil)
+	c.Assert(bobEvents.states, DeepEquals, []MessageState{StateFinished})
+
+	_, err = bob.Send([]byte("are you there?"))
+	c.Assert(err, Equals, errConversationFinished)
+
+	_, _, err = bob.Receive([]byte("plaintext"))
+	c.Assert(err, IsNil)
+	c.Assert(bobEvents.warnings, DeepEquals, []Warning{WarnUnencryptedMessage})
+
+	toSend, err = bob.End()
+	c.Assert(err, IsNil)
+	c.Assert(toSend, HasLen, 0)
+	c.Assert(bob.State(), Equals, StateStart)
+
+	toSend, err = bob.Send([]byte("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(toSend, DeepEquals, [][]byte{[]byte("hello")})
+}
+
+func (s *OTR4Suite) Test_NewDAKEAfterFinished(c *C) {
+	alice, bob := establishTestSession(c)
+	exchangeMessage(c, alice, bob, "hello")
+
+	toSend, err := alice.End()
+	c.Assert(err, IsNil)
+	_, _, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+
+	_, toSend, err = alice.Receive(bob.QueryMessage())
+	c.Assert(err, IsNil)
+	_, toSend, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	_, toSend, err = alice.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	_, _, err = bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+
+	c.Assert(bob.State(), Equals, StateEncryptedMessages)
+	exchangeMessage(c, bob, alice, "hello again")
+	c.Assert(alice.State(), Equals, StateEncryptedMessages)
+}
@@ -165,7 +165,7 @@ var (
 	}
 
 	testPrivA = &privateKey{
-		ed448.NewScalar([]byte{
+		r: ed448.NewScalar([]byte{
 			0x13, 0x66, 0x00, 0x41, 0x14, 0x93, 0x97, 0x66,
 			0x8a, 0x8d, 0xf2, 0xd3, 0x20, 0x77, 0xa6, 0x5e,
 			0x9b, 0x5f, 0x97, 0x7c, 0x39, 0x34, 0xbe, 0xf3,
@@ -206,7 +206,7 @@ var (
 	}
 
 	testPrivB = &privateKey{
-		ed448.NewScalar([]byte{
+		r: ed448.NewScalar([]byte{
 			0xb9, 0x1c, 0xa1, 0xe6, 0x54, 0xb5, 0xdc, 0x03,
 			0x11, 0x0e, 0x6f, 0xa8, 0x52, 0x6b, 0x3d, 0x7c,
 			0x46, 0xbd, 0xd6, 0x1b, 0x52, 0x8b, 0x18, 0xa4,
@@ -294,61 +294,4 @@ var (
 		0x37, 0x31, 0x39, 0xc2, 0x50, 0xa5, 0xd4, 0x10,
 		0xd6, 0x60,
 	}
-
-	testSigma = &authMessage{
-		ed448.NewScalar([]byte{
-			0xb7, 0x45, 0x7c, 0xd2, 0x31, 0x90, 0xbf, 0xcd,
-			0xcb, 0x09, 0x14, 0x76, 0x87, 0x19, 0xb8, 0xad,
-			0x94, 0xe6, 0x6c, 0x1a, 0x61, 0x9d, 0x2e, 0xcf,
-			0x6b, 0xcf, 0xd3, 0xc8, 0x2b, 0xa3, 0x38, 0x4f,
-			0x00, 0x09, 0x06, 0xb3, 0xce, 0x50, 0xfe, 0x79,
-			0x98, 0x85, 0x84, 0x6c, 0x23, 0xf6, 0x2e, 0xbb,
-			0x6c, 0x13, 0xeb, 0xbe, 0x82, 0x59, 0xd3, 0x11,
-		}),
-		ed448.NewScalar([]byte{
-			0x34, 0x51, 0x89, 0xe2, 0xf6, 0xf6, 0xfb, 0x6a,
-			0xa1, 0xfd, 0xc3, 0xc2, 0x98, 0xc1, 0xe6, 0x84,
-			0x6e, 0xf5, 0x91, 0x59, 0x90, 0x78, 0x7e, 0x9a,
-			0xb0, 0xa7, 0x05, 0xbf, 0x41, 0x2d, 0x70, 0x41,
-			0x98, 0x46, 0xb8, 0x69, 0xf0, 0x84, 0x77, 0x84,
-			0x20, 0x07, 0xc2, 0xe0, 0x26, 0x01, 0x6d, 0xb3,
-			0x9f, 0xc9, 0xbe, 0x99, 0x15, 0x2f, 0x47, 0x20,
-		}),
-		ed448.NewScalar([]byte{
-			0xad, 0x6a, 0xc8, 0x1c, 0xb1, 0x91, 0xef, 0xcb,
-			0xfa, 0x5d, 0x81, 0xbe, 0xf3, 0xa2, 0x01, 0x0f,
-			0xb2, 0x32, 0x97, 0x2c, 0x2c, 0x46, 0xb6, 0xd2,
-			0x55, 0x19, 0xad, 0xb4, 0x57, 0x74, 0xe6, 0x61,
-			0xb0, 0xe2, 0x1a, 0x22, 0x91, 0x82, 0xe4, 0x9a,
-			0xf7, 0xff, 0x82, 0x5b, 0x4f, 0xeb, 0x05, 0x2b,
-			0x0d, 0xcf, 0x78, 0xe0, 0x2, 0x53, 0x6d, 0x33,
-		}),
-		ed448.NewScalar([]byte{
-			0x2c, 0x80, 0x3f, 0x45, 0x89, 0x58, 0x2d, 0x7e,
-			0xda, 0x26, 0x01, 0xa7, 0x78, 0xa6, 0xa6, 0x61,
-			0xa3, 0x56, 0x5c, 0x0b, 0xe0, 0xae, 0x09, 0xea,
-			0x56, 0xce, 0x09, 0x17, 0xc0, 0x98, 0xd5, 0x40,
-			0xe8, 0x9b, 0x18, 0xdf, 0xb7, 0x78, 0x44, 0xc3,
-			0xc9, 0x66, 0x62, 0x85, 0xae, 0xa6, 0xd7, 0x10,
-			0x7b, 0x14, 0xf0, 0x40, 0xd7, 0x72, 0x92, 0x2b,
-		}),
-		ed448.NewScalar([]byte{
-			0xd7, 0xfb, 0x29, 0xa2, 0xd1, 0x3d, 0x98, 0xec,
-			0x18, 0xe8, 0x91, 0x07, 0x22, 0x13, 0xbf, 0x76,
-			0x5a, 0x2f, 0x93, 0xa6, 0xd4, 0xcf, 0xe7, 0x77,
-			0x99, 0x73, 0xbb, 0x20, 0x4e, 0x09, 0xb1, 0xc0,
-			0x68, 0x93, 0xf1, 0xf2, 0x35, 0x28, 0x5b, 0xa3,
-			0x89, 0x9d, 0x76, 0x75, 0x46, 0x5b, 0xe9, 0xa1,
-			0xff, 0x1c, 0x2e, 0x8e, 0xbf, 0x5e, 0x22, 0x15,
-		}),
-		ed448.NewScalar([]byte{
-			0x02, 0x35, 0xbd, 0x52, 0x34, 0x56, 0x9b, 0x58,
-			0x2c, 0x39, 0xaf, 0x2e, 0x92, 0xca, 0x6c, 0x0a,
-			0x81, 0x22, 0x88, 0x38, 0xd3, 0xdd, 0x17, 0x25,
-			0x27, 0xc9, 0x2d, 0xf6, 0x4d, 0xa1, 0xf2, 0x9c,
-			0xbd, 0x08, 0xf4, 0xa0, 0x91, 0x08, 0x79, 0xf6,
-			0x8a, 0x78, 0x3c, 0xf0, 0xac, 0x2d, 0x97, 0x03,
-			0x54, 0xe3, 0xc6, 0x22, 0xb9, 0xf4, 0x55, 0x3a,
-		}),
-	}
 )
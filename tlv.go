@@ -0,0 +1,178 @@
+package otr4
+
+import "bytes"
+
+// TLVs are appended to the plaintext of a data message, separated from it by
+// a NUL byte. The types up to maxReservedTLVType are defined by the spec;
+// applications can register handlers for their own types.
+
+const (
+	tlvTypePadding           = 0x0000
+	tlvTypeDisconnected      = 0x0001
+	tlvTypeSMP1              = 0x0002
+	tlvTypeSMP2              = 0x0003
+	tlvTypeSMP3              = 0x0004
+	tlvTypeSMP4              = 0x0005
+	tlvTypeSMPAbort          = 0x0006
+	tlvTypeExtraSymmetricKey = 0x0007
+
+	maxReservedTLVType = tlvTypeExtraSymmetricKey
+)
+
+// TLVHandler is called with the value of a TLV received in a data message.
+type TLVHandler func(value []byte)
+
+type tlv struct {
+	tlvType  uint16
+	tlvValue []byte
+}
+
+func (t tlv) serialize() []byte {
+	out := appendShort(nil, t.tlvType)
+	out = appendShort(out, uint16(len(t.tlvValue)))
+	return append(out, t.tlvValue...)
+}
+
+func extractTLV(bs []byte) ([]byte, tlv, bool) {
+	cursor, tlvType, ok1 := extractShort(bs)
+	cursor, l, ok2 := extractShort(cursor)
+	if !(ok1 && ok2) || len(cursor) < int(l) {
+		return bs, tlv{}, false
+	}
+
+	return cursor[l:], tlv{tlvType: tlvType, tlvValue: cursor[:l]}, true
+}
+
+// appendTLVs builds the payload of a data message
+func appendTLVs(plaintext []byte, tlvs []tlv) []byte {
+	if len(tlvs) == 0 {
+		return plaintext
+	}
+
+	out := append(append([]byte{}, plaintext...), 0x00)
+	for _, t := range tlvs {
+		out = append(out, t.serialize()...)
+	}
+
+	return out
+}
+
+// parsePayload splits the payload of a data message into the plaintext and
+// its TLVs. Trailing bytes that do not form a TLV are ignored.
+func parsePayload(payload []byte) ([]byte, []tlv) {
+	for i, b := range payload {
+		if b != 0x00 {
+			continue
+		}
+
+		var tlvs []tlv
+		cursor := payload[i+1:]
+		for len(cursor) > 0 {
+			var t tlv
+			var ok bool
+			cursor, t, ok = extractTLV(cursor)
+			if !ok {
+				break
+			}
+			tlvs = append(tlvs, t)
+		}
+
+		return payload[:i], tlvs
+	}
+
+	return payload, nil
+}
+
+func paddingTLV(n int) tlv {
+	return tlv{tlvType: tlvTypePadding, tlvValue: make([]byte, n)}
+}
+
+// padPayload appends a padding TLV to the payload of a data message, making
+// its length a multiple of c.Padding
+func (c *Conversation) padPayload(payload []byte) []byte {
+	if c.Padding <= 0 {
+		return payload
+	}
+
+	out := append([]byte{}, payload...)
+	if bytes.IndexByte(out, 0x00) < 0 {
+		out = append(out, 0x00)
+	}
+
+	// the type and length of the TLV take 4 bytes
+	n := (c.Padding - (len(out)+4)%c.Padding) % c.Padding
+	if n > 0xffff {
+		n = 0xffff
+	}
+
+	return append(out, paddingTLV(n).serialize()...)
+}
+
+var disconnectedTLV = tlv{tlvType: tlvTypeDisconnected}
+
+// RegisterTLVHandler sets the handler called when a TLV of the given type is
+// received. Types defined by the spec cannot be registered. A nil handler
+// removes the registration.
+func (c *Conversation) RegisterTLVHandler(tlvType uint16, handler TLVHandler) error {
+	if tlvType <= maxReservedTLVType {
+		return errReservedTLVType
+	}
+
+	if handler == nil {
+		delete(c.tlvHandlers, tlvType)
+		return nil
+	}
+
+	if c.tlvHandlers == nil {
+		c.tlvHandlers = make(map[uint16]TLVHandler)
+	}
+	c.tlvHandlers[tlvType] = handler
+
+	return nil
+}
+
+// SendTLV returns a data message carrying a TLV of a type defined by the
+// application.
+func (c *Conversation) SendTLV(tlvType uint16, value []byte) ([][]byte, error) {
+	if tlvType <= maxReservedTLVType {
+		return nil, errReservedTLVType
+	}
+
+	if len(value) > 0xFFFF {
+		return nil, errInvalidLength
+	}
+
+	return c.sendTLVs(tlv{tlvType: tlvType, tlvValue: value})
+}
+
+// processTLVs handles the TLVs received in a data message and returns the
+// ones that should be sent back. extraKey is the extra symmetric key of the
+// message.
+func (c *Conversation) processTLVs(tlvs []tlv, extraKey []byte) []tlv {
+	var replies []tlv
+	disconnected := false
+
+	for _, t := range tlvs {
+		switch t.tlvType {
+		case tlvTypePadding:
+		case tlvTypeDisconnected:
+			disconnected = true
+		case tlvTypeSMP1, tlvTypeSMP2, tlvTypeSMP3, tlvTypeSMP4, tlvTypeSMPAbort:
+			replies = append(replies, c.receiveSMP(t)...)
+		case tlvTypeExtraSymmetricKey:
+			c.receiveExtraSymmetricKey(t, extraKey)
+		default:
+			if handler, ok := c.tlvHandlers[t.tlvType]; ok {
+				handler(t.tlvValue)
+			}
+		}
+	}
+
+	// nothing can be sent back once the peer has ended the session
+	if disconnected {
+		c.receiveDisconnected()
+		return nil
+	}
+
+	return replies
+}
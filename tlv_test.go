@@ -0,0 +1,136 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *OTR4Suite) Test_TLVSerialization(c *C) {
+	t := tlv{tlvType: tlvTypeSMP4, tlvValue: []byte{0x01, 0x02, 0x03}}
+	expected := []byte{0x00, 0x05, 0x00, 0x03, 0x01, 0x02, 0x03}
+
+	c.Assert(t.serialize(), DeepEquals, expected)
+
+	cursor, t2, ok := extractTLV(append(expected, 0xFF))
+	c.Assert(ok, Equals, true)
+	c.Assert(t2, DeepEquals, t)
+	c.Assert(cursor, DeepEquals, []byte{0xFF})
+}
+
+func (s *OTR4Suite) Test_ExtractTLVRejectsTruncatedInput(c *C) {
+	ser := tlv{tlvType: tlvTypeSMP1, tlvValue: []byte{0x01, 0x02}}.serialize()
+
+	for l := 0; l < len(ser); l++ {
+		_, _, ok := extractTLV(ser[:l])
+		c.Assert(ok, Equals, false)
+	}
+}
+
+func (s *OTR4Suite) Test_PayloadWithTLVs(c *C) {
+	tlvs := []tlv{
+		{tlvType: tlvTypeSMP1, tlvValue: []byte{0x01}},
+		{tlvType: tlvTypeSMPAbort, tlvValue: []byte{}},
+	}
+
+	payload := appendTLVs([]byte("hi"), tlvs)
+	c.Assert(payload, DeepEquals, []byte{
+		'h', 'i', 0x00,
+		0x00, 0x02, 0x00, 0x01, 0x01,
+		0x00, 0x06, 0x00, 0x00,
+	})
+
+	plain, tlvs2 := parsePayload(payload)
+	c.Assert(plain, DeepEquals, []byte("hi"))
+	c.Assert(tlvs2, DeepEquals, tlvs)
+}
+
+func (s *OTR4Suite) Test_PayloadWithoutTLVs(c *C) {
+	c.Assert(appendTLVs([]byte("hi"), nil), DeepEquals, []byte("hi"))
+
+	plain, tlvs := parsePayload([]byte("hi"))
+	c.Assert(plain, DeepEquals, []byte("hi"))
+	c.Assert(tlvs, IsNil)
+}
+
+func (s *OTR4Suite) Test_PayloadIgnoresTrailingGarbage(c *C) {
+	payload := appendTLVs(nil, []tlv{{tlvType: tlvTypeSMPAbort, tlvValue: []byte{}}})
+
+	_, tlvs := parsePayload(append(payload, 0x00, 0x02, 0x00))
+	c.Assert(tlvs, HasLen, 1)
+	c.Assert(tlvs[0].tlvType, Equals, uint16(tlvTypeSMPAbort))
+}
+
+func (s *OTR4Suite) Test_PaddingAndDisconnectedTLVs(c *C) {
+	c.Assert(paddingTLV(3).serialize(), DeepEquals, []byte{0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00})
+	c.Assert(disconnectedTLV.serialize(), DeepEquals, []byte{0x00, 0x01, 0x00, 0x00})
+
+	conv := &Conversation{}
+	c.Assert(conv.processTLVs([]tlv{paddingTLV(10), disconnectedTLV}, nil), IsNil)
+}
+
+func (s *OTR4Suite) Test_PadPayload(c *C) {
+	conv := &Conversation{}
+	c.Assert(conv.padPayload([]byte("hi")), DeepEquals, []byte("hi"))
+
+	conv.Padding = 16
+	padded := conv.padPayload([]byte("hi"))
+	c.Assert(padded, HasLen, 16)
+
+	plain, tlvs := parsePayload(padded)
+	c.Assert(plain, DeepEquals, []byte("hi"))
+	c.Assert(tlvs, DeepEquals, []tlv{paddingTLV(9)})
+
+	// the padding follows the TLVs already in the payload
+	padded = conv.padPayload(appendTLVs([]byte("hi"), []tlv{disconnectedTLV}))
+	c.Assert(padded, HasLen, 16)
+
+	plain, tlvs = parsePayload(padded)
+	c.Assert(plain, DeepEquals, []byte("hi"))
+	c.Assert(tlvs, HasLen, 2)
+	c.Assert(tlvs[0].tlvType, Equals, uint16(tlvTypeDisconnected))
+	c.Assert(tlvs[1], DeepEquals, paddingTLV(5))
+}
+
+func (s *OTR4Suite) Test_RegisterTLVHandler(c *C) {
+	conv := &Conversation{}
+
+	for _, t := range []uint16{tlvTypePadding, tlvTypeSMP1, tlvTypeExtraSymmetricKey} {
+		c.Assert(conv.RegisterTLVHandler(t, func([]byte) {}), Equals, errReservedTLVType)
+	}
+
+	var received [][]byte
+	c.Assert(conv.RegisterTLVHandler(0x0100, func(value []byte) {
+		received = append(received, value)
+	}), IsNil)
+
+	conv.processTLVs([]tlv{
+		{tlvType: 0x0100, tlvValue: []byte("one")},
+		{tlvType: 0x0101, tlvValue: []byte("unknown")},
+		{tlvType: 0x0100, tlvValue: []byte("two")},
+	}, nil)
+	c.Assert(received, DeepEquals, [][]byte{[]byte("one"), []byte("two")})
+
+	c.Assert(conv.RegisterTLVHandler(0x0100, nil), IsNil)
+	conv.processTLVs([]tlv{{tlvType: 0x0100, tlvValue: []byte("three")}}, nil)
+	c.Assert(received, HasLen, 2)
+}
+
+func (s *OTR4Suite) Test_SendTLV(c *C) {
+	alice, bob := establishTestSession(c)
+
+	var received []byte
+	c.Assert(bob.RegisterTLVHandler(0x0100, func(value []byte) { received = value }), IsNil)
+
+	toSend, err := alice.SendTLV(0x0100, []byte("application data"))
+	c.Assert(err, IsNil)
+
+	plain, _, err := bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, HasLen, 0)
+	c.Assert(received, DeepEquals, []byte("application data"))
+
+	_, err = alice.SendTLV(tlvTypeDisconnected, nil)
+	c.Assert(err, Equals, errReservedTLVType)
+
+	_, err = alice.SendTLV(0x0100, make([]byte, 0x10000))
+	c.Assert(err, Equals, errInvalidLength)
+}
@@ -0,0 +1,342 @@
+package otr4
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TrustLevel is how much we trust that a fingerprint belongs to a peer.
+type TrustLevel int
+
+const (
+	// TrustUnverified fingerprints have only been seen, and are trusted on
+	// first use.
+	TrustUnverified TrustLevel = iota
+	// TrustManuallyVerified fingerprints have been checked by the user.
+	TrustManuallyVerified
+	// TrustSMPVerified fingerprints have been checked with the Socialist
+	// Millionaires Protocol.
+	TrustSMPVerified
+	// TrustRevoked fingerprints must not be used anymore.
+	TrustRevoked
+)
+
+var trustLevelNames = []string{"unverified", "manually-verified", "smp-verified", "revoked"}
+
+func (l TrustLevel) String() string {
+	if l < 0 || int(l) >= len(trustLevelNames) {
+		return "unknown"
+	}
+	return trustLevelNames[l]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (l TrustLevel) MarshalText() ([]byte, error) {
+	if l.String() == "unknown" {
+		return nil, errUnknownTrustLevel
+	}
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (l *TrustLevel) UnmarshalText(text []byte) error {
+	for i, name := range trustLevelNames {
+		if name == string(text) {
+			*l = TrustLevel(i)
+			return nil
+		}
+	}
+	return errUnknownTrustLevel
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (f Fingerprint) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (f *Fingerprint) UnmarshalText(text []byte) error {
+	parsed, err := ParseFingerprint(string(text))
+	if err != nil {
+		return err
+	}
+
+	*f = parsed
+	return nil
+}
+
+// TrustEvent is what happened when a peer authenticated with a fingerprint.
+type TrustEvent int
+
+const (
+	// TrustNewPeer means no fingerprint was known for the peer: the one it
+	// used is now trusted on first use.
+	TrustNewPeer TrustEvent = iota
+	// TrustKnownFingerprint means the peer used a fingerprint known for it.
+	TrustKnownFingerprint
+	// TrustFingerprintChanged means the peer used a fingerprint we have never
+	// seen, although others are known for it. The user should verify it.
+	TrustFingerprintChanged
+	// TrustRevokedFingerprint means the peer used a revoked fingerprint.
+	TrustRevokedFingerprint
+)
+
+// A TrustEntry records a fingerprint known for a peer.
+type TrustEntry struct {
+	Fingerprint Fingerprint `json:"fingerprint"`
+	Level       TrustLevel  `json:"level"`
+	FirstSeen   time.Time   `json:"firstSeen"`
+	LastSeen    time.Time   `json:"lastSeen"`
+}
+
+// A TrustBackend persists the fingerprints known for the peers of every
+// account.
+type TrustBackend interface {
+	// Load returns the entries known for a peer, or none if the peer is
+	// unknown.
+	Load(account, peer string) ([]TrustEntry, error)
+	// Store replaces the entries known for a peer.
+	Store(account, peer string, entries []TrustEntry) error
+}
+
+type trustRecords map[string]map[string][]TrustEntry
+
+func (r trustRecords) load(account, peer string) []TrustEntry {
+	return append([]TrustEntry(nil), r[account][peer]...)
+}
+
+func (r trustRecords) store(account, peer string, entries []TrustEntry) {
+	peers, ok := r[account]
+	if !ok {
+		peers = make(map[string][]TrustEntry)
+		r[account] = peers
+	}
+
+	peers[peer] = append([]TrustEntry(nil), entries...)
+}
+
+type memoryTrustBackend struct {
+	records trustRecords
+}
+
+// NewMemoryTrustBackend returns a backend keeping entries in memory only.
+func NewMemoryTrustBackend() TrustBackend {
+	return &memoryTrustBackend{records: make(trustRecords)}
+}
+
+func (b *memoryTrustBackend) Load(account, peer string) ([]TrustEntry, error) {
+	return b.records.load(account, peer), nil
+}
+
+func (b *memoryTrustBackend) Store(account, peer string, entries []TrustEntry) error {
+	b.records.store(account, peer, entries)
+	return nil
+}
+
+type jsonTrustBackend struct {
+	path string
+}
+
+// NewJSONTrustBackend returns a backend keeping entries in a JSON file, which
+// is created on the first write.
+func NewJSONTrustBackend(path string) TrustBackend {
+	return &jsonTrustBackend{path: path}
+}
+
+func (b *jsonTrustBackend) read() (trustRecords, error) {
+	records := make(trustRecords)
+
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (b *jsonTrustBackend) Load(account, peer string) ([]TrustEntry, error) {
+	records, err := b.read()
+	if err != nil {
+		return nil, err
+	}
+
+	return records.load(account, peer), nil
+}
+
+func (b *jsonTrustBackend) Store(account, peer string, entries []TrustEntry) error {
+	records, err := b.read()
+	if err != nil {
+		return err
+	}
+	records.store(account, peer, entries)
+
+	data, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(b.path, data)
+}
+
+// writeFileAtomically replaces the file at path with data, so that it is
+// never left half-written
+func writeFileAtomically(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	err = firstError(err, f.Sync(), f.Close())
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// A TrustStore remembers the fingerprints used by the peers of every account,
+// and how much they are trusted.
+type TrustStore struct {
+	backend TrustBackend
+	lock    sync.Mutex
+}
+
+// NewTrustStore returns a trust store keeping its entries in backend.
+func NewTrustStore(backend TrustBackend) *TrustStore {
+	return &TrustStore{backend: backend}
+}
+
+// Fingerprints returns the fingerprints known for a peer.
+func (s *TrustStore) Fingerprints(account, peer string) ([]TrustEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.backend.Load(account, peer)
+}
+
+// Seen records that a peer authenticated with a fingerprint, and tells what
+// it means for its trust.
+func (s *TrustStore) Seen(account, peer string, f Fingerprint) (TrustEvent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries, err := s.backend.Load(account, peer)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	event := TrustFingerprintChanged
+	if len(entries) == 0 {
+		event = TrustNewPeer
+	}
+
+	i := findTrustEntry(entries, f)
+	if i >= 0 {
+		event = TrustKnownFingerprint
+		if entries[i].Level == TrustRevoked {
+			event = TrustRevokedFingerprint
+		}
+		entries[i].LastSeen = now
+	} else {
+		entries = append(entries, TrustEntry{
+			Fingerprint: f,
+			Level:       TrustUnverified,
+			FirstSeen:   now,
+			LastSeen:    now,
+		})
+	}
+
+	return event, s.backend.Store(account, peer, entries)
+}
+
+// Verify records that the user checked the fingerprint of a peer.
+func (s *TrustStore) Verify(account, peer string, f Fingerprint) error {
+	return s.setLevel(account, peer, f, TrustManuallyVerified)
+}
+
+// Revoke records that a fingerprint must not be trusted for a peer anymore.
+func (s *TrustStore) Revoke(account, peer string, f Fingerprint) error {
+	return s.setLevel(account, peer, f, TrustRevoked)
+}
+
+// verifiedBySMP records a successful SMP exchange with a peer. It does not
+// restore trust in a revoked fingerprint.
+func (s *TrustStore) verifiedBySMP(account, peer string, f Fingerprint) error {
+	return s.setLevel(account, peer, f, TrustSMPVerified)
+}
+
+func (s *TrustStore) setLevel(account, peer string, f Fingerprint, level TrustLevel) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries, err := s.backend.Load(account, peer)
+	if err != nil {
+		return err
+	}
+
+	i := findTrustEntry(entries, f)
+	if i < 0 {
+		now := time.Now()
+		entries = append(entries, TrustEntry{Fingerprint: f, FirstSeen: now, LastSeen: now})
+		i = len(entries) - 1
+	}
+
+	if entries[i].Level == TrustRevoked && level == TrustSMPVerified {
+		return nil
+	}
+	entries[i].Level = level
+
+	return s.backend.Store(account, peer, entries)
+}
+
+func findTrustEntry(entries []TrustEntry, f Fingerprint) int {
+	for i := range entries {
+		if entries[i].Fingerprint.Equal(f) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkTrust records the fingerprint of the client profile the peer
+// authenticated with in the trust store, if there is one, and refuses revoked
+// fingerprints
+func (c *Conversation) checkTrust(theirProfile *clientProfile) error {
+	if c.TrustStore == nil {
+		return nil
+	}
+
+	f := theirProfile.fingerprint()
+	event, err := c.TrustStore.Seen(c.Account, c.Peer, f)
+	if err != nil {
+		return err
+	}
+
+	if c.FingerprintSeen != nil {
+		c.FingerprintSeen(event, f)
+	}
+
+	if event == TrustRevokedFingerprint {
+		return errRevokedFingerprint
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package otr4
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func otherTestFingerprint() Fingerprint {
+	f := testFingerprint()
+	f[0] ^= 0xff
+	return f
+}
+
+func (s *OTR4Suite) Test_TrustLevelText(c *C) {
+	for _, l := range []TrustLevel{TrustUnverified, TrustManuallyVerified, TrustSMPVerified, TrustRevoked} {
+		text, err := l.MarshalText()
+		c.Assert(err, IsNil)
+
+		var parsed TrustLevel
+		c.Assert(parsed.UnmarshalText(text), IsNil)
+		c.Assert(parsed, Equals, l)
+	}
+
+	_, err := TrustLevel(42).MarshalText()
+	c.Assert(err, Equals, errUnknownTrustLevel)
+
+	var l TrustLevel
+	c.Assert(l.UnmarshalText([]byte("trusted")), Equals, errUnknownTrustLevel)
+}
+
+func (s *OTR4Suite) Test_TrustOnFirstUse(c *C) {
+	store := NewTrustStore(NewMemoryTrustBackend())
+
+	event, err := store.Seen("alice@example.org", "bob@example.org", testFingerprint())
+	c.Assert(err, IsNil)
+	c.Assert(event, Equals, TrustNewPeer)
+
+	entries, err := store.Fingerprints("alice@example.org", "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Fingerprint, Equals, testFingerprint())
+	c.Assert(entries[0].Level, Equals, TrustUnverified)
+	c.Assert(entries[0].FirstSeen.IsZero(), Equals, false)
+
+	event, err = store.Seen("alice@example.org", "bob@example.org", testFingerprint())
+	c.Assert(err, IsNil)
+	c.Assert(event, Equals, TrustKnownFingerprint)
+
+	again, err := store.Fingerprints("alice@example.org", "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(again, HasLen, 1)
+	c.Assert(again[0].FirstSeen.Equal(entries[0].FirstSeen), Equals, true)
+	c.Assert(again[0].LastSeen.Before(entries[0].LastSeen), Equals, false)
+}
+
+func (s *OTR4Suite) Test_TrustFingerprintChange(c *C) {
+	store := NewTrustStore(NewMemoryTrustBackend())
+
+	_, err := store.Seen("alice@example.org", "bob@example.org", testFingerprint())
+	c.Assert(err, IsNil)
+
+	event, err := store.Seen("alice@example.org", "bob@example.org", otherTestFingerprint())
+	c.Assert(err, IsNil)
+	c.Assert(event, Equals, TrustFingerprintChanged)
+
+	event, err = store.Seen("alice@example.org", "carol@example.org", otherTestFingerprint())
+	c.Assert(err, IsNil)
+	c.Assert(event, Equals, TrustNewPeer)
+
+	event, err = store.Seen("dave@example.org", "bob@example.org", otherTestFingerprint())
+	c.Assert(err, IsNil)
+	c.Assert(event, Equals, TrustNewPeer)
+}
+
+func (s *OTR4Suite) Test_TrustLevels(c *C) {
+	store := NewTrustStore(NewMemoryTrustBackend())
+
+	c.Assert(store.Verify("alice@example.org", "bob@example.org", testFingerprint()), IsNil)
+	c.Assert(store.verifiedBySMP("alice@example.org", "bob@example.org", otherTestFingerprint()), IsNil)
+
+	entries, err := store.Fingerprints("alice@example.org", "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Assert(entries[0].Level, Equals, TrustManuallyVerified)
+	c.Assert(entries[1].Level, Equals, TrustSMPVerified)
+
+	c.Assert(store.Revoke("alice@example.org", "bob@example.org", otherTestFingerprint()), IsNil)
+	c.Assert(store.verifiedBySMP("alice@example.org", "bob@example.org", otherTestFingerprint()), IsNil)
+
+	event, err := store.Seen("alice@example.org", "bob@example.org", otherTestFingerprint())
+	c.Assert(err, IsNil)
+	c.Assert(event, Equals, TrustRevokedFingerprint)
+
+	entries, err = store.Fingerprints("alice@example.org", "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(entries[1].Level, Equals, TrustRevoked)
+}
+
+func (s *OTR4Suite) Test_JSONTrustBackend(c *C) {
+	path := filepath.Join(c.MkDir(), "trust.json")
+
+	store := NewTrustStore(NewJSONTrustBackend(path))
+
+	entries, err := store.Fingerprints("alice@example.org", "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	_, err = store.Seen("alice@example.org", "bob@example.org", testFingerprint())
+	c.Assert(err, IsNil)
+	c.Assert(store.Verify("alice@example.org", "bob@example.org", testFingerprint()), IsNil)
+	_, err = store.Seen("alice@example.org", "carol@example.org", otherTestFingerprint())
+	c.Assert(err, IsNil)
+
+	reopened := NewTrustStore(NewJSONTrustBackend(path))
+
+	entries, err = reopened.Fingerprints("alice@example.org", "bob@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Fingerprint, Equals, testFingerprint())
+	c.Assert(entries[0].Level, Equals, TrustManuallyVerified)
+
+	entries, err = reopened.Fingerprints("alice@example.org", "carol@example.org")
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	var raw map[string]map[string][]map[string]interface{}
+	c.Assert(json.Unmarshal(data, &raw), IsNil)
+	c.Assert(raw["alice@example.org"]["bob@example.org"][0]["fingerprint"], Equals, testFingerprintString)
+	c.Assert(raw["alice@example.org"]["bob@example.org"][0]["level"], Equals, "manually-verified")
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+}
+
+func (s *OTR4Suite) Test_JSONTrustBackendRejectsCorruptFiles(c *C) {
+	path := filepath.Join(c.MkDir(), "trust.json")
+	c.Assert(ioutil.WriteFile(path, []byte("{"), 0600), IsNil)
+
+	_, err := NewTrustStore(NewJSONTrustBackend(path)).Fingerprints("alice@example.org", "bob@example.org")
+	c.Assert(err, NotNil)
+
+	_, err = os.Stat(path)
+	c.Assert(err, IsNil)
+}
+
+type trustEvents struct {
+	events       []TrustEvent
+	fingerprints []Fingerprint
+}
+
+func watchTrust(conv *Conversation, store *TrustStore, account, peer string) *trustEvents {
+	t := &trustEvents{}
+	conv.TrustStore = store
+	conv.Account = account
+	conv.Peer = peer
+	conv.FingerprintSeen = func(event TrustEvent, f Fingerprint) {
+		t.events = append(t.events, event)
+		t.fingerprints = append(t.fingerprints, f)
+	}
+	return t
+}
+
+func runTrustedDAKE(c *C, alice, bob *Conversation) error {
+	identity, err := alice.startDAKE()
+	c.Assert(err, IsNil)
+
+	authR, err := bob.receiveIdentityMessage(identity)
+	c.Assert(err, IsNil)
+
+	authI, err := alice.receiveAuthRMessage(authR)
+	if err != nil {
+		return err
+	}
+
+	return bob.receiveAuthIMessage(authI)
+}
+
+func (s *OTR4Suite) Test_DAKERecordsFingerprints(c *C) {
+	store := NewTrustStore(NewMemoryTrustBackend())
+
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	aliceEvents := watchTrust(alice, store, "alice", "bob")
+	bobEvents := watchTrust(bob, store, "bob", "alice")
+
+	c.Assert(runTrustedDAKE(c, alice, bob), IsNil)
+	c.Assert(aliceEvents.events, DeepEquals, []TrustEvent{TrustNewPeer})
+	c.Assert(aliceEvents.fingerprints[0], Equals, bob.OurFingerprint())
+	c.Assert(bobEvents.events, DeepEquals, []TrustEvent{TrustNewPeer})
+	c.Assert(bobEvents.fingerprints[0], Equals, alice.OurFingerprint())
+
+	newBob := newTestConversation(c, 0x103)
+	watchTrust(newBob, store, "bob", "alice")
+
+	c.Assert(runTrustedDAKE(c, alice, newBob), IsNil)
+	c.Assert(aliceEvents.events, DeepEquals, []TrustEvent{TrustNewPeer, TrustFingerprintChanged})
+	c.Assert(aliceEvents.fingerprints[1], Equals, newBob.OurFingerprint())
+}
+
+func (s *OTR4Suite) Test_DAKEFailsWithARevokedFingerprint(c *C) {
+	store := NewTrustStore(NewMemoryTrustBackend())
+
+	alice := newTestConversation(c, 0x101)
+	bob := newTestConversation(c, 0x102)
+
+	aliceEvents := watchTrust(alice, store, "alice", "bob")
+	c.Assert(store.Revoke("alice", "bob", bob.OurFingerprint()), IsNil)
+
+	c.Assert(runTrustedDAKE(c, alice, bob), Equals, errRevokedFingerprint)
+	c.Assert(aliceEvents.events, DeepEquals, []TrustEvent{TrustRevokedFingerprint})
+}
+
+func (s *OTR4Suite) Test_SMPVerifiesFingerprints(c *C) {
+	store := NewTrustStore(NewMemoryTrustBackend())
+
+	alice, bob := establishTestSession(c)
+	watchTrust(alice, store, "alice", "bob")
+
+	smp1, err := alice.StartSMP([]byte("our secret"))
+	c.Assert(err, IsNil)
+	bob.SMPSecretNeeded = func(string) {}
+
+	c.Assert(deliver(c, bob, smp1), IsNil)
+	smp2, err := bob.ProvideSMPSecret([]byte("our secret"))
+	c.Assert(err, IsNil)
+	smp3 := deliver(c, alice, smp2)
+	smp4 := deliver(c, bob, smp3)
+	c.Assert(deliver(c, alice, smp4), IsNil)
+
+	entries, err := store.Fingerprints("alice", "bob")
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Fingerprint, Equals, bob.OurFingerprint())
+	c.Assert(entries[0].Level, Equals, TrustSMPVerified)
+}
+
+// failingTrustBackend cannot store anything
+type failingTrustBackend struct {
+	TrustBackend
+}
+
+func (failingTrustBackend) Store(account, peer string, entries []TrustEntry) error {
+	return errors.New("disk full")
+}
+
+func (s *OTR4Suite) Test_SMPWarnsWhenTheVerificationIsNotStored(c *C) {
+	store := NewTrustStore(failingTrustBackend{NewMemoryTrustBackend()})
+
+	alice, bob := establishTestSession(c)
+	watchTrust(alice, store, "alice", "bob")
+
+	var warnings []Warning
+	alice.SecurityWarning = func(w Warning) { warnings = append(warnings, w) }
+	results := watchSMP(alice)
+
+	smp1, err := alice.StartSMP([]byte("our secret"))
+	c.Assert(err, IsNil)
+	bob.SMPSecretNeeded = func(string) {}
+
+	c.Assert(deliver(c, bob, smp1), IsNil)
+	smp2, err := bob.ProvideSMPSecret([]byte("our secret"))
+	c.Assert(err, IsNil)
+	smp3 := deliver(c, alice, smp2)
+	smp4 := deliver(c, bob, smp3)
+	c.Assert(deliver(c, alice, smp4), IsNil)
+
+	c.Assert(results.results, DeepEquals, []bool{true})
+	c.Assert(warnings, DeepEquals, []Warning{WarnSMPVerificationNotStored})
+}
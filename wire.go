@@ -0,0 +1,89 @@
+package otr4
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+// On the wire, encoded messages are sent as "?OTR:" followed by their base64
+// encoding and a ".". Errors are reported to the peer in plaintext, as
+// "?OTR Error: " followed by an error code and a description.
+
+var (
+	encodedMessagePrefix = []byte("?OTR:")
+	encodedMessageSuffix = []byte(".")
+	errorMessagePrefix   = []byte("?OTR Error:")
+)
+
+// error codes sent in error messages
+const (
+	errorCodeUnreadableMessage = "ERROR_1"
+	errorCodeNotInPrivateState = "ERROR_2"
+)
+
+var errorCodeDescriptions = map[string]string{
+	errorCodeUnreadableMessage: "Unreadable message",
+	errorCodeNotInPrivateState: "Not in private state message",
+}
+
+// PeerError is an error reported by the peer in an error message.
+type PeerError struct {
+	// Code is the error code sent by the peer, if any, such as "ERROR_1".
+	Code string
+	// Message is the description of the error.
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	if e.Code == "" {
+		return "otr: the peer reported an error: " + e.Message
+	}
+	return "otr: the peer reported an error: " + e.Code + ": " + e.Message
+}
+
+func isEncoded(msg []byte) bool {
+	return bytes.HasPrefix(msg, encodedMessagePrefix)
+}
+
+func encodeMessage(msg []byte) []byte {
+	out := make([]byte, 0, len(encodedMessagePrefix)+base64.StdEncoding.EncodedLen(len(msg))+len(encodedMessageSuffix))
+	out = append(out, encodedMessagePrefix...)
+	out = append(out, base64.StdEncoding.EncodeToString(msg)...)
+	return append(out, encodedMessageSuffix...)
+}
+
+func decodeMessage(msg []byte) ([]byte, error) {
+	if !isEncoded(msg) || !bytes.HasSuffix(msg, encodedMessageSuffix) {
+		return nil, errMalformedMessage
+	}
+
+	encoded := msg[len(encodedMessagePrefix) : len(msg)-len(encodedMessageSuffix)]
+	out := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(out, encoded)
+	if err != nil {
+		return nil, errMalformedMessage
+	}
+
+	return out[:n], nil
+}
+
+func isErrorMessage(msg []byte) bool {
+	return bytes.HasPrefix(msg, errorMessagePrefix)
+}
+
+func errorMessage(code string) []byte {
+	return []byte(string(errorMessagePrefix) + " " + code + ": " + errorCodeDescriptions[code])
+}
+
+func parseErrorMessage(msg []byte) *PeerError {
+	text := strings.TrimSpace(string(msg[len(errorMessagePrefix):]))
+
+	e := &PeerError{Message: text}
+	if i := strings.Index(text, ":"); i >= 0 && strings.HasPrefix(text, "ERROR_") {
+		e.Code = text[:i]
+		e.Message = strings.TrimSpace(text[i+1:])
+	}
+
+	return e
+}
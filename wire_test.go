@@ -0,0 +1,92 @@
+package otr4
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func decodeTestMessage(c *C, msg []byte) []byte {
+	decoded, err := decodeMessage(msg)
+	c.Assert(err, IsNil)
+	return decoded
+}
+
+func (s *OTR4Suite) Test_EncodeMessage(c *C) {
+	msg := []byte{0x00, 0x04, 0x03, 0xff}
+
+	c.Assert(encodeMessage(msg), DeepEquals, []byte("?OTR:AAQD/w==."))
+	c.Assert(decodeTestMessage(c, encodeMessage(msg)), DeepEquals, msg)
+	c.Assert(isEncoded(encodeMessage(msg)), Equals, true)
+	c.Assert(isEncoded([]byte("hello")), Equals, false)
+}
+
+func (s *OTR4Suite) Test_DecodeMalformedMessage(c *C) {
+	for _, msg := range []string{"?OTR:AAQD/w==", "?OTR:AAQD/w=.", "?OTR:AA*D/w==.", "?OTR", "hello"} {
+		_, err := decodeMessage([]byte(msg))
+		c.Assert(err, Equals, errMalformedMessage)
+	}
+}
+
+func (s *OTR4Suite) Test_ErrorMessage(c *C) {
+	msg := errorMessage(errorCodeUnreadableMessage)
+	c.Assert(msg, DeepEquals, []byte("?OTR Error: ERROR_1: Unreadable message"))
+	c.Assert(isErrorMessage(msg), Equals, true)
+
+	e := parseErrorMessage(msg)
+	c.Assert(e.Code, Equals, errorCodeUnreadableMessage)
+	c.Assert(e.Message, Equals, "Unreadable message")
+	c.Assert(e.Error(), Equals, "otr: the peer reported an error: ERROR_1: Unreadable message")
+
+	e = parseErrorMessage([]byte("?OTR Error:something: went wrong"))
+	c.Assert(e.Code, Equals, "")
+	c.Assert(e.Message, Equals, "something: went wrong")
+}
+
+func (s *OTR4Suite) Test_ReceiveErrorMessage(c *C) {
+	conv := &Conversation{}
+
+	plain, toSend, err := conv.Receive(errorMessage(errorCodeNotInPrivateState))
+	c.Assert(plain, IsNil)
+	c.Assert(toSend, DeepEquals, [][]byte{conv.QueryMessage()})
+	c.Assert(err, DeepEquals, &PeerError{Code: errorCodeNotInPrivateState, Message: "Not in private state message"})
+
+	conv.Policy = AllowV4
+	_, toSend, err = conv.Receive(errorMessage(errorCodeNotInPrivateState))
+	c.Assert(toSend, IsNil)
+	c.Assert(err, NotNil)
+}
+
+func (s *OTR4Suite) Test_ReceiveMalformedEncodedMessage(c *C) {
+	conv := &Conversation{}
+
+	_, _, err := conv.Receive([]byte("?OTR:not base64!."))
+	c.Assert(err, Equals, errMalformedMessage)
+
+	_, _, err = conv.Receive(encodeMessage([]byte{0x00, 0x04}))
+	c.Assert(err, Equals, errInvalidLength)
+}
+
+func (s *OTR4Suite) Test_ReceiveDispatchesOnTheVersion(c *C) {
+	conv := &Conversation{}
+
+	_, _, err := conv.Receive(encodeMessage(messageHeader{version: 3, messageType: dataMsgType}.serialize()))
+	c.Assert(err, Equals, errVersion3Unsupported)
+
+	_, _, err = conv.Receive(encodeMessage(messageHeader{version: 5, messageType: dataMsgType}.serialize()))
+	c.Assert(err, Equals, errInvalidVersion)
+}
+
+func (s *OTR4Suite) Test_ConversationSendsEncodedMessages(c *C) {
+	alice, bob := establishTestSession(c)
+
+	toSend, err := alice.Send([]byte("hi bob"))
+	c.Assert(err, IsNil)
+	c.Assert(isEncoded(toSend[0]), Equals, true)
+
+	_, h, ok := extractHeader(decodeTestMessage(c, toSend[0]))
+	c.Assert(ok, Equals, true)
+	c.Assert(h.messageType, Equals, byte(dataMsgType))
+
+	plain, _, err := bob.Receive(toSend[0])
+	c.Assert(err, IsNil)
+	c.Assert(plain, DeepEquals, []byte("hi bob"))
+}